@@ -0,0 +1,94 @@
+package tg
+
+import (
+	"time"
+)
+
+// broadcastRateDefault is a default number of messages sent per second
+// (see https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this)
+const broadcastRateDefault = 30
+
+// BroadcastOptions contains options for broadcast
+type BroadcastOptions struct {
+
+	// Rate defines max number of messages sent per second.
+	// If zero, default value (30) will be used
+	Rate int
+}
+
+// BroadcastResult contains broadcast summary
+type BroadcastResult struct {
+
+	// Sent contains number of chats message successfully sent to
+	Sent int
+
+	// Failed contains number of chats message failed to send to
+	// (including chats that blocked the bot)
+	Failed int
+
+	// FailedChatIDs contains IDs of chats message failed to send to
+	FailedChatIDs []int64
+
+	// BlockedChatIDs contains IDs of chats that blocked the bot
+	BlockedChatIDs []int64
+
+	// Errors contains errors occurred for each failed chat
+	Errors map[int64]error
+}
+
+// Broadcast sends specified message to every chat from `chatIDs` pacing
+// sends in accordance with options. Chats that blocked the bot are skipped.
+// Error will be returned only if message can not be sent to any chat (e.g.
+// message contains wrong buttons), errors for certain chats are collected
+// into result
+func (t *Telegram) Broadcast(chatIDs []int64, msg SendMessageData, opts BroadcastOptions) (BroadcastResult, error) {
+
+	r := BroadcastResult{
+		Errors: make(map[int64]error),
+	}
+
+	// Check message can be prepared before any sends
+	if _, err := keyboardPrepare(msg.Buttons, msg.ButtonState); err != nil {
+		return r, err
+	}
+
+	rate := opts.Rate
+	if rate <= 0 {
+		rate = broadcastRateDefault
+	}
+
+	tk := time.NewTicker(time.Second / time.Duration(rate))
+	defer tk.Stop()
+
+	for i, chatID := range chatIDs {
+
+		if i > 0 {
+			<-tk.C
+		}
+
+		_, err := t.SendMessage(chatID, 0, msg)
+		if err != nil {
+			// Retry once if flood limit exceeded
+			if e := apiErrorGet(err); e != nil && e.RetryAfter > 0 {
+				time.Sleep(time.Duration(e.RetryAfter) * time.Second)
+				_, err = t.SendMessage(chatID, 0, msg)
+			}
+		}
+
+		if err != nil {
+			r.Failed++
+			r.FailedChatIDs = append(r.FailedChatIDs, chatID)
+			r.Errors[chatID] = err
+
+			if IsBlockedError(err) == true {
+				r.BlockedChatIDs = append(r.BlockedChatIDs, chatID)
+			}
+
+			continue
+		}
+
+		r.Sent++
+	}
+
+	return r, nil
+}
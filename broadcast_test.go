@@ -0,0 +1,31 @@
+package tg
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBroadcastBlocked(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		return testSendError(method, req, "2", http.StatusForbidden, "Forbidden: bot was blocked by the user"), nil
+	})
+
+	r, err := bot.Broadcast([]int64{1, 2, 3}, SendMessageData{Message: "news"}, BroadcastOptions{Rate: 1000})
+	if err != nil {
+		t.Fatalf("broadcast error: %v", err)
+	}
+
+	if r.Sent != 2 || r.Failed != 1 {
+		t.Fatalf("wrong broadcast counts: sent %d, failed %d", r.Sent, r.Failed)
+	}
+	if len(r.BlockedChatIDs) != 1 || r.BlockedChatIDs[0] != 2 {
+		t.Fatalf("wrong blocked chats: %v", r.BlockedChatIDs)
+	}
+	if len(r.FailedChatIDs) != 1 || r.FailedChatIDs[0] != 2 {
+		t.Fatalf("wrong failed chats: %v", r.FailedChatIDs)
+	}
+	if IsBlockedError(r.Errors[2]) == false {
+		t.Fatalf("wrong chat error: %v", r.Errors[2])
+	}
+}
@@ -0,0 +1,66 @@
+package tg
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SplitArgs splits command arguments by whitespaces. Segments enclosed
+// in double or single quotes are treated as a single argument, e.g.
+// `add "John Smith" 42` splits into `add`, `John Smith` and `42`
+func SplitArgs(args string) []string {
+
+	var (
+		res   []string
+		arg   strings.Builder
+		quote rune
+		inArg bool
+	)
+
+	for _, r := range args {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			arg.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg == true {
+				res = append(res, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if inArg == true {
+		res = append(res, arg.String())
+	}
+
+	return res
+}
+
+// ParseCommandArgs splits command arguments with `SplitArgs` and
+// binds them to specified variables positionally. Number of arguments
+// must be equal to number of variables
+func ParseCommandArgs(args string, into ...*string) error {
+
+	a := SplitArgs(args)
+	if len(a) != len(into) {
+		return fmt.Errorf("%w: expected %d, got %d", ErrCommandArgsCount, len(into), len(a))
+	}
+
+	for i, v := range a {
+		*into[i] = v
+	}
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestSplitArgs(t *testing.T) {
+
+	for _, c := range []struct {
+		args string
+		res  []string
+	}{
+		{`add name 42`, []string{"add", "name", "42"}},
+		{`  add   name	 42  `, []string{"add", "name", "42"}},
+		{`add "John Smith" 42`, []string{"add", "John Smith", "42"}},
+		{`add 'John Smith' "it's"`, []string{"add", "John Smith", "it's"}},
+		{`add "" 42`, []string{"add", "", "42"}},
+		{`pre"fix suf"fix`, []string{"prefix suffix"}},
+		{``, nil},
+		{`   `, nil},
+	} {
+		if res := SplitArgs(c.args); reflect.DeepEqual(res, c.res) == false {
+			t.Fatalf("wrong split of `%s`: %q", c.args, res)
+		}
+	}
+}
+
+func TestParseCommandArgs(t *testing.T) {
+
+	var name, age string
+
+	if err := ParseCommandArgs(` "John Smith"   42 `, &name, &age); err != nil {
+		t.Fatalf("parse args error: %v", err)
+	}
+	if name != "John Smith" || age != "42" {
+		t.Fatalf("wrong parsed args: %q, %q", name, age)
+	}
+
+	if err := ParseCommandArgs(`John Smith 42`, &name, &age); errors.Is(err, ErrCommandArgsCount) == false {
+		t.Fatalf("wrong number of args must be reported, got: %v", err)
+	}
+}
+
+// testCommandsBot initializes bot with `help` command having `h` alias.
+// Command handler records executed commands
+func testCommandsBot(t *testing.T, s Settings, aliasesInMenu bool, executed *[]string) *Telegram {
+	return testBotInit(t, nil, s, Description{
+		Commands: []Command{
+			{
+				Command:       "help",
+				Description:   "Show help",
+				Aliases:       []string{"h"},
+				AliasesInMenu: aliasesInMenu,
+				Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+					*executed = append(*executed, cmd)
+					return CommandHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+}
+
+func TestCommandAliases(t *testing.T) {
+
+	var executed []string
+
+	bot := testCommandsBot(t, Settings{}, false, &executed)
+
+	if err := bot.ProcessUpdate(testCommand(1, 1, "/help")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if err := bot.ProcessUpdate(testCommand(2, 1, "/h")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if reflect.DeepEqual(executed, []string{"help", "h"}) == false {
+		t.Fatalf("wrong executed commands: %v", executed)
+	}
+
+	// Aliases are not registered within commands menu by default
+	r := testSent(bot, "setMyCommands")
+	if len(r) != 1 || r[0].Params["commands"] != `[{"command":"help","description":"Show help"}]` {
+		t.Fatalf("wrong commands menu: %v", r)
+	}
+
+	bot = testCommandsBot(t, Settings{}, true, &executed)
+
+	r = testSent(bot, "setMyCommands")
+	if len(r) != 1 || r[0].Params["commands"] != `[{"command":"help","description":"Show help"},{"command":"h","description":"Show help"}]` {
+		t.Fatalf("wrong commands menu: %v", r)
+	}
+}
+
+func TestCommandLookupPointer(t *testing.T) {
+
+	d := Description{
+		Commands: []Command{
+			{Command: "start"},
+			{Command: "help", Aliases: []string{"h"}},
+		},
+	}
+
+	if c := d.commandLookup("help", false); c != &d.Commands[1] {
+		t.Fatal("command lookup must return pointer to the slice element")
+	}
+	if c := d.commandLookup("h", false); c != &d.Commands[1] {
+		t.Fatal("alias lookup must return pointer to the slice element")
+	}
+	if c := d.commandLookup("unknown", false); c != nil {
+		t.Fatalf("unknown command must not be found: %v", c)
+	}
+}
+
+func TestCommandMatching(t *testing.T) {
+
+	for _, c := range []struct {
+		text            string
+		caseInsensitive bool
+		executed        bool
+	}{
+		{"/start", false, true},
+		{"/Start", false, false},
+		{"/Start", true, true},
+		{"/start@" + dryRunBotUserName, false, true},
+		{"/start@Dry_Run_Bot arg", false, true},
+		{"/START@dry_run_bot", true, true},
+		{"/start@other_bot", false, false},
+		{"/start@other_bot", true, false},
+	} {
+
+		var executed []string
+
+		bot := testBotInit(t, nil, Settings{CommandsCaseInsensitive: c.caseInsensitive}, Description{
+			Commands: []Command{
+				{
+					Command: "start",
+					Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+						executed = append(executed, cmd)
+						return CommandHandlerRes{NextState: SessStateBreak()}, nil
+					},
+				},
+			},
+		})
+
+		if err := bot.ProcessUpdate(testCommand(1, 1, c.text)); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+
+		if (len(executed) == 1) != c.executed {
+			t.Fatalf("`%s` (case insensitive: %v): wrong command execution: %v", c.text, c.caseInsensitive, executed)
+		}
+	}
+}
+
+func TestCommandsClear(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if err := bot.CommandsClear(); err != nil {
+		t.Fatalf("commands clear error: %v", err)
+	}
+
+	if err := bot.CommandsClear(
+		CommandScope{Type: CommandScopeAllGroupChats},
+		CommandScope{Type: CommandScopeChatMember, ChatID: -100, UserID: 42},
+	); err != nil {
+		t.Fatalf("commands clear error: %v", err)
+	}
+
+	r := testSent(bot, "deleteMyCommands")
+	if len(r) != 3 {
+		t.Fatalf("expected three delete requests, got %d", len(r))
+	}
+
+	for i, scope := range []string{
+		"",
+		`{"type":"all_group_chats"}`,
+		`{"type":"chat_member","chat_id":-100,"user_id":42}`,
+	} {
+		if r[i].Params["scope"] != scope {
+			t.Fatalf("wrong request %d scope: expected `%s`, got `%s`", i, scope, r[i].Params["scope"])
+		}
+	}
+}
+
+// testAdminBot initializes a bot with `admin` command allowed for user 1 in
+// private chat and in group -100 only. Executed commands and denials are
+// collected into `log`
+func testAdminBot(t *testing.T, deniedHandler bool, log *[]string) *Telegram {
+
+	t.Helper()
+
+	d := Description{
+		Commands: []Command{
+			{
+				Command:        "admin",
+				AllowedUserIDs: []int64{1},
+				AllowedChatIDs: []int64{1, -100},
+				Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+					*log = append(*log, fmt.Sprintf("exec:%d:%d", s.ChatIDGet(), s.UserIDGet()))
+					return CommandHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	}
+
+	if deniedHandler == true {
+		d.CommandDeniedHandler = func(t *Telegram, s *Session, cmd string) (CommandHandlerRes, error) {
+			*log = append(*log, fmt.Sprintf("denied:%s:%d:%d", cmd, s.ChatIDGet(), s.UserIDGet()))
+			return CommandHandlerRes{NextState: SessStateBreak()}, nil
+		}
+	}
+
+	return testBotInit(t, nil, Settings{}, d)
+}
+
+func TestCommandAllowed(t *testing.T) {
+
+	var log []string
+
+	bot := testAdminBot(t, false, &log)
+
+	group := func(updateID int, chatID, userID int64) Update {
+		u := testCommand(updateID, userID, "/admin")
+		u.Message.Chat = &tgbotapi.Chat{ID: chatID, Type: "group"}
+		return u
+	}
+
+	for _, u := range []Update{
+		testCommand(1, 1, "/admin"),
+		testCommand(2, 2, "/admin"),
+		group(3, -100, 1),
+		group(4, -200, 1),
+	} {
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	if fmt.Sprint(log) != "[exec:1:1 exec:-100:1]" {
+		t.Fatalf("wrong executed commands: %v", log)
+	}
+
+	// Denied users are notified with standard message
+	var denied []string
+	for _, r := range testSent(bot, "sendMessage") {
+		if r.Params["text"] == commandDeniedMessage {
+			denied = append(denied, r.Params["chat_id"])
+		}
+	}
+	if fmt.Sprint(denied) != "[2 -200]" {
+		t.Fatalf("wrong denial messages chats: %v", denied)
+	}
+}
+
+func TestCommandDeniedHandler(t *testing.T) {
+
+	var log []string
+
+	bot := testAdminBot(t, true, &log)
+
+	if err := bot.ProcessUpdate(testCommand(1, 2, "/admin")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if fmt.Sprint(log) != "[denied:admin:2:2]" {
+		t.Fatalf("wrong handlers calls: %v", log)
+	}
+	if n := len(testSent(bot, "sendMessage")); n != 0 {
+		t.Fatalf("standard denial message must not be sent with denied handler, got %d messages", n)
+	}
+}
@@ -0,0 +1,64 @@
+package tg
+
+import (
+	"sync"
+	"time"
+)
+
+// updateDedupWindowDefault is a default time window to drop duplicate updates within
+const updateDedupWindowDefault = 10 * time.Second
+
+// updateDedup it is a process-wide duplicate updates filter context structure
+type updateDedup struct {
+	mu      sync.Mutex
+	window  time.Duration
+	seen    map[int]time.Time
+	cleaned time.Time
+}
+
+// updateDedupInit initiates duplicate updates filter
+func updateDedupInit(window time.Duration) *updateDedup {
+	return &updateDedup{
+		window:  window,
+		seen:    make(map[int]time.Time),
+		cleaned: time.Now(),
+	}
+}
+
+// check checks whether the update with specified ID has already
+// been seen within the window. Update ID is not remembered until
+// `commit` is called
+func (d *updateDedup) check(updateID int) bool {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+
+	// Cleanup expired elements once per window
+	if now.Sub(d.cleaned) > d.window {
+		for id, t := range d.seen {
+			if now.Sub(t) > d.window {
+				delete(d.seen, id)
+			}
+		}
+		d.cleaned = now
+	}
+
+	if t, b := d.seen[updateID]; b == true && now.Sub(t) <= d.window {
+		return true
+	}
+
+	return false
+}
+
+// commit remembers the update with specified ID as seen. It must be
+// called only after the update has been successfully absorbed, so
+// the failed one may be redelivered
+func (d *updateDedup) commit(updateID int) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seen[updateID] = time.Now()
+}
@@ -0,0 +1,162 @@
+package tg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestUpdateDedupCheckCommit(t *testing.T) {
+
+	d := updateDedupInit(updateDedupWindowDefault)
+
+	if d.check(1) == true {
+		t.Fatal("update must not be seen before commit")
+	}
+	if d.check(1) == true {
+		t.Fatal("check must not remember update")
+	}
+
+	d.commit(1)
+
+	if d.check(1) == false {
+		t.Fatal("committed update must be seen")
+	}
+	if d.check(2) == true {
+		t.Fatal("other update must not be seen")
+	}
+}
+
+func TestUpdateAbsorbDedupInMemory(t *testing.T) {
+
+	m := miniredis.RunT(t)
+
+	var calls int
+
+	bot := testBotInit(t, m, Settings{Synchronous: true}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			calls++
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	u := testMessage(100, 1, "hello")
+
+	if err := bot.UpdateAbsorb(u); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+
+	// Duplicate must be dropped without Redis round trip
+	m.SetError("redis is down")
+	if err := bot.UpdateAbsorb(u); err != nil {
+		t.Fatalf("duplicate absorb error: %v", err)
+	}
+	m.SetError("")
+
+	if calls != 1 {
+		t.Fatalf("update processed %d times, expected once", calls)
+	}
+}
+
+func TestUpdateAbsorbDedupRetryAfterFailure(t *testing.T) {
+
+	m := miniredis.RunT(t)
+
+	var calls int
+
+	bot := testBotInit(t, m, Settings{Synchronous: true}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			calls++
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	u := testMessage(100, 1, "hello")
+
+	// Failed update must not be remembered as seen
+	m.SetError("redis is down")
+	if err := bot.UpdateAbsorb(u); err == nil {
+		t.Fatal("absorb must fail while redis is down")
+	}
+	m.SetError("")
+
+	if err := bot.UpdateAbsorb(u); err != nil {
+		t.Fatalf("redelivered absorb error: %v", err)
+	}
+	if err := bot.UpdateAbsorb(u); err != nil {
+		t.Fatalf("duplicate absorb error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("update processed %d times, expected once", calls)
+	}
+}
+
+func TestUpdateAbsorbDedupInstances(t *testing.T) {
+
+	m := miniredis.RunT(t)
+
+	var calls int
+
+	d := Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			calls++
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	}
+
+	bot1 := testBotInit(t, m, Settings{Synchronous: true}, d)
+	bot2 := testBotInit(t, m, Settings{Synchronous: true}, d)
+
+	u := testMessage(100, 1, "hello")
+
+	if err := bot1.UpdateAbsorb(u); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if err := bot2.UpdateAbsorb(u); err != nil {
+		t.Fatalf("duplicate absorb error: %v", err)
+	}
+
+	if calls != 1 {
+		t.Fatalf("update processed %d times, expected once", calls)
+	}
+}
+
+func TestUpdateAbsorbDedupReleaseOnFailure(t *testing.T) {
+
+	m := miniredis.RunT(t)
+
+	var calls int
+
+	d := Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			calls++
+			if calls == 1 {
+				return InitHandlerRes{}, errTestHandler
+			}
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	}
+
+	bot1 := testBotInit(t, m, Settings{Synchronous: true}, d)
+	bot2 := testBotInit(t, m, Settings{Synchronous: true}, d)
+
+	u := testMessage(100, 1, "hello")
+
+	if err := bot1.UpdateAbsorb(u); errors.Is(err, errTestHandler) == false {
+		t.Fatalf("absorb must fail with handler error, got: %v", err)
+	}
+
+	// Update failed on one instance must be processed on redelivery
+	if err := bot2.UpdateAbsorb(u); err != nil {
+		t.Fatalf("redelivered absorb error: %v", err)
+	}
+	if err := bot1.UpdateAbsorb(u); err != nil {
+		t.Fatalf("duplicate absorb error: %v", err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("update processed %d times, expected twice", calls)
+	}
+}
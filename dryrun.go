@@ -0,0 +1,171 @@
+package tg
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Recorded contains a request to Telegram recorded in dry-run mode
+type Recorded struct {
+
+	// Method contains Telegram Bot API method, e.g. `sendMessage`
+	Method string
+
+	// Params contains request parameters (except uploaded files)
+	Params map[string]string
+
+	// Files contains names of request fields with uploaded files
+	Files []string
+}
+
+// dryRunClient it is a HTTP client for Telegram Bot API which records
+// all requests instead of sending them and replies with fake results
+type dryRunClient struct {
+	mu        sync.Mutex
+	requests  []Recorded
+	messageID int
+}
+
+// dryRunBotUserName is a user name of the bot in dry-run mode
+const dryRunBotUserName = "dry_run_bot"
+
+// Do records the request and returns fake successful response
+func (c *dryRunClient) Do(req *http.Request) (*http.Response, error) {
+
+	r := Recorded{
+		Method: path.Base(req.URL.Path),
+		Params: make(map[string]string),
+	}
+
+	// Bot token starts with bot ID
+	token := strings.TrimPrefix(path.Base(path.Dir(req.URL.Path)), "bot")
+	botID, _ := strconv.ParseInt(strings.SplitN(token, ":", 2)[0], 10, 64)
+	if botID == 0 {
+		botID = 1
+	}
+
+	if err := dryRunParamsGet(req, &r); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.requests = append(c.requests, r)
+
+	result, err := c.resultGet(r, botID)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(tgbotapi.APIResponse{
+		Ok:     true,
+		Result: result,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader(b)),
+		Request:    req,
+	}, nil
+}
+
+// recorded gets a copy of all recorded requests
+func (c *dryRunClient) recorded() []Recorded {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]Recorded{}, c.requests...)
+}
+
+// resultGet gets fake result for recorded request.
+// Must be called with locked mutex
+func (c *dryRunClient) resultGet(r Recorded, botID int64) (json.RawMessage, error) {
+
+	switch {
+	case r.Method == "getMe":
+		return json.Marshal(tgbotapi.User{
+			ID:        botID,
+			IsBot:     true,
+			FirstName: "Dry Run",
+			UserName:  dryRunBotUserName,
+		})
+
+	case strings.HasPrefix(r.Method, "send"),
+		strings.HasPrefix(r.Method, "edit") && len(r.Params["inline_message_id"]) == 0:
+
+		chatID, _ := strconv.ParseInt(r.Params["chat_id"], 10, 64)
+
+		messageID, _ := strconv.Atoi(r.Params["message_id"])
+		if messageID == 0 {
+			c.messageID++
+			messageID = c.messageID
+		}
+
+		return json.Marshal(tgbotapi.Message{
+			MessageID: messageID,
+			Chat:      &tgbotapi.Chat{ID: chatID},
+			Date:      int(time.Now().Unix()),
+			Text:      r.Params["text"],
+			Caption:   r.Params["caption"],
+		})
+	}
+
+	return json.RawMessage("true"), nil
+}
+
+// dryRunParamsGet gets parameters and uploaded files from request
+func dryRunParamsGet(req *http.Request, r *Recorded) error {
+
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+
+	if ct == "multipart/form-data" {
+		if err := req.ParseMultipartForm(32 << 20); err != nil {
+			return err
+		}
+		for k, v := range req.MultipartForm.Value {
+			r.Params[k] = v[0]
+		}
+		for k := range req.MultipartForm.File {
+			r.Files = append(r.Files, k)
+		}
+		sort.Strings(r.Files)
+		return nil
+	}
+
+	if err := req.ParseForm(); err != nil {
+		return err
+	}
+	for k, v := range req.PostForm {
+		r.Params[k] = v[0]
+	}
+
+	return nil
+}
+
+// SentRequests gets all requests to Telegram recorded in dry-run mode
+// (see `DryRun` setting). Returns nil if bot is not in dry-run mode
+func (t *Telegram) SentRequests() []Recorded {
+
+	if t.dryRun == nil {
+		return nil
+	}
+
+	return t.dryRun.recorded()
+}
@@ -0,0 +1,76 @@
+package tg
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("ask")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("ask"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message: "Send me a file",
+						Buttons: [][]Button{{{Text: "Cancel", Identifier: "cancel"}}},
+					}, nil
+				},
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					if _, err := t.UploadFileStream(s.ChatIDGet(), FileSendStream{
+						FileType: FileTypeDocument,
+						FileName: "reply.txt",
+						Caption:  "Here you are",
+					}, strings.NewReader("data")); err != nil {
+						return MessageHandlerRes{}, err
+					}
+					return MessageHandlerRes{NextState: SessStateDestroy()}, nil
+				},
+			},
+		},
+	})
+
+	if u := bot.Self(); u.ID != 1 || u.UserName != dryRunBotUserName {
+		t.Fatalf("wrong dry-run bot info: %+v", u)
+	}
+
+	for i, text := range []string{"hello", "file please"} {
+		if err := bot.ProcessUpdate(testMessage(i+1, 42, text)); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	var methods []string
+	for _, r := range bot.SentRequests() {
+		methods = append(methods, r.Method)
+	}
+	if fmt.Sprint(methods) != "[getMe deleteWebhook setMyCommands sendMessage sendDocument]" {
+		t.Fatalf("wrong recorded requests: %v", methods)
+	}
+
+	m := testSent(bot, "sendMessage")[0]
+	if m.Params["chat_id"] != "42" || m.Params["text"] != "Send me a file" || strings.Contains(m.Params["reply_markup"], "Cancel") == false {
+		t.Fatalf("wrong recorded message: %+v", m)
+	}
+
+	d := testSent(bot, "sendDocument")[0]
+	if d.Params["caption"] != "Here you are" || fmt.Sprint(d.Files) != "[document]" {
+		t.Fatalf("wrong recorded document: %+v", d)
+	}
+}
+
+func TestDryRunDisabled(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		return nil, nil
+	})
+
+	if r := bot.SentRequests(); r != nil {
+		t.Fatalf("requests must not be recorded if dry-run is disabled: %v", r)
+	}
+}
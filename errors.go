@@ -0,0 +1,81 @@
+package tg
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiError it is a Telegram API error classified into one of sentinel
+// errors. Both sentinel (with `errors.Is()`) and original error
+// (with `errors.As()`) can be checked
+type apiError struct {
+	kind error
+	err  error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func (e *apiError) Is(target error) bool {
+	return target == e.kind
+}
+
+// classifyError classifies Telegram API error into one of sentinel errors:
+// ErrBotBlocked, ErrChatNotFound, ErrMessageNotModified, ErrMessageToDeleteNotFound
+// or ErrTooManyRequests. Other errors are returned as is
+func classifyError(err error) error {
+
+	var kind error
+
+	e := apiErrorGet(err)
+	if e == nil {
+		return err
+	}
+
+	m := strings.ToLower(e.Message)
+
+	switch {
+	case e.Code == http.StatusForbidden || strings.HasPrefix(m, "forbidden:"):
+		kind = ErrBotBlocked
+	case e.Code == http.StatusTooManyRequests || e.RetryAfter > 0 || strings.HasPrefix(m, "too many requests"):
+		kind = ErrTooManyRequests
+	case strings.Contains(m, "message is not modified"):
+		kind = ErrMessageNotModified
+	case strings.Contains(m, "message to delete not found"):
+		kind = ErrMessageToDeleteNotFound
+	case strings.Contains(m, "chat not found"):
+		kind = ErrChatNotFound
+	default:
+		return err
+	}
+
+	return &apiError{
+		kind: kind,
+		err:  err,
+	}
+}
+
+// getUpdatesRetryable checks whether or not getting updates may be retried
+// after specified error. Retry is useless if bot token is revoked or updates
+// are got by other bot instance (or webhook is set)
+func getUpdatesRetryable(err error) bool {
+
+	e := apiErrorGet(err)
+	if e == nil {
+		return true
+	}
+
+	switch e.Code {
+	case
+		http.StatusUnauthorized,
+		http.StatusConflict:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,114 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestIsBlockedError(t *testing.T) {
+
+	for _, c := range []struct {
+		err     error
+		blocked bool
+	}{
+		{&tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was blocked by the user"}, true},
+		{&tgbotapi.Error{Message: "Forbidden: user is deactivated"}, true},
+		{fmt.Errorf("send error: %w", &tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was kicked from the group chat"}), true},
+		{&tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: chat not found"}, false},
+		{errors.New("Forbidden: bot was blocked by the user"), false},
+		{nil, false},
+	} {
+		if b := IsBlockedError(c.err); b != c.blocked {
+			t.Fatalf("wrong blocked check for `%v`: %v", c.err, b)
+		}
+	}
+}
+
+func TestDestroyBlockedSession(t *testing.T) {
+
+	for _, destroy := range []bool{true, false} {
+
+		var destroyed bool
+
+		bot := testBotInitHTTP(t, Settings{DestroyBlockedSessions: destroy}, Description{
+			DestroyHandler: func(t *Telegram, s *Session) error {
+				destroyed = true
+				return nil
+			},
+			States: map[SessionState]State{
+				SessState("notify"): {
+					StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+						return StateHandlerRes{
+							Message:   "news",
+							NextState: SessStateBreak(),
+						}, nil
+					},
+				},
+			},
+		}, func(method string, req *http.Request) (*http.Response, error) {
+			return testSendError(method, req, "1", http.StatusForbidden, "Forbidden: bot was blocked by the user"), nil
+		})
+
+		err := bot.SessionStart(1, 1, SessState("notify"))
+
+		if destroy == true {
+			if err != nil {
+				t.Fatalf("session of blocked user must be destroyed without error, got: %v", err)
+			}
+			if destroyed == false {
+				t.Fatal("session of blocked user must be destroyed")
+			}
+			if _, e, _ := testSessionNew(t, bot, 1).StateGet(); e == true {
+				t.Fatal("session of blocked user must not exist")
+			}
+			continue
+		}
+
+		if IsBlockedError(err) == false || destroyed == true {
+			t.Fatalf("blocked error must be returned without destroy, got: %v", err)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+
+	for _, c := range []struct {
+		err  error
+		kind error
+	}{
+		{&tgbotapi.Error{Code: http.StatusForbidden, Message: "Forbidden: bot was blocked by the user"}, ErrBotBlocked},
+		{&tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: chat not found"}, ErrChatNotFound},
+		{&tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"}, ErrMessageNotModified},
+		{&tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: message to delete not found"}, ErrMessageToDeleteNotFound},
+		{&tgbotapi.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, ErrTooManyRequests},
+		{&tgbotapi.Error{Message: "Too Many Requests: retry after 5"}, ErrTooManyRequests},
+	} {
+
+		err := classifyError(c.err)
+
+		if errors.Is(err, c.kind) == false {
+			t.Fatalf("error `%v` expected to be classified as `%v`", c.err, c.kind)
+		}
+
+		// Original error is kept
+		var e *tgbotapi.Error
+		if errors.As(err, &e) == false || err.Error() != c.err.Error() {
+			t.Fatalf("original error is lost for `%v`", c.err)
+		}
+	}
+
+	// Other errors are returned as is
+	for _, err := range []error{
+		&tgbotapi.Error{Code: http.StatusBadRequest, Message: "Bad Request: message text is empty"},
+		errors.New("chat not found"),
+		nil,
+	} {
+		if r := classifyError(err); r != err {
+			t.Fatalf("error `%v` must not be classified, got `%v`", err, r)
+		}
+	}
+}
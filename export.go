@@ -0,0 +1,69 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// sessionExport contains session data for export.
+// Slots are encoded in base64 within JSON
+type sessionExport struct {
+	Key  string `json:"key"`
+	Data data   `json:"data"`
+}
+
+// ExportSessions writes all sessions into `w` as a stream of JSON
+// objects (one per line). Useful for backups or migration to other Redis
+func (t *Telegram) ExportSessions(w io.Writer) error {
+
+	ctx := context.Background()
+
+	r, err := t.redisGet(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	enc := json.NewEncoder(w)
+
+	return r.sessScan(ctx, func(key string, d data) error {
+		return enc.Encode(sessionExport{
+			Key:  key,
+			Data: d,
+		})
+	})
+}
+
+// ImportSessions reads sessions from `src` written by `ExportSessions` and
+// saves them into Redis. Existing sessions with the same keys are overwritten
+// regardless of their versions, so import must be done while the bot is
+// stopped (i.e. no updates are processed)
+func (t *Telegram) ImportSessions(src io.Reader) error {
+
+	ctx := context.Background()
+
+	r, err := t.redisGet(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	dec := json.NewDecoder(src)
+
+	for {
+
+		var se sessionExport
+
+		if err := dec.Decode(&se); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := r.sessSet(ctx, se.Key, se.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// testSession opens session of user in private chat
+func testSession(t *testing.T, bot *Telegram, userID int64) *Session {
+
+	t.Helper()
+
+	s, err := sessionNew(context.Background(), bot, userID, userID)
+	if err != nil {
+		t.Fatalf("session open error: %v", err)
+	}
+	t.Cleanup(func() {
+		s.close()
+	})
+
+	return s
+}
+
+func TestExportImportSessions(t *testing.T) {
+
+	type order struct {
+		Item  string
+		Count int
+	}
+
+	src := testBotInit(t, nil, Settings{}, Description{})
+
+	for _, userID := range []int64{1, 2} {
+
+		s := testSession(t, src, userID)
+
+		if err := s.StateSet(SessState("order")); err != nil {
+			t.Fatalf("state set error: %v", err)
+		}
+		if err := s.SlotSave("order", order{Item: "pizza", Count: int(userID)}); err != nil {
+			t.Fatalf("slot save error: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := src.ExportSessions(&buf); err != nil {
+		t.Fatalf("export error: %v", err)
+	}
+
+	// One JSON object per session
+	if n := strings.Count(buf.String(), "\n"); n != 2 {
+		t.Fatalf("expected two exported sessions, got %d:\n%s", n, buf.String())
+	}
+
+	dst := testBotInit(t, nil, Settings{}, Description{})
+
+	// Existing session is overwritten
+	if err := testSession(t, dst, 1).StateSet(SessState("menu")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+
+	if err := dst.ImportSessions(&buf); err != nil {
+		t.Fatalf("import error: %v", err)
+	}
+
+	for _, userID := range []int64{1, 2} {
+
+		s := testSession(t, dst, userID)
+
+		st, e, err := s.StateGet()
+		if err != nil {
+			t.Fatalf("state get error: %v", err)
+		}
+		if e == false || st != SessState("order") {
+			t.Fatalf("user %d: wrong imported state: %v (exists %t)", userID, st, e)
+		}
+
+		var o order
+		if b, err := s.SlotGet("order", &o); err != nil || b == false {
+			t.Fatalf("user %d: imported slot get error: %v (exists %t)", userID, err, b)
+		}
+		if o.Item != "pizza" || o.Count != int(userID) {
+			t.Fatalf("user %d: wrong imported slot: %+v", userID, o)
+		}
+	}
+
+	if err := dst.ImportSessions(strings.NewReader("{wrong")); err == nil {
+		t.Fatal("import of malformed data must fail")
+	}
+}
@@ -3,12 +3,14 @@ module github.com/nixys/nxs-go-telegram
 go 1.17
 
 require (
-	github.com/go-redis/redis v6.15.9+incompatible
+	github.com/alicebob/miniredis/v2 v2.39.0
 	github.com/go-telegram-bot-api/telegram-bot-api/v5 v5.5.1
+	github.com/redis/go-redis/v9 v9.0.5
 	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
 )
 
 require (
-	github.com/onsi/ginkgo v1.16.5 // indirect
-	github.com/onsi/gomega v1.18.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 )
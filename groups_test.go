@@ -0,0 +1,147 @@
+package tg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// testMention adds entity for `mention` into message update
+func testMention(u Update, mention string) Update {
+
+	u.Message.Entities = append(u.Message.Entities, tgbotapi.MessageEntity{
+		Type:   "mention",
+		Offset: strings.Index(u.Message.Text, mention),
+		Length: len(mention),
+	})
+
+	return u
+}
+
+func TestBotMentioned(t *testing.T) {
+
+	// Entity offsets are in UTF-16 code units
+	emoji := testMessage(4, 42, "🙂 @my_bot")
+	emoji.Message.Entities = []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 7}}
+
+	caption := testMessage(5, 42, "")
+	caption.Message.Caption = "look @my_bot"
+	caption.Message.CaptionEntities = []tgbotapi.MessageEntity{{Type: "mention", Offset: 5, Length: 7}}
+
+	// Mention-like text without entity
+	plain := testMessage(6, 42, "@my_bot")
+
+	for _, c := range []struct {
+		name      string
+		updates   []Update
+		mentioned bool
+	}{
+		{"mention", []Update{testMention(testMessage(1, 42, "hi @my_bot"), "@my_bot")}, true},
+		{"case", []Update{testMention(testMessage(2, 42, "hi @My_Bot"), "@My_Bot")}, true},
+		{"other bot", []Update{testMention(testMessage(3, 42, "hi @my_bot2"), "@my_bot2")}, false},
+		{"utf16", []Update{emoji}, true},
+		{"caption", []Update{caption}, true},
+		{"no entity", []Update{plain}, false},
+		{"chain", []Update{plain, emoji}, true},
+	} {
+		uc := UpdateChain{}
+		uc.add(c.updates)
+		if b := uc.BotMentioned("my_bot"); b != c.mentioned {
+			t.Fatalf("%s: wrong mention check: expected %t, got %t", c.name, c.mentioned, b)
+		}
+	}
+
+	uc := UpdateChain{}
+	uc.add([]Update{testMention(testMessage(8, 42, "hi @my_bot"), "@my_bot")})
+	if uc.BotMentioned("") == true {
+		t.Fatal("empty bot user name must not be mentioned")
+	}
+
+	// Callback chains never mention the bot
+	uc = UpdateChain{}
+	uc.add([]Update{{
+		UpdateID: 9,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "9",
+			From: &tgbotapi.User{ID: 42},
+			Message: &tgbotapi.Message{
+				MessageID: 1,
+				Chat:      &tgbotapi.Chat{ID: 42, Type: "private"},
+				Text:      "hi @my_bot",
+				Entities:  []tgbotapi.MessageEntity{{Type: "mention", Offset: 3, Length: 7}},
+			},
+			Data: "{}",
+		},
+	}})
+	if uc.TypeGet() != UpdateTypeCallback {
+		t.Fatalf("wrong chain type: %v", uc.TypeGet())
+	}
+	if uc.BotMentioned("my_bot") == true {
+		t.Fatal("callback chain must not mention the bot")
+	}
+}
+
+func TestGroupSessionsExplicit(t *testing.T) {
+
+	for _, explicit := range []bool{true, false} {
+
+		var inits []int
+
+		bot := testBotInit(t, nil, Settings{GroupSessionsExplicit: explicit}, Description{
+			Commands: []Command{
+				{
+					Command: "start",
+					Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+						inits = append(inits, s.UpdateChain().updates[0].UpdateID)
+						return CommandHandlerRes{NextState: SessState("chat")}, nil
+					},
+				},
+			},
+			InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+				inits = append(inits, s.UpdateChain().updates[0].UpdateID)
+				return InitHandlerRes{NextState: SessState("chat")}, nil
+			},
+			States: map[SessionState]State{
+				SessState("chat"): {},
+			},
+		})
+
+		mention := "@" + bot.bot.Self.UserName
+
+		start := testGroupMessage(3, -100, 3, "/start")
+		start.Message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: 6}}
+
+		testProcess(t, bot,
+			testGroupMessage(1, -100, 1, "idle chatter"),
+			testMention(testGroupMessage(2, -100, 2, "hey "+mention), mention),
+			start,
+			testMention(testGroupMessage(4, -100, 4, "hey @other_bot"), "@other_bot"),
+			testMessage(5, 5, "private"),
+		)
+
+		// Sessions in groups are created only if bot is addressed
+		expected := "[2 3 5]"
+		if explicit == false {
+			expected = "[1 2 3 4 5]"
+		}
+		if fmt.Sprint(inits) != expected {
+			t.Fatalf("explicit %t: wrong initiated sessions: expected %s, got %v", explicit, expected, inits)
+		}
+
+		s, err := sessionNew(context.Background(), bot, -100, 1)
+		if err != nil {
+			t.Fatalf("session open error: %v", err)
+		}
+		_, e, err := s.StateGet()
+		s.close()
+		if err != nil {
+			t.Fatalf("state get error: %v", err)
+		}
+		if e == explicit {
+			t.Fatalf("explicit %t: wrong session existence for idle user", explicit)
+		}
+	}
+}
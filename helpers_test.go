@@ -0,0 +1,20 @@
+package tg
+
+import (
+	"testing"
+)
+
+// testProcess puts updates into queue and processes them one by one
+func testProcess(t *testing.T, bot *Telegram, updates ...Update) {
+
+	t.Helper()
+
+	for _, u := range updates {
+		if err := bot.UpdateAbsorb(u); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+		if err := bot.Processing(); err != nil {
+			t.Fatalf("processing error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package tg
+
+// KeyboardBuilder it is a fluent builder for inline keyboard buttons
+type KeyboardBuilder struct {
+	rows [][]Button
+}
+
+// NewKeyboard creates inline keyboard builder, e.g.:
+//
+//	tg.NewKeyboard().Row(yes, no).Wrap(items, 3).Build()
+func NewKeyboard() KeyboardBuilder {
+	return KeyboardBuilder{}
+}
+
+// Row appends a row with specified buttons. Empty rows are skipped
+func (kb KeyboardBuilder) Row(buttons ...Button) KeyboardBuilder {
+
+	if len(buttons) == 0 {
+		return kb
+	}
+
+	kb.rows = append(append([][]Button{}, kb.rows...), append([]Button{}, buttons...))
+
+	return kb
+}
+
+// Wrap appends specified buttons wrapped into rows with `width` buttons each
+func (kb KeyboardBuilder) Wrap(buttons []Button, width int) KeyboardBuilder {
+	kb.rows = append(append([][]Button{}, kb.rows...), ButtonsWrap(buttons, width)...)
+	return kb
+}
+
+// Build returns composed buttons
+func (kb KeyboardBuilder) Build() [][]Button {
+	return kb.rows
+}
+
+// ButtonsWrap wraps specified buttons into rows with `width` buttons each.
+// The last row contains the remainder. If `width` is zero or less all
+// buttons are placed into single row
+func ButtonsWrap(buttons []Button, width int) [][]Button {
+
+	var rows [][]Button
+
+	if width <= 0 {
+		width = len(buttons)
+	}
+
+	for i := 0; i < len(buttons); i += width {
+
+		e := i + width
+		if e > len(buttons) {
+			e = len(buttons)
+		}
+
+		rows = append(rows, append([]Button{}, buttons[i:e]...))
+	}
+
+	return rows
+}
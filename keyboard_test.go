@@ -0,0 +1,72 @@
+package tg
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testKeyboardLayout gets identifiers of buttons grouped by rows
+func testKeyboardLayout(rows [][]Button) string {
+
+	var r [][]string
+
+	for _, row := range rows {
+		var ids []string
+		for _, b := range row {
+			ids = append(ids, b.Identifier)
+		}
+		r = append(r, ids)
+	}
+
+	return fmt.Sprint(r)
+}
+
+func TestButtonsWrap(t *testing.T) {
+
+	var buttons []Button
+	for i := 1; i <= 7; i++ {
+		buttons = append(buttons, Button{Text: fmt.Sprint(i), Identifier: fmt.Sprint(i)})
+	}
+
+	for _, c := range []struct {
+		width    int
+		expected string
+	}{
+		{3, "[[1 2 3] [4 5 6] [7]]"},
+		{7, "[[1 2 3 4 5 6 7]]"},
+		{10, "[[1 2 3 4 5 6 7]]"},
+		{0, "[[1 2 3 4 5 6 7]]"},
+	} {
+		if r := testKeyboardLayout(ButtonsWrap(buttons, c.width)); r != c.expected {
+			t.Fatalf("width %d: expected %s, got %s", c.width, c.expected, r)
+		}
+	}
+
+	if r := ButtonsWrap(nil, 3); len(r) != 0 {
+		t.Fatalf("expected no rows for no buttons, got %v", r)
+	}
+}
+
+func TestKeyboardBuilder(t *testing.T) {
+
+	yes := Button{Text: "Yes", Identifier: "yes"}
+	no := Button{Text: "No", Identifier: "no"}
+
+	items := []Button{
+		{Text: "A", Identifier: "a"},
+		{Text: "B", Identifier: "b"},
+		{Text: "C", Identifier: "c"},
+	}
+
+	base := NewKeyboard().Row(yes, no).Row()
+
+	kb := base.Wrap(items, 2).Row(no)
+	if r := testKeyboardLayout(kb.Build()); r != "[[yes no] [a b] [c] [no]]" {
+		t.Fatalf("wrong keyboard layout: %s", r)
+	}
+
+	// Builder values are independent
+	if r := testKeyboardLayout(base.Build()); r != "[[yes no]]" {
+		t.Fatalf("base keyboard must not be changed: %s", r)
+	}
+}
@@ -0,0 +1,52 @@
+package tg
+
+import (
+	"fmt"
+)
+
+// Localizer is an interface to translate messages into user language.
+// `Templates` implements it, so it can be used as a simple map-backed localizer
+type Localizer interface {
+
+	// Translate translates message with `key` into `lang` language.
+	// `args` are used to format translated message
+	Translate(lang, key string, args ...interface{}) string
+}
+
+// Translate translates message with `key` into `lang` language. If message
+// not found for `lang` it will be looked up for default language. If nothing
+// found the key will be returned. `args` are applied with `fmt.Sprintf()`
+func (tpl *Templates) Translate(lang, key string, args ...interface{}) string {
+
+	text, b := tpl.Texts[lang][key]
+	if b == false {
+		text, b = tpl.Texts[tpl.DefaultLang][key]
+		if b == false {
+			text = key
+		}
+	}
+
+	return localizeFormat(text, args)
+}
+
+// T translates message with `key` into session user language with localizer
+// from bot settings. If localizer is not set the key will be returned
+func (s *Session) T(key string, args ...interface{}) string {
+
+	if s.localizer == nil {
+		return localizeFormat(key, args)
+	}
+
+	return s.localizer.Translate(s.userLang, key, args...)
+}
+
+// localizeFormat applies `args` to translated message. Args are taken as a slice,
+// so `go vet` does not treat translation keys passed to `T()` as format strings
+func localizeFormat(text string, args []interface{}) string {
+
+	if len(args) == 0 {
+		return text
+	}
+
+	return fmt.Sprintf(text, args...)
+}
@@ -0,0 +1,55 @@
+package tg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionTranslate(t *testing.T) {
+
+	var texts []string
+
+	bot := testBotInit(t, nil, Settings{
+		Localizer: &Templates{
+			DefaultLang: "en",
+			Texts: map[string]map[string]string{
+				"en": {
+					"hello": "Hello, %s!",
+					"bye":   "Bye",
+				},
+				"ru": {
+					"hello": "Привет, %s!",
+				},
+			},
+		},
+	}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			texts = append(texts, s.T("hello", "John"), s.T("bye"), s.T("unknown"))
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	for i, lang := range []string{"ru", "de"} {
+
+		u := testMessage(i+1, int64(i+1), "hi")
+		u.Message.From.LanguageCode = lang
+
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	// Missing messages fall back to default language and then to key
+	if fmt.Sprint(texts) != "[Привет, John! Bye unknown Hello, John! Bye unknown]" {
+		t.Fatalf("wrong translated messages: %v", texts)
+	}
+}
+
+func TestSessionTranslateNoLocalizer(t *testing.T) {
+
+	s := Session{}
+
+	if r := s.T("Hello, %s!", "John"); r != "Hello, John!" {
+		t.Fatalf("wrong message without localizer: %s", r)
+	}
+}
@@ -0,0 +1,44 @@
+package tg
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Logger is an interface to write debug messages, e.g. `*log.Logger`
+type Logger interface {
+	Println(v ...interface{})
+	Printf(format string, v ...interface{})
+}
+
+// tokenRe matches Telegram bot tokens (`<bot ID>:<secret>`)
+var tokenRe = regexp.MustCompile(`\d+:[A-Za-z0-9_-]{30,}`)
+
+// tokenRedacted replaces bot tokens in debug messages
+const tokenRedacted = "<redacted>"
+
+// loggerRedact it's a Logger wrapper redacting bot tokens
+type loggerRedact struct {
+	l Logger
+}
+
+// loggerDefault gets logger used if no one specified in settings
+func loggerDefault() Logger {
+	return log.New(os.Stderr, "", log.LstdFlags)
+}
+
+func (l loggerRedact) Println(v ...interface{}) {
+	l.l.Println(l.redact(fmt.Sprintln(v...)))
+}
+
+func (l loggerRedact) Printf(format string, v ...interface{}) {
+	l.l.Println(l.redact(fmt.Sprintf(format, v...)))
+}
+
+// redact replaces bot tokens in message
+func (l loggerRedact) redact(s string) string {
+	return tokenRe.ReplaceAllString(strings.TrimSuffix(s, "\n"), tokenRedacted)
+}
@@ -0,0 +1,202 @@
+package tg
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	rds "github.com/redis/go-redis/v9"
+)
+
+// Manager holds several bots (keyed by bot token) and processes their
+// queues within a single processing loop. Each bot keeps its own Redis keys
+// prefixed with bot ID, so all bots use the same Redis database via the
+// single client shared by manager
+type Manager struct {
+	mu     *sync.RWMutex
+	bots   map[string]*Telegram
+	tokens []string
+
+	// client is a Redis client shared between all bots
+	// (created with Redis settings of the first added bot)
+	client *rds.Client
+
+	// opts contains Redis options of the first added bot
+	opts *rds.Options
+}
+
+// managerQueue contains bot queue available for processing
+type managerQueue struct {
+	t *Telegram
+	q queue
+	m queueMeta
+}
+
+// ManagerInit initializes empty bots manager
+func ManagerInit() Manager {
+	return Manager{
+		mu:   &sync.RWMutex{},
+		bots: make(map[string]*Telegram),
+	}
+}
+
+// Add initializes bot the same way as `Init()` and adds it into manager.
+// Bot with the same token will be replaced. Setting `RedisKeysWithBotID`
+// is always enabled for bots within the manager. All bots must use the
+// same Redis (host, database, credentials and TLS settings) as the first
+// added one. It's checked before the bot is initialized, so nothing is
+// requested from Telegram or Redis for bot with other Redis
+func (m *Manager) Add(s Settings, description Description, usrCtx interface{}) (*Telegram, error) {
+
+	s.RedisKeysWithBotID = true
+
+	ro, err := redisOptionsGet(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.redisCheck(ro); err != nil {
+		return nil, err
+	}
+
+	t, err := Init(s, description, usrCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client == nil {
+		m.opts = ro
+		m.client = rds.NewClient(t.redisOpts)
+	} else if redisOptionsSame(m.opts, ro) == false {
+		// Other bot with different Redis has been added concurrently
+		return nil, ErrManagerRedisMismatch
+	}
+
+	t.redisClient = m.client
+
+	if _, b := m.bots[t.bot.Token]; b == false {
+		m.tokens = append(m.tokens, t.bot.Token)
+	}
+	m.bots[t.bot.Token] = &t
+
+	return &t, nil
+}
+
+// redisCheck checks Redis options are the same as the ones of manager
+func (m *Manager) redisCheck(ro *rds.Options) error {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.client != nil && redisOptionsSame(m.opts, ro) == false {
+		return ErrManagerRedisMismatch
+	}
+
+	return nil
+}
+
+// Close closes Redis client shared between bots
+func (m *Manager) Close() error {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client == nil {
+		return nil
+	}
+
+	err := m.client.Close()
+	m.client = nil
+
+	return err
+}
+
+// Bot gets bot with specified token
+func (m *Manager) Bot(token string) (*Telegram, bool) {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	t, b := m.bots[token]
+
+	return t, b
+}
+
+// UpdateAbsorb absorbs specified `update` received for bot with
+// specified token and put it into the queue of this bot
+func (m *Manager) UpdateAbsorb(token string, update Update) error {
+
+	t, b := m.Bot(token)
+	if b == false {
+		return ErrManagerBotNotFound
+	}
+
+	return t.UpdateAbsorb(update)
+}
+
+// Processing processes a single update chain available in queues of
+// all bots. Queues of all bots are scanned at once and the one whose
+// wait elapsed earliest is processed by its bot (with its own description),
+// so busy bots do not starve others
+func (m *Manager) Processing() error {
+
+	ctx := context.Background()
+
+	var mqs []managerQueue
+
+	for _, t := range m.botsGet() {
+
+		q, err := queueInit(ctx, t)
+		if err != nil {
+			return err
+		}
+
+		qm, err := q.ready(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range qm {
+			mqs = append(mqs, managerQueue{
+				t: t,
+				q: q,
+				m: e,
+			})
+		}
+	}
+
+	sort.SliceStable(mqs, func(i, j int) bool {
+		return mqs[i].m.waitTill.Before(mqs[j].m.waitTill)
+	})
+
+	for _, e := range mqs {
+
+		uc, b, err := e.q.claim(ctx, e.m)
+		if err != nil {
+			return err
+		}
+
+		if b == true {
+			return e.t.chainProcess(ctx, uc)
+		}
+	}
+
+	return nil
+}
+
+// botsGet gets all bots in order of their addition
+func (m *Manager) botsGet() []*Telegram {
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	bots := make([]*Telegram, 0, len(m.tokens))
+	for _, tk := range m.tokens {
+		bots = append(bots, m.bots[tk])
+	}
+
+	return bots
+}
@@ -0,0 +1,167 @@
+package tg
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+const (
+	testTokenA = "11:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"
+	testTokenB = "22:BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB"
+)
+
+// testManagerBotAdd adds bot with specified token into manager. Bot
+// sends message with `name` to user started the session
+func testManagerBotAdd(t *testing.T, mgr *Manager, m *miniredis.Miniredis, token, name string) *Telegram {
+
+	t.Helper()
+
+	bot, err := mgr.Add(Settings{
+		BotSettings: SettingsBot{BotAPI: token},
+		RedisHost:   m.Addr(),
+		DryRun:      true,
+	}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("hello")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("hello"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message:   name,
+						NextState: SessStateBreak(),
+					}, nil
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("manager bot add error: %v", err)
+	}
+
+	return bot
+}
+
+func TestManagerRouting(t *testing.T) {
+
+	m := miniredis.RunT(t)
+
+	mgr := ManagerInit()
+	defer mgr.Close()
+
+	botA := testManagerBotAdd(t, &mgr, m, testTokenA, "A")
+	botB := testManagerBotAdd(t, &mgr, m, testTokenB, "B")
+
+	if botA.redisClient == nil || botA.redisClient != botB.redisClient {
+		t.Fatal("bots must share Redis client of manager")
+	}
+
+	if err := mgr.UpdateAbsorb(testTokenA, testMessage(1, 100, "hi")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if err := mgr.UpdateAbsorb(testTokenB, testMessage(1, 200, "hi")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if err := mgr.UpdateAbsorb("33:unknown", testMessage(1, 300, "hi")); err != ErrManagerBotNotFound {
+		t.Fatalf("absorb for unknown bot must fail, got: %v", err)
+	}
+
+	// Each bot keeps its keys under own prefix within the same Redis
+	for _, k := range m.Keys() {
+		if strings.HasPrefix(k, "bot11:") == false && strings.HasPrefix(k, "bot22:") == false {
+			t.Fatalf("key without bot prefix: %s", k)
+		}
+	}
+
+	// Single processing loop dispatches both queues
+	for i := 0; i < 3; i++ {
+		if err := mgr.Processing(); err != nil {
+			t.Fatalf("processing error: %v", err)
+		}
+	}
+
+	for _, c := range []struct {
+		bot    *Telegram
+		chatID string
+		text   string
+	}{
+		{botA, "100", "A"},
+		{botB, "200", "B"},
+	} {
+		r := testSent(c.bot, "sendMessage")
+		if len(r) != 1 {
+			t.Fatalf("bot %s: expected one sent message, got %d", c.text, len(r))
+		}
+		if r[0].Params["chat_id"] != c.chatID || r[0].Params["text"] != c.text {
+			t.Fatalf("bot %s: wrong sent message: %v", c.text, r[0].Params)
+		}
+	}
+
+	if v := m.HGet("bot11:"+sessionKey, sessionKeyGen(botA.sessionScope, 100, 100)); len(v) == 0 {
+		t.Fatal("session of bot A must be stored under its prefix")
+	}
+	if v := m.HGet("bot22:"+sessionKey, sessionKeyGen(botB.sessionScope, 200, 200)); len(v) == 0 {
+		t.Fatal("session of bot B must be stored under its prefix")
+	}
+}
+
+func TestManagerRedisMismatch(t *testing.T) {
+
+	m1 := miniredis.RunT(t)
+	m2 := miniredis.RunT(t)
+
+	mgr := ManagerInit()
+	defer mgr.Close()
+
+	testManagerBotAdd(t, &mgr, m1, testTokenA, "A")
+
+	var requests int
+
+	// Nothing must be requested from Telegram for rejected bot
+	client := &http.Client{
+		Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+			requests++
+			return nil, errors.New("unexpected request")
+		}),
+	}
+
+	for _, c := range []struct {
+		name string
+		s    Settings
+	}{
+		{"host", Settings{RedisHost: m2.Addr()}},
+		{"database", Settings{RedisHost: "redis://" + m1.Addr() + "/1"}},
+		{"username", Settings{RedisHost: "redis://user@" + m1.Addr()}},
+		{"password", Settings{RedisHost: "redis://:secret@" + m1.Addr()}},
+		{"TLS", Settings{RedisHost: m1.Addr(), RedisTLS: &tls.Config{ServerName: "redis"}}},
+	} {
+
+		c.s.BotSettings = SettingsBot{BotAPI: testTokenB}
+		c.s.HTTPClient = client
+
+		if _, err := mgr.Add(c.s, Description{}, nil); err != ErrManagerRedisMismatch {
+			t.Fatalf("%s: bot with other Redis must be rejected, got: %v", c.name, err)
+		}
+	}
+
+	if requests != 0 {
+		t.Fatalf("rejected bots must not reach Telegram: %d requests", requests)
+	}
+	if n := m2.TotalConnectionCount(); n != 0 {
+		t.Fatalf("rejected bot must not reach Redis: %d connections", n)
+	}
+
+	// The same Redis may be specified as URL
+	if _, err := mgr.Add(Settings{
+		BotSettings: SettingsBot{BotAPI: testTokenB},
+		RedisHost:   "redis://" + m1.Addr() + "/0",
+		DryRun:      true,
+	}, Description{}, nil); err != nil {
+		t.Fatalf("bot with the same Redis must be added, got: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package tg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSessionMembers(t *testing.T) {
+
+	var members []Member
+
+	bot := testBotInit(t, nil, Settings{SessionScope: ScopeChat}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("game")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("game"): {
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+
+					if fmt.Sprint(s.UpdateChain().MessageTextGet()) != "[start]" {
+						return MessageHandlerRes{NextState: SessStateBreak()}, nil
+					}
+
+					var err error
+					members, err = s.MembersGet()
+					if err != nil {
+						return MessageHandlerRes{}, err
+					}
+
+					// Send each participant a private role
+					for _, m := range members {
+						if _, err := t.SendMessage(m.UserID, 0, SendMessageData{Message: "role of " + m.UserName}); err != nil {
+							return MessageHandlerRes{}, err
+						}
+					}
+
+					return MessageHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	for i, m := range []struct {
+		userID int64
+		text   string
+	}{
+		{2, "join"},
+		{1, "join"},
+		{2, "again"},
+		{1, "start"},
+	} {
+		u := testGroupMessage(i+1, -100, m.userID, m.text)
+		u.Message.From.UserName = fmt.Sprintf("user%d", m.userID)
+		testProcess(t, bot, u)
+	}
+
+	if fmt.Sprintf("%+v", members) != "[{UserID:1 UserName:user1 FirstName: LastName:} {UserID:2 UserName:user2 FirstName: LastName:}]" {
+		t.Fatalf("wrong session members: %+v", members)
+	}
+
+	var sent []string
+	for _, r := range testSent(bot, "sendMessage") {
+		sent = append(sent, r.Params["chat_id"]+":"+r.Params["text"])
+	}
+	if fmt.Sprint(sent) != "[1:role of user1 2:role of user2]" {
+		t.Fatalf("wrong messages to members: %v", sent)
+	}
+}
+
+func TestSessionMembersScopeUser(t *testing.T) {
+
+	var (
+		members []Member
+		called  bool
+	)
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("game")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("game"): {
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					var err error
+					called = true
+					members, err = s.MembersGet()
+					return MessageHandlerRes{NextState: SessStateBreak()}, err
+				},
+			},
+		},
+	})
+
+	testProcess(t, bot, testGroupMessage(1, -100, 1, "join"), testGroupMessage(2, -100, 1, "start"))
+
+	// Members are not tracked for user scoped sessions
+	if called == false || len(members) != 0 {
+		t.Fatalf("user session must have no members: %+v", members)
+	}
+}
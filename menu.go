@@ -0,0 +1,113 @@
+package tg
+
+import (
+	"encoding/json"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MenuButtonType it's a type of chat menu button
+type MenuButtonType int
+
+const (
+
+	// MenuButtonDefault - default menu button behaviour
+	MenuButtonDefault MenuButtonType = iota
+
+	// MenuButtonCommands - menu button opens the list of bot commands
+	MenuButtonCommands
+
+	// MenuButtonWebApp - menu button launches a Web App
+	MenuButtonWebApp
+)
+
+func (m MenuButtonType) String() string {
+	return [...]string{"default", "commands", "web_app"}[m]
+}
+
+// MenuButton contains chat menu button options
+type MenuButton struct {
+	Type MenuButtonType
+
+	// Text defines button text. Only for `MenuButtonWebApp` type
+	Text string
+
+	// WebAppURL defines an URL of Web App to launch.
+	// Only for `MenuButtonWebApp` type
+	WebAppURL string
+}
+
+// menuButton contains chat menu button in Telegram API format
+type menuButton struct {
+	Type   string         `json:"type"`
+	Text   string         `json:"text,omitempty"`
+	WebApp *menuButtonApp `json:"web_app,omitempty"`
+}
+
+type menuButtonApp struct {
+	URL string `json:"url"`
+}
+
+// SetChatMenuButton sets menu button for specified private chat.
+// If `chatID` is zero default menu button for all chats will be set
+func (t *Telegram) SetChatMenuButton(chatID int64, button MenuButton) error {
+
+	mb := menuButton{
+		Type: button.Type.String(),
+	}
+
+	if button.Type == MenuButtonWebApp {
+		mb.Text = button.Text
+		mb.WebApp = &menuButtonApp{
+			URL: button.WebAppURL,
+		}
+	}
+
+	params := make(tgbotapi.Params)
+	params.AddNonZero64("chat_id", chatID)
+	if err := params.AddInterface("menu_button", mb); err != nil {
+		return err
+	}
+
+	_, err := t.bot.MakeRequest("setChatMenuButton", params)
+
+	return classifyError(err)
+}
+
+// GetChatMenuButton gets menu button of specified private chat.
+// If `chatID` is zero default menu button will be returned
+func (t *Telegram) GetChatMenuButton(chatID int64) (MenuButton, error) {
+
+	var mb menuButton
+
+	params := make(tgbotapi.Params)
+	params.AddNonZero64("chat_id", chatID)
+
+	r, err := t.bot.MakeRequest("getChatMenuButton", params)
+	if err != nil {
+		return MenuButton{}, classifyError(err)
+	}
+
+	if err := json.Unmarshal(r.Result, &mb); err != nil {
+		return MenuButton{}, err
+	}
+
+	switch mb.Type {
+	case MenuButtonDefault.String():
+		return MenuButton{Type: MenuButtonDefault}, nil
+	case MenuButtonCommands.String():
+		return MenuButton{Type: MenuButtonCommands}, nil
+	case MenuButtonWebApp.String():
+		b := MenuButton{
+			Type: MenuButtonWebApp,
+			Text: mb.Text,
+		}
+		if mb.WebApp != nil {
+			b.WebAppURL = mb.WebApp.URL
+		}
+		return b, nil
+	}
+
+	return MenuButton{}, fmt.Errorf("unknown menu button type: %s", mb.Type)
+}
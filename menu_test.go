@@ -0,0 +1,76 @@
+package tg
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSetChatMenuButton(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	for _, c := range []struct {
+		chatID int64
+		button MenuButton
+	}{
+		{42, MenuButton{Type: MenuButtonDefault}},
+		{42, MenuButton{Type: MenuButtonCommands}},
+		{0, MenuButton{Type: MenuButtonWebApp, Text: "Shop", WebAppURL: "https://example.com/app"}},
+	} {
+		if err := bot.SetChatMenuButton(c.chatID, c.button); err != nil {
+			t.Fatalf("set chat menu button error: %v", err)
+		}
+	}
+
+	r := testSent(bot, "setChatMenuButton")
+	if len(r) != 3 {
+		t.Fatalf("expected three requests, got %d", len(r))
+	}
+
+	for i, c := range []struct {
+		chatID string
+		button string
+	}{
+		{"42", `{"type":"default"}`},
+		{"42", `{"type":"commands"}`},
+		{"", `{"type":"web_app","text":"Shop","web_app":{"url":"https://example.com/app"}}`},
+	} {
+		if r[i].Params["chat_id"] != c.chatID || r[i].Params["menu_button"] != c.button {
+			t.Fatalf("wrong request %d params: %v", i, r[i].Params)
+		}
+	}
+}
+
+func TestGetChatMenuButton(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if method != "getChatMenuButton" {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusOK, `{"ok":true,"result":{"type":"web_app","text":"Shop","web_app":{"url":"https://example.com/app"}}}`), nil
+	})
+
+	mb, err := bot.GetChatMenuButton(42)
+	if err != nil {
+		t.Fatalf("get chat menu button error: %v", err)
+	}
+
+	if mb.Type != MenuButtonWebApp || mb.Text != "Shop" || mb.WebAppURL != "https://example.com/app" {
+		t.Fatalf("wrong menu button: %+v", mb)
+	}
+}
+
+func TestGetChatMenuButtonError(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if method != "getChatMenuButton" {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`), nil
+	})
+
+	if _, err := bot.GetChatMenuButton(42); errors.Is(err, ErrChatNotFound) == false {
+		t.Fatalf("expected error %v, got %v", ErrChatNotFound, err)
+	}
+}
@@ -0,0 +1,286 @@
+package tg
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MessageBuilder it is a fluent builder for SendMessageData
+type MessageBuilder struct {
+	d SendMessageData
+}
+
+// NewMessage creates message builder with specified message text, e.g.:
+//
+//	tg.NewMessage("<b>Hello</b>").HTML().Buttons(row).DisablePreview().Build()
+func NewMessage(text string) MessageBuilder {
+	return MessageBuilder{
+		d: SendMessageData{
+			Message: text,
+		},
+	}
+}
+
+// Markdown sets Markdown parse mode for message
+func (mb MessageBuilder) Markdown() MessageBuilder {
+	mb.d.ParseMode = ParseModeMarkdown
+	return mb
+}
+
+// MarkdownV2 sets MarkdownV2 parse mode for message
+func (mb MessageBuilder) MarkdownV2() MessageBuilder {
+	mb.d.ParseMode = ParseModeMarkdownV2
+	return mb
+}
+
+// HTML sets HTML parse mode for message
+func (mb MessageBuilder) HTML() MessageBuilder {
+	mb.d.ParseMode = ParseModeHTML
+	return mb
+}
+
+// DisablePreview disables web page preview for message
+func (mb MessageBuilder) DisablePreview() MessageBuilder {
+	mb.d.DisableWebPagePreview = true
+	return mb
+}
+
+// Buttons appends specified button rows to message
+func (mb MessageBuilder) Buttons(rows ...[]Button) MessageBuilder {
+	mb.d.Buttons = append(append([][]Button{}, mb.d.Buttons...), rows...)
+	return mb
+}
+
+// ButtonState sets a state with callback handler for message buttons
+func (mb MessageBuilder) ButtonState(state SessionState) MessageBuilder {
+	mb.d.ButtonState = state
+	return mb
+}
+
+// Build returns composed message data
+func (mb MessageBuilder) Build() SendMessageData {
+	return mb.d
+}
+
+const (
+
+	// MessageMaxLen is a max length of message text (in characters)
+	MessageMaxLen = 4096
+
+	// buttonsMaxCount is a max number of buttons in inline keyboard
+	buttonsMaxCount = 100
+
+	// buttonsRowMaxCount is a max number of buttons in inline keyboard row
+	buttonsRowMaxCount = 8
+)
+
+// htmlTagRe matches HTML tags of message text
+var htmlTagRe = regexp.MustCompile(`<[^>]*>`)
+
+// MessageSplit splits message text into parts with length not exceeding
+// `limit` characters (MessageMaxLen will be used if `limit` is zero or less).
+// Text is split by line breaks where possible, then by spaces. Text is
+// considered as a plain one, i.e. markup characters (Markdown or HTML tags)
+// are counted and formatting spanned across the parts will be broken
+func MessageSplit(text string, limit int) []string {
+
+	var parts []string
+
+	if limit <= 0 {
+		limit = MessageMaxLen
+	}
+
+	r := []rune(text)
+
+	for len(r) > limit {
+
+		i := lastIndexRune(r[:limit+1], '\n')
+		if i <= 0 {
+			i = lastIndexRune(r[:limit+1], ' ')
+		}
+
+		if i <= 0 {
+			// No suitable separator, hard cut
+			parts = append(parts, string(r[:limit]))
+			r = r[limit:]
+			continue
+		}
+
+		parts = append(parts, string(r[:i]))
+		r = r[i+1:]
+	}
+
+	if len(r) > 0 || len(parts) == 0 {
+		parts = append(parts, string(r))
+	}
+
+	return parts
+}
+
+// messageSplit splits message text with specified parse mode into parts
+// with length of visible text not exceeding MessageMaxLen. Only text
+// without formatting is split: it's split as a plain text and then escaped
+// for the parse mode. Text with formatting is returned as is
+func messageSplit(text string, mode ParseMode) []string {
+
+	var parts []string
+
+	plain, f := messagePlain(text, mode)
+	if f == true || utf8.RuneCountInString(plain) <= MessageMaxLen {
+		return []string{text}
+	}
+
+	for _, p := range MessageSplit(plain, MessageMaxLen) {
+		parts = append(parts, tgbotapi.EscapeText(mode.String(), p))
+	}
+
+	return parts
+}
+
+// messageCheck checks length of message text user will see
+// (i.e. without markup of specified parse mode) is within Telegram limits
+func messageCheck(text string, mode ParseMode) error {
+
+	plain, _ := messagePlain(text, mode)
+
+	l := utf8.RuneCountInString(plain)
+
+	if l == 0 {
+		return ErrMessageEmpty
+	}
+
+	if l > MessageMaxLen {
+		return fmt.Errorf("%w: %d characters, max %d", ErrMessageTooLong, l, MessageMaxLen)
+	}
+
+	return nil
+}
+
+// buttonsCheck checks inline keyboard is within Telegram limits
+func buttonsCheck(buttons [][]Button) error {
+
+	var c int
+
+	for i, br := range buttons {
+		if len(br) > buttonsRowMaxCount {
+			return fmt.Errorf("%w: row %d contains %d buttons, max %d", ErrButtonsTooMany, i, len(br), buttonsRowMaxCount)
+		}
+		c += len(br)
+	}
+
+	if c > buttonsMaxCount {
+		return fmt.Errorf("%w: keyboard contains %d buttons, max %d", ErrButtonsTooMany, c, buttonsMaxCount)
+	}
+
+	return nil
+}
+
+// messagePlain gets message text as user will see it, i.e. without markup of
+// specified parse mode. Also returns whether or not text contains formatting
+// (tags, markup entities or code blocks). Escaped characters and HTML
+// character references are not considered as formatting
+func messagePlain(text string, mode ParseMode) (string, bool) {
+
+	var (
+		b             strings.Builder
+		f, code, link bool
+	)
+
+	if mode == ParseModeHTML {
+		p := htmlTagRe.ReplaceAllString(text, "")
+		return html.UnescapeString(p), p != text
+	}
+
+	v2 := mode == ParseModeMarkdownV2
+
+	r := []rune(text)
+
+	for i := 0; i < len(r); i++ {
+
+		c := r[i]
+
+		switch {
+
+		// Escaped character. Within the code blocks only MarkdownV2 supports escaping
+		case c == '\\' && i+1 < len(r) && (v2 == true || code == false && strings.ContainsRune("_*`[", r[i+1]) == true):
+			i++
+			b.WriteRune(r[i])
+
+		// Code or pre block
+		case c == '`':
+			f = true
+			if i+2 < len(r) && r[i+1] == '`' && r[i+2] == '`' {
+				i += 2
+				if code == false {
+					i = preLangSkip(r, i)
+				}
+			}
+			code = !code
+
+		case code == true:
+			b.WriteRune(c)
+
+		// URL of link or custom emoji
+		case c == ']' && link == true:
+			link = false
+			if i+1 < len(r) && r[i+1] == '(' {
+				for i < len(r) && r[i] != ')' {
+					i++
+				}
+			}
+
+		case c == '[':
+			f = true
+			link = true
+
+		// Custom emoji
+		case v2 == true && c == '!' && i+1 < len(r) && r[i+1] == '[':
+			f = true
+
+		// Bold, italic, underline, strikethrough and spoiler
+		case c == '*' || c == '_' || v2 == true && (c == '~' || c == '|'):
+			f = true
+
+		// Block quotation
+		case v2 == true && c == '>' && (i == 0 || r[i-1] == '\n'):
+			f = true
+
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	return b.String(), f
+}
+
+// preLangSkip skips programming language of pre block opened at `i`
+// (i.e. the word right before the line break) and returns new position
+func preLangSkip(r []rune, i int) int {
+
+	j := i + 1
+	for j < len(r) && r[j] != '`' && unicode.IsSpace(r[j]) == false {
+		j++
+	}
+
+	if j > i+1 && j < len(r) && r[j] == '\n' {
+		return j
+	}
+
+	return i
+}
+
+// lastIndexRune returns index of the last `c` in `r` or -1 if not found
+func lastIndexRune(r []rune, c rune) int {
+	for i := len(r) - 1; i >= 0; i-- {
+		if r[i] == c {
+			return i
+		}
+	}
+	return -1
+}
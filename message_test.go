@@ -0,0 +1,247 @@
+package tg
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSendMessageValidation(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	row := make([]Button, buttonsRowMaxCount+1)
+	for i := range row {
+		row[i] = Button{Text: "b", Identifier: "b"}
+	}
+
+	for _, c := range []struct {
+		msg SendMessageData
+		err error
+	}{
+		{SendMessageData{}, ErrMessageEmpty},
+		{SendMessageData{Message: strings.Repeat("a", MessageMaxLen+1)}, ErrMessageTooLong},
+		{SendMessageData{Message: "text", Buttons: [][]Button{row}}, ErrButtonsTooMany},
+	} {
+		if _, err := bot.SendMessage(1, 0, c.msg); errors.Is(err, c.err) == false {
+			t.Fatalf("expected error `%v`, got: %v", c.err, err)
+		}
+	}
+
+	// Invalid messages must not reach Telegram
+	if r := testSent(bot, "sendMessage"); len(r) != 0 {
+		t.Fatalf("unexpected sends: %v", r)
+	}
+
+	// Message of max length is valid
+	if _, err := bot.SendMessage(1, 0, SendMessageData{Message: strings.Repeat("я", MessageMaxLen)}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+}
+
+func TestMessageSplit(t *testing.T) {
+
+	for _, c := range []struct {
+		text  string
+		limit int
+		parts []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"", 10, []string{""}},
+		{"line one\nline two", 10, []string{"line one", "line two"}},
+		{"word word word", 10, []string{"word word", "word"}},
+		{"abcdefghijkl", 5, []string{"abcde", "fghij", "kl"}},
+	} {
+		parts := MessageSplit(c.text, c.limit)
+		if strings.Join(parts, "|") != strings.Join(c.parts, "|") || len(parts) != len(c.parts) {
+			t.Fatalf("wrong split of `%s`: %q", c.text, parts)
+		}
+	}
+}
+
+func TestSendMessageAutoSplit(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{AutoSplitMessages: true}, Description{})
+
+	// 9000 characters text of 90 lines 100 characters each
+	// (incl. line breaks and trailing character)
+	lines := make([]string, 90)
+	for i := range lines {
+		lines[i] = strings.Repeat("a", 99)
+	}
+	text := strings.Join(lines, "\n") + "!"
+
+	ms, err := bot.SendMessage(1, 0, SendMessageData{
+		Message: text,
+		Buttons: [][]Button{{{Text: "OK", Identifier: "ok"}}},
+	})
+	if err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 3 || len(ms) != 3 {
+		t.Fatalf("expected three sends, got %d (sent messages %d)", len(r), len(ms))
+	}
+
+	// Text is split on line boundaries, so parts contain
+	// whole lines (40 lines fit the limit)
+	for i, e := range []string{
+		strings.Join(lines[:40], "\n"),
+		strings.Join(lines[40:80], "\n"),
+		strings.Join(lines[80:], "\n") + "!",
+	} {
+		if r[i].Params["text"] != e {
+			t.Fatalf("wrong part %d boundaries: %d characters", i, len(r[i].Params["text"]))
+		}
+
+		// Buttons are attached to the last part only
+		if _, b := r[i].Params["reply_markup"]; b != (i == 2) {
+			t.Fatalf("wrong buttons of part %d: %v", i, r[i].Params["reply_markup"])
+		}
+	}
+}
+
+func TestEditMessageNotModified(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if strings.HasPrefix(method, "edit") == false {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusBadRequest, `{"ok":false,"error_code":400,"description":"Bad Request: message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message"}`), nil
+	})
+
+	ms, err := bot.SendMessage(42, 10, SendMessageData{Message: "same"})
+	if err != nil {
+		t.Fatalf("edit of not modified message must not fail, got: %v", err)
+	}
+	if len(ms) != 1 || ms[0].MessageID != 10 || ms[0].Chat.ID != 42 {
+		t.Fatalf("wrong edited message: %+v", ms)
+	}
+
+	if err := bot.EditInlineMessage("inline", SendMessageData{Message: "same"}); err != nil {
+		t.Fatalf("edit of not modified inline message must not fail, got: %v", err)
+	}
+}
+
+func TestMessagePlain(t *testing.T) {
+
+	for _, c := range []struct {
+		text   string
+		mode   ParseMode
+		plain  string
+		format bool
+	}{
+		{"plain text", ParseModeHTML, "plain text", false},
+		{"a &lt; b &amp; c", ParseModeHTML, "a < b & c", false},
+		{`<b>bold</b> <a href="https://example.com">link</a>`, ParseModeHTML, "bold link", true},
+		{`snake\_case`, ParseModeMarkdown, "snake_case", false},
+		{"*bold* [link](https://example.com)", ParseModeMarkdown, "bold link", true},
+		{"`a*b`", ParseModeMarkdown, "a*b", true},
+		{`end\. a\-b`, ParseModeMarkdownV2, "end. a-b", false},
+		{"__u__ ~s~ ||sp|| ![x](tg://emoji?id=1)", ParseModeMarkdownV2, "u s sp x", true},
+		{"```go\nfmt.Println()```", ParseModeMarkdownV2, "fmt.Println()", true},
+		{">quote", ParseModeMarkdownV2, "quote", true},
+	} {
+		plain, f := messagePlain(c.text, c.mode)
+		if plain != c.plain || f != c.format {
+			t.Fatalf("wrong plain text of `%s` (%v): `%s` (formatting %t)", c.text, c.mode, plain, f)
+		}
+	}
+}
+
+func TestSendMessageAutoSplitHTML(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{AutoSplitMessages: true}, Description{})
+
+	// Length is measured without markup: 4097 characters
+	// with tags, but 4090 visible ones
+	bold := "<b>" + strings.Repeat("a", 4090) + "</b>"
+
+	// Text without formatting is split by visible length
+	// and parts are escaped: 1000 lines 5 visible
+	// characters each (8 with character references)
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = "a &lt; b"
+	}
+	escaped := strings.Join(lines, "\n")
+
+	if _, err := bot.SendMessage(1, 0, SendMessageData{Message: bold, ParseMode: ParseModeHTML}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+	if _, err := bot.SendMessage(1, 0, SendMessageData{Message: escaped, ParseMode: ParseModeHTML}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 3 || r[0].Params["text"] != bold {
+		t.Fatalf("wrong sent messages: %d", len(r))
+	}
+
+	// 682 lines fit the limit (4091 characters incl. line breaks)
+	for i, e := range []string{
+		strings.Join(lines[:682], "\n"),
+		strings.Join(lines[682:], "\n"),
+	} {
+		if r[i+1].Params["text"] != e || r[i+1].Params["parse_mode"] != "HTML" {
+			t.Fatalf("wrong part %d: %d characters", i, len(r[i+1].Params["text"]))
+		}
+	}
+
+	// Text with formatting is never split
+	if _, err := bot.SendMessage(1, 0, SendMessageData{
+		Message:   "<b>Report</b>\n" + escaped,
+		ParseMode: ParseModeHTML,
+	}); errors.Is(err, ErrMessageTooLong) == false {
+		t.Fatalf("expected error %v, got %v", ErrMessageTooLong, err)
+	}
+	if r := testSent(bot, "sendMessage"); len(r) != 3 {
+		t.Fatalf("formatted message must not be sent: %d", len(r))
+	}
+}
+
+func TestMessageBuilder(t *testing.T) {
+
+	row := []Button{{Text: "OK", Identifier: "ok"}}
+
+	md := NewMessage("<b>Hello</b>").HTML().Buttons(row).ButtonState(SessState("menu")).DisablePreview().Build()
+
+	expected := SendMessageData{
+		Message:               "<b>Hello</b>",
+		ParseMode:             ParseModeHTML,
+		DisableWebPagePreview: true,
+		Buttons:               [][]Button{row},
+		ButtonState:           SessState("menu"),
+	}
+	if reflect.DeepEqual(md, expected) == false {
+		t.Fatalf("wrong built message: %+v", md)
+	}
+
+	// Builder methods do not modify the origin
+	b := NewMessage("text")
+	b.HTML()
+	if md := b.Build(); md.ParseMode == ParseModeHTML {
+		t.Fatal("builder origin must not be modified")
+	}
+	if md := b.MarkdownV2().Build(); md.ParseMode != ParseModeMarkdownV2 {
+		t.Fatalf("wrong parse mode: %v", md.ParseMode)
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {},
+		},
+	})
+
+	if _, err := bot.SendMessage(1, 0, md); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 1 || r[0].Params["parse_mode"] != "HTML" || r[0].Params["disable_web_page_preview"] != "true" || strings.Contains(r[0].Params["reply_markup"], `"text":"OK"`) == false {
+		t.Fatalf("wrong sent message: %+v", r)
+	}
+}
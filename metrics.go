@@ -0,0 +1,24 @@
+package tg
+
+import (
+	"time"
+)
+
+// Metrics is an interface to observe bot activity, e.g. with Prometheus
+type Metrics interface {
+
+	// ObserveHandler is called after every user handler call with handler
+	// source, state name (empty if not applicable), handler execution time
+	// and returned error
+	ObserveHandler(source HandlerSource, state string, d time.Duration, err error)
+
+	// ObserveSend is called after every message sent by `SendMessage`
+	ObserveSend(err error)
+}
+
+// metricsNoop it's a Metrics implementation doing nothing
+type metricsNoop struct{}
+
+func (metricsNoop) ObserveHandler(HandlerSource, string, time.Duration, error) {}
+
+func (metricsNoop) ObserveSend(error) {}
@@ -0,0 +1,62 @@
+package tg
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testMetrics it is a Metrics implementation recording observations
+type testMetrics struct {
+	mu       sync.Mutex
+	handlers []string
+	sends    []error
+}
+
+func (m *testMetrics) ObserveHandler(source HandlerSource, state string, d time.Duration, err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.handlers = append(m.handlers, source.String()+":"+state)
+}
+
+func (m *testMetrics) ObserveSend(err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sends = append(m.sends, err)
+}
+
+func TestMetrics(t *testing.T) {
+
+	m := &testMetrics{}
+
+	bot := testBotInit(t, nil, Settings{Metrics: m}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("hello")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("hello"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message:   "hello",
+						NextState: SessStateBreak(),
+					}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ProcessUpdate(testMessage(1, 1, "hi")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if len(m.handlers) != 2 || m.handlers[0] != "init:" || m.handlers[1] != "state:hello" {
+		t.Fatalf("wrong observed handlers: %v", m.handlers)
+	}
+	if len(m.sends) != 1 || m.sends[0] != nil {
+		t.Fatalf("wrong observed sends: %v", m.sends)
+	}
+}
@@ -0,0 +1,280 @@
+package tg
+
+import (
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Price contains a portion of the price for goods or services
+type Price struct {
+
+	// Label defines a portion label
+	Label string
+
+	// Amount defines a price of the product in the smallest units
+	// of the currency (e.g. 145 for US$ 1.45)
+	Amount int
+}
+
+// ShippingOption contains one shipping option
+type ShippingOption struct {
+	ID     string
+	Title  string
+	Prices []Price
+}
+
+// CurrencyStars is a currency code for payments in Telegram Stars
+const CurrencyStars = "XTR"
+
+// paymentDeclineMessage is an error message for payment queries
+// declined because bot has no appropriate handler
+const paymentDeclineMessage = "Payment can not be processed, please try again later"
+
+// Invoice contains options for invoice to be sent to user
+type Invoice struct {
+
+	// Title defines product name, 1-32 characters
+	Title string
+
+	// Description defines product description, 1-255 characters
+	Description string
+
+	// Payload defines a bot-defined invoice payload, 1-128 bytes. It will
+	// not be displayed to user, use it for internal processes
+	Payload string
+
+	// ProviderToken defines payment provider token. Must be empty
+	// for payments in Telegram Stars
+	ProviderToken string
+
+	// Currency defines three-letter ISO 4217 currency code
+	// or `CurrencyStars` for payments in Telegram Stars
+	Currency string
+
+	// Prices contains price breakdown (e.g. product price, tax, discount,
+	// delivery cost, etc). Must contain exactly one item for Telegram Stars
+	Prices []Price
+
+	// StartParameter defines deep-linking parameter. If empty, forwarded
+	// copies of the message will have a Pay button
+	StartParameter string
+
+	// PhotoURL defines an URL of the product photo
+	PhotoURL string
+
+	// Whether or not user's full name, phone number, email or
+	// shipping address are required to complete the order
+	NeedName            bool
+	NeedPhoneNumber     bool
+	NeedEmail           bool
+	NeedShippingAddress bool
+
+	// IsFlexible defines whether or not the final price depends
+	// on the shipping method (see `ShippingHandler`)
+	IsFlexible bool
+}
+
+// PaymentHandlerRes contains data returned by the PreCheckoutHandler and ShippingHandler
+type PaymentHandlerRes struct {
+
+	// NextState contains next session state
+	NextState SessionState
+}
+
+// PreCheckoutQueryGet gets pre-checkout query from update chain.
+// Returns nil if chain has not pre-checkout type
+func (uc *UpdateChain) PreCheckoutQueryGet() *tgbotapi.PreCheckoutQuery {
+
+	if uc.updateType != UpdateTypePreCheckout || len(uc.updates) == 0 {
+		return nil
+	}
+
+	return uc.updates[0].PreCheckoutQuery
+}
+
+// ShippingQueryGet gets shipping query from update chain.
+// Returns nil if chain has not shipping type
+func (uc *UpdateChain) ShippingQueryGet() *tgbotapi.ShippingQuery {
+
+	if uc.updateType != UpdateTypeShipping || len(uc.updates) == 0 {
+		return nil
+	}
+
+	return uc.updates[0].ShippingQuery
+}
+
+// SuccessfulPaymentGet gets successful payment info from the first message in update chain.
+// Returns nil if message is not a service message about successful payment
+func (uc *UpdateChain) SuccessfulPaymentGet() *tgbotapi.SuccessfulPayment {
+
+	if uc.updateType != UpdateTypeMessage || len(uc.updates) == 0 {
+		return nil
+	}
+
+	return uc.updates[0].Message.SuccessfulPayment
+}
+
+// AnswerPreCheckoutQuery answers to pre-checkout query. Set `ok` to false and
+// specify `errMsg` if there are any problems (e.g. goods are out of stock).
+// Note that Telegram expects an answer within 10 seconds
+func (t *Telegram) AnswerPreCheckoutQuery(id string, ok bool, errMsg string) error {
+
+	// Request parameters are composed here rather than with tgbotapi config
+	// because latter omits required `ok` parameter if it's false
+	params := make(tgbotapi.Params)
+	params["pre_checkout_query_id"] = id
+	params["ok"] = strconv.FormatBool(ok)
+
+	if ok == false {
+		params.AddNonEmpty("error_message", errMsg)
+	}
+
+	_, err := t.bot.MakeRequest("answerPreCheckoutQuery", params)
+
+	return err
+}
+
+// AnswerShippingQuery answers to shipping query with available shipping `options`.
+// Set `ok` to false and specify `errMsg` if delivery to the address is impossible
+func (t *Telegram) AnswerShippingQuery(id string, ok bool, options []ShippingOption, errMsg string) error {
+
+	// See `AnswerPreCheckoutQuery()` for the reason not to use tgbotapi config
+	params := make(tgbotapi.Params)
+	params["shipping_query_id"] = id
+	params["ok"] = strconv.FormatBool(ok)
+
+	if ok == true {
+
+		var so []tgbotapi.ShippingOption
+
+		for _, o := range options {
+			so = append(so, tgbotapi.ShippingOption{
+				ID:     o.ID,
+				Title:  o.Title,
+				Prices: pricesPrepare(o.Prices),
+			})
+		}
+
+		if err := params.AddInterface("shipping_options", so); err != nil {
+			return err
+		}
+	} else {
+		params.AddNonEmpty("error_message", errMsg)
+	}
+
+	_, err := t.bot.MakeRequest("answerShippingQuery", params)
+
+	return err
+}
+
+// SendInvoice sends invoice to specified chat
+func (t *Telegram) SendInvoice(chatID int64, inv Invoice) (MessageSent, error) {
+
+	c := tgbotapi.NewInvoice(chatID, inv.Title, inv.Description, inv.Payload, inv.ProviderToken, inv.StartParameter, inv.Currency, pricesPrepare(inv.Prices))
+
+	c.PhotoURL = inv.PhotoURL
+	c.NeedName = inv.NeedName
+	c.NeedPhoneNumber = inv.NeedPhoneNumber
+	c.NeedEmail = inv.NeedEmail
+	c.NeedShippingAddress = inv.NeedShippingAddress
+	c.IsFlexible = inv.IsFlexible
+
+	// Otherwise `null` will be sent and Telegram fails to parse it
+	c.SuggestedTipAmounts = []int{}
+
+	m, err := t.bot.Send(c)
+	t.metrics.ObserveSend(err)
+	if err != nil {
+		return MessageSent(m), classifyError(err)
+	}
+
+	t.sentHandlerCall([]MessageSent{MessageSent(m)})
+
+	return MessageSent(m), nil
+}
+
+// statePaymentProcessing processes update chain of pre-checkout or shipping query type
+func (s *Session) statePaymentProcessing(t *Telegram, hs HandlerSource) error {
+
+	var (
+		ns SessionState
+		r  PaymentHandlerRes
+		h  func(t *Telegram, s *Session) (PaymentHandlerRes, error)
+	)
+
+	switch hs {
+	case HandlerSourcePreCheckout:
+		h = t.description.PreCheckoutHandler
+	case HandlerSourceShipping:
+		h = t.description.ShippingHandler
+	}
+
+	// Query must be answered anyway, otherwise user
+	// will wait for the answer until Telegram timeout
+	if h == nil {
+		return paymentDecline(t, s.UpdateChain())
+	}
+
+	// Call PrimeHandler if specified
+	phs, err := primeProcessing(t, s, hs)
+	if err != nil {
+		return err
+	}
+	if phs != sessionContinue {
+		return s.stateSwitch(t, phs, 0)
+	}
+
+	err = t.handlerCall(s, hs, sessionBreak, func(s *Session) error {
+		var err error
+		r, err = h(t, s)
+		return err
+	})
+	if err != nil {
+
+		if t.description.ErrorHandler == nil {
+			return err
+		}
+
+		r, err := t.errorHandlerCall(s, err)
+		if err != nil {
+			return err
+		}
+
+		ns = r.NextState
+	} else {
+		ns = r.NextState
+	}
+
+	return s.stateSwitch(t, ns, 0)
+}
+
+// paymentDecline answers to pre-checkout or shipping query from update chain
+// with failure
+func paymentDecline(t *Telegram, uc *UpdateChain) error {
+
+	if q := uc.PreCheckoutQueryGet(); q != nil {
+		return t.AnswerPreCheckoutQuery(q.ID, false, paymentDeclineMessage)
+	}
+
+	if q := uc.ShippingQueryGet(); q != nil {
+		return t.AnswerShippingQuery(q.ID, false, nil, paymentDeclineMessage)
+	}
+
+	return nil
+}
+
+// pricesPrepare converts prices into Telegram API format
+func pricesPrepare(prices []Price) []tgbotapi.LabeledPrice {
+
+	var lp []tgbotapi.LabeledPrice
+
+	for _, p := range prices {
+		lp = append(lp, tgbotapi.LabeledPrice{
+			Label:  p.Label,
+			Amount: p.Amount,
+		})
+	}
+
+	return lp
+}
@@ -0,0 +1,247 @@
+package tg
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestPaymentQueries(t *testing.T) {
+
+	var chats []int64
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		PreCheckoutHandler: func(t *Telegram, s *Session) (PaymentHandlerRes, error) {
+
+			chats = append(chats, s.ChatIDGet())
+
+			q := s.UpdateChain().PreCheckoutQueryGet()
+			if err := t.AnswerPreCheckoutQuery(q.ID, false, "Out of stock"); err != nil {
+				return PaymentHandlerRes{}, err
+			}
+
+			return PaymentHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		ShippingHandler: func(t *Telegram, s *Session) (PaymentHandlerRes, error) {
+
+			chats = append(chats, s.ChatIDGet())
+
+			q := s.UpdateChain().ShippingQueryGet()
+			if err := t.AnswerShippingQuery(q.ID, true, []ShippingOption{
+				{
+					ID:     "post",
+					Title:  "Post",
+					Prices: []Price{{Label: "Delivery", Amount: 500}},
+				},
+			}, ""); err != nil {
+				return PaymentHandlerRes{}, err
+			}
+
+			return PaymentHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	pc := Update{
+		UpdateID: 1,
+		PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{
+			ID:             "pc",
+			From:           &tgbotapi.User{ID: 42},
+			Currency:       "USD",
+			TotalAmount:    1000,
+			InvoicePayload: "order",
+		},
+	}
+
+	sh := Update{
+		UpdateID: 2,
+		ShippingQuery: &tgbotapi.ShippingQuery{
+			ID:             "sh",
+			From:           &tgbotapi.User{ID: 43},
+			InvoicePayload: "order",
+		},
+	}
+
+	if ut := updateTypeEltGet(pc); ut != UpdateTypePreCheckout {
+		t.Fatalf("wrong pre-checkout query update type: %v", ut)
+	}
+	if ut := updateTypeEltGet(sh); ut != UpdateTypeShipping {
+		t.Fatalf("wrong shipping query update type: %v", ut)
+	}
+
+	for _, u := range []Update{pc, sh} {
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	// Queries have no chat, so sessions are keyed by user
+	if len(chats) != 2 || chats[0] != 42 || chats[1] != 43 {
+		t.Fatalf("wrong sessions chats: %v", chats)
+	}
+
+	a := testSent(bot, "answerPreCheckoutQuery")
+	if len(a) != 1 || a[0].Params["pre_checkout_query_id"] != "pc" || a[0].Params["ok"] != "false" || a[0].Params["error_message"] != "Out of stock" {
+		t.Fatalf("wrong pre-checkout query answer: %+v", a)
+	}
+
+	a = testSent(bot, "answerShippingQuery")
+	if len(a) != 1 || a[0].Params["shipping_query_id"] != "sh" || a[0].Params["ok"] != "true" {
+		t.Fatalf("wrong shipping query answer: %+v", a)
+	}
+
+	var opts []tgbotapi.ShippingOption
+	if err := json.Unmarshal([]byte(a[0].Params["shipping_options"]), &opts); err != nil {
+		t.Fatalf("shipping options unmarshal error: %v", err)
+	}
+	if len(opts) != 1 || opts[0].ID != "post" || len(opts[0].Prices) != 1 || opts[0].Prices[0].Amount != 500 {
+		t.Fatalf("wrong shipping options: %+v", opts)
+	}
+}
+
+// testPreCheckout makes an update with pre-checkout query from user
+func testPreCheckout(updateID int, userID int64) Update {
+	return Update{
+		UpdateID: updateID,
+		PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{
+			ID:             strconv.Itoa(updateID),
+			From:           &tgbotapi.User{ID: userID},
+			Currency:       "USD",
+			TotalAmount:    1000,
+			InvoicePayload: "order",
+		},
+	}
+}
+
+func TestPaymentQueriesUnlimited(t *testing.T) {
+
+	var handled []string
+
+	bot := testBotInit(t, nil, Settings{
+		UpdateQueueWait: time.Minute,
+		RateLimit: SettingsRateLimit{
+			Rate:  0.001,
+			Burst: 1,
+		},
+	}, Description{
+		PreCheckoutHandler: func(t *Telegram, s *Session) (PaymentHandlerRes, error) {
+			handled = append(handled, s.UpdateChain().PreCheckoutQueryGet().ID)
+			return PaymentHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	// Queries are processed at once in spite of queue wait and rate limit
+	for i := 1; i <= 2; i++ {
+		if err := bot.UpdateAbsorb(testPreCheckout(i, 42)); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+		if err := bot.Processing(); err != nil {
+			t.Fatalf("processing error: %v", err)
+		}
+	}
+
+	if fmt.Sprint(handled) != "[1 2]" {
+		t.Fatalf("wrong handled queries: %v", handled)
+	}
+}
+
+func TestPaymentQueriesDecline(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	for _, u := range []Update{
+		testPreCheckout(1, 42),
+		{
+			UpdateID: 2,
+			ShippingQuery: &tgbotapi.ShippingQuery{
+				ID:             "sh",
+				From:           &tgbotapi.User{ID: 43},
+				InvoicePayload: "order",
+			},
+		},
+	} {
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	// Queries without handlers are declined rather than left unanswered
+	for _, c := range []struct {
+		method string
+		param  string
+		id     string
+	}{
+		{"answerPreCheckoutQuery", "pre_checkout_query_id", "1"},
+		{"answerShippingQuery", "shipping_query_id", "sh"},
+	} {
+		a := testSent(bot, c.method)
+		if len(a) != 1 || a[0].Params[c.param] != c.id || a[0].Params["ok"] != "false" || len(a[0].Params["error_message"]) == 0 {
+			t.Fatalf("wrong %s: %+v", c.method, a)
+		}
+	}
+}
+
+func TestSendInvoice(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	for _, inv := range []Invoice{
+		{
+			Title:         "Book",
+			Description:   "Paper book",
+			Payload:       "order-1",
+			ProviderToken: "provider",
+			Currency:      "USD",
+			Prices: []Price{
+				{Label: "Book", Amount: 1000},
+				{Label: "Tax", Amount: 145},
+			},
+			NeedShippingAddress: true,
+			IsFlexible:          true,
+		},
+		{
+			Title:       "Sticker pack",
+			Description: "Digital goods",
+			Payload:     "order-2",
+			Currency:    CurrencyStars,
+			Prices:      []Price{{Label: "Pack", Amount: 50}},
+		},
+	} {
+		if _, err := bot.SendInvoice(42, inv); err != nil {
+			t.Fatalf("send invoice error: %v", err)
+		}
+	}
+
+	r := testSent(bot, "sendInvoice")
+	if len(r) != 2 {
+		t.Fatalf("expected two invoices, got %d", len(r))
+	}
+
+	for i, c := range []struct {
+		currency string
+		token    string
+		prices   int
+		flexible string
+	}{
+		{"USD", "provider", 2, "true"},
+		{"XTR", "", 1, ""},
+	} {
+
+		p := r[i].Params
+
+		if p["chat_id"] != "42" || p["currency"] != c.currency || p["provider_token"] != c.token || p["is_flexible"] != c.flexible {
+			t.Fatalf("wrong invoice %d params: %v", i, p)
+		}
+
+		var prices []tgbotapi.LabeledPrice
+		if err := json.Unmarshal([]byte(p["prices"]), &prices); err != nil {
+			t.Fatalf("prices unmarshal error: %v", err)
+		}
+		if len(prices) != c.prices {
+			t.Fatalf("wrong invoice %d prices: %+v", i, prices)
+		}
+	}
+}
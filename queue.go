@@ -1,32 +1,44 @@
 package tg
 
 import (
+	"context"
+	"sort"
 	"time"
 )
 
 // queue it is a queue context structure
 type queue struct {
-	redis        *redis
-	waitInterval time.Duration
+	redis *redis
+	fair  bool
 }
 
 type queueChain struct {
 }
 
-// queueInit initiates queue
-func queueInit(host string, waitInterval time.Duration) (queue, error) {
+// QueueStats contains queue statistics
+type QueueStats struct {
+
+	// Chats contains number of chats (queues) waiting for processing
+	Chats int
+
+	// Updates contains total number of updates waiting for processing
+	Updates int64
+}
+
+// queueInit initiates queue of bot `t`
+func queueInit(ctx context.Context, t *Telegram) (queue, error) {
 
 	var (
 		q   queue
 		err error
 	)
 
-	q.redis, err = redisConnect(host)
+	q.redis, err = t.redisGet(ctx)
 	if err != nil {
 		return q, err
 	}
 
-	q.waitInterval = waitInterval
+	q.fair = t.updateQueueFair
 
 	return q, nil
 }
@@ -35,54 +47,168 @@ func (q *queue) close() error {
 	return q.redis.close()
 }
 
-// add adds element into queue
-func (q *queue) add(chatID, userID int64, update Update) error {
+// add adds element into queue. Queue will be available for processing
+// after `wait` interval
+func (q *queue) add(ctx context.Context, chatID, userID int64, update Update, wait time.Duration) error {
 
-	if err := q.redis.queueMetaAdd(chatID, userID, time.Now().Add(q.waitInterval)); err != nil {
+	if err := q.redis.queueMetaAdd(ctx, chatID, userID, time.Now().Add(wait)); err != nil {
 		return err
 	}
 
-	if err := q.redis.queueUpdateAdd(chatID, userID, update); err != nil {
+	if err := q.redis.queueUpdateAdd(ctx, chatID, userID, update); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// seen checks whether the update has already been added into queue within `window`
+func (q *queue) seen(ctx context.Context, updateID int, window time.Duration) (bool, error) {
+	return q.redis.updateSeenCheck(ctx, updateID, window)
+}
+
+// unseen forgets the update which failed to be added into queue
+func (q *queue) unseen(ctx context.Context, updateID int) error {
+	return q.redis.updateSeenDel(ctx, updateID)
+}
+
+// limit checks whether the user has not exceeded the rate limit.
+// Returns false if update must be dropped and whether or not user
+// must be notified about it
+func (q *queue) limit(ctx context.Context, userID int64, rl SettingsRateLimit) (bool, bool, error) {
+	return q.redis.rateLimitCheck(ctx, userID, rl.Rate, rl.burstGet())
+}
+
 // chainGet finds available queue and get update chain
-func (q *queue) chainGet() (UpdateChain, error) {
+func (q *queue) chainGet(ctx context.Context) (UpdateChain, error) {
+
+	qm, err := q.ready(ctx)
+	if err != nil {
+		return UpdateChain{}, err
+	}
+
+	for _, m := range qm {
+
+		uc, b, err := q.claim(ctx, m)
+		if err != nil {
+			return UpdateChain{}, err
+		}
+
+		if b == true {
+			return uc, nil
+		}
+	}
+
+	return UpdateChain{}, nil
+}
+
+// ready gets queues available for processing
+func (q *queue) ready(ctx context.Context) ([]queueMeta, error) {
+
+	var r []queueMeta
+
+	qm, err := q.redis.queueMetasGet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, m := range qm {
+		if now.After(m.waitTill) == true {
+			r = append(r, m)
+		}
+	}
+
+	// Claim queues whose wait elapsed earliest first
+	if q.fair == true {
+		sort.Slice(r, func(i, j int) bool {
+			return r[i].waitTill.Before(r[j].waitTill)
+		})
+	}
+
+	return r, nil
+}
+
+// claim gets update chain from specified queue. Returns false
+// if queue has already been claimed by other goroutine
+func (q *queue) claim(ctx context.Context, m queueMeta) (UpdateChain, bool, error) {
 
 	var uc UpdateChain
 
-	qm, err := q.redis.queueMetasGet()
+	// Delete meta for this queue to prevent queue race with other goroutines
+	i, err := q.redis.queueMetaDel(ctx, m.chatID, m.userID)
 	if err != nil {
-		return UpdateChain{}, err
+		return uc, false, err
+	}
+
+	if i == 0 {
+		// If other goroutine lock the queue first
+		return uc, false, nil
+	}
+
+	u, err := q.redis.queueUpdatesGet(ctx, m.chatID, m.userID)
+	if err != nil {
+		return uc, false, err
+	}
+
+	uc.add(u)
+
+	return uc, true, nil
+}
+
+// purge drops queues whose wait interval expired before `before`
+func (q *queue) purge(ctx context.Context, before time.Time) error {
+
+	qm, err := q.redis.queueMetasGet(ctx)
+	if err != nil {
+		return err
 	}
 
 	for _, m := range qm {
-		if time.Now().After(m.waitTill) == true {
 
-			// Delete meta for this queue to prevent queue race with other goroutines
-			i, err := q.redis.queueMetaDel(m.chatID, m.userID)
-			if err != nil {
-				return uc, err
-			}
+		if m.waitTill.Before(before) == false {
+			continue
+		}
 
-			if i == 0 {
-				// If other goroutine lock the queue first
-				continue
-			}
+		i, err := q.redis.queueMetaDel(ctx, m.chatID, m.userID)
+		if err != nil {
+			return err
+		}
 
-			u, err := q.redis.queueUpdatesGet(m.chatID, m.userID)
-			if err != nil {
-				return uc, err
-			}
+		if i == 0 {
+			// Queue has been claimed by other goroutine
+			continue
+		}
 
-			uc.add(u)
+		if err := q.redis.queueUpdateDel(ctx, m.chatID, m.userID); err != nil {
+			return err
+		}
+	}
 
-			return uc, nil
+	return nil
+}
+
+// stats gets queue statistics
+func (q *queue) stats(ctx context.Context) (QueueStats, error) {
+
+	var qs QueueStats
+
+	qm, err := q.redis.queueMetasGet(ctx)
+	if err != nil {
+		return qs, err
+	}
+
+	for _, m := range qm {
+
+		l, err := q.redis.queueUpdatesLen(ctx, m.chatID, m.userID)
+		if err != nil {
+			return qs, err
 		}
+
+		qs.Chats++
+		qs.Updates += l
 	}
 
-	return UpdateChain{}, nil
+	return qs, nil
 }
@@ -0,0 +1,308 @@
+package tg
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestQueueStats(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{UpdateQueueWait: time.Minute}, Description{})
+
+	for i, userID := range []int64{1, 1, 2} {
+		if err := bot.UpdateAbsorb(testMessage(i+1, userID, "hello")); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+	}
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 2 || qs.Updates != 3 {
+		t.Fatalf("wrong queue stats: %+v", qs)
+	}
+}
+
+func TestQueueChain(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+	q := queue{redis: testRedisConnect(t, m, "")}
+
+	for i := 1; i <= 2; i++ {
+		if err := q.add(ctx, 1, 1, testMessage(i, 1, "hello"), 0); err != nil {
+			t.Fatalf("queue add error: %v", err)
+		}
+	}
+
+	uc, err := q.chainGet(ctx)
+	if err != nil {
+		t.Fatalf("queue chain get error: %v", err)
+	}
+	if uc.Len() != 2 {
+		t.Fatalf("wrong chain length: %d", uc.Len())
+	}
+
+	// Queue is empty after claim
+	uc, err = q.chainGet(ctx)
+	if err != nil {
+		t.Fatalf("queue chain get error: %v", err)
+	}
+	if uc.Len() != 0 {
+		t.Fatalf("queue must be empty: %d", uc.Len())
+	}
+}
+
+func TestQueueFair(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+	q := queue{
+		redis: testRedisConnect(t, m, ""),
+		fair:  true,
+	}
+
+	// Wait of the last chats elapses earlier
+	for i := int64(1); i <= 5; i++ {
+		if err := q.add(ctx, i, i, testMessage(int(i), i, "hello"), time.Duration(6-i)*10*time.Millisecond); err != nil {
+			t.Fatalf("queue add error: %v", err)
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	var chats []int64
+
+	for {
+		uc, err := q.chainGet(ctx)
+		if err != nil {
+			t.Fatalf("queue chain get error: %v", err)
+		}
+		if uc.Len() == 0 {
+			break
+		}
+		chats = append(chats, uc.Get()[0].Message.Chat.ID)
+	}
+
+	if fmt.Sprint(chats) != "[5 4 3 2 1]" {
+		t.Fatalf("wrong order of claimed chats: %v", chats)
+	}
+}
+
+func TestUpdateAbsorbWithWait(t *testing.T) {
+
+	var users []int64
+
+	bot := testBotInit(t, nil, Settings{UpdateQueueWait: time.Minute}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			users = append(users, s.UserIDGet())
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	if err := bot.UpdateAbsorb(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if err := bot.UpdateAbsorbWithWait(testMessage(2, 2, "hello"), 10*time.Millisecond); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if err := bot.Processing(); err != nil {
+			t.Fatalf("processing error: %v", err)
+		}
+	}
+
+	// Only the queue with short wait is processed
+	if fmt.Sprint(users) != "[2]" {
+		t.Fatalf("wrong processed users: %v", users)
+	}
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 1 || qs.Updates != 1 {
+		t.Fatalf("wrong queue stats: %+v", qs)
+	}
+}
+
+func TestUpdateAbsorbSynchronous(t *testing.T) {
+
+	var texts []string
+
+	bot := testBotInit(t, nil, Settings{
+		Synchronous:     true,
+		UpdateQueueWait: time.Minute,
+	}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			texts = append(texts, s.UpdateChain().LastMessageText())
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	// Update is processed at once regardless of queue wait
+	if err := bot.UpdateAbsorb(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+
+	if fmt.Sprint(texts) != "[hello]" {
+		t.Fatalf("wrong processed messages: %v", texts)
+	}
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 0 || qs.Updates != 0 {
+		t.Fatalf("queue must be empty: %+v", qs)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	var users []int64
+
+	m := miniredis.RunT(t)
+
+	s := Settings{
+		Synchronous: true,
+		RateLimit: SettingsRateLimit{
+			Rate:    10,
+			Burst:   2,
+			Message: "Slow down",
+		},
+	}
+
+	d := Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			users = append(users, s.UserIDGet())
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	}
+
+	// Bots share the limit via Redis
+	bots := []*Telegram{
+		testBotInit(t, m, s, d),
+		testBotInit(t, m, s, d),
+	}
+
+	for i := 1; i <= 5; i++ {
+		if err := bots[i%2].UpdateAbsorb(testMessage(i, 1, "hello")); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+	}
+
+	// Other users are not affected
+	if err := bots[0].UpdateAbsorb(testMessage(6, 2, "hello")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+
+	if fmt.Sprint(users) != "[1 1 2]" {
+		t.Fatalf("wrong processed users: %v", users)
+	}
+
+	// User is notified once
+	var notified int
+	for _, bot := range bots {
+		for _, r := range testSent(bot, "sendMessage") {
+			if r.Params["text"] == "Slow down" && r.Params["chat_id"] == "1" {
+				notified++
+			}
+		}
+	}
+	if notified != 1 {
+		t.Fatalf("expected user to be notified once, got %d", notified)
+	}
+
+	// Bucket is refilled over time
+	time.Sleep(150 * time.Millisecond)
+
+	if err := bots[0].UpdateAbsorb(testMessage(7, 1, "hello")); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if fmt.Sprint(users) != "[1 1 2 1]" {
+		t.Fatalf("wrong processed users after refill: %v", users)
+	}
+}
+
+func TestDropPendingUpdates(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+
+	bot := testBotInit(t, m, Settings{}, Description{})
+
+	q, err := queueInit(ctx, bot)
+	if err != nil {
+		t.Fatalf("queue init error: %v", err)
+	}
+	defer q.close()
+
+	// Queue left by a bot stopped long ago and the fresh one
+	if err := q.add(ctx, 1, 1, testMessage(1, 1, "old"), -10*time.Minute); err != nil {
+		t.Fatalf("queue add error: %v", err)
+	}
+	if err := q.add(ctx, 2, 2, testMessage(2, 2, "fresh"), -time.Second); err != nil {
+		t.Fatalf("queue add error: %v", err)
+	}
+
+	bot = testBotInit(t, m, Settings{DropPendingUpdates: true}, Description{})
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 1 || qs.Updates != 1 {
+		t.Fatalf("only old queue must be dropped: %+v", qs)
+	}
+
+	// Telegram drops updates received while bot was down
+	r := testSent(bot, "deleteWebhook")
+	if len(r) != 1 || r[0].Params["drop_pending_updates"] != "true" {
+		t.Fatalf("wrong deleteWebhook requests: %+v", r)
+	}
+}
+
+func TestDropPendingUpdatesDisabled(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+
+	bot := testBotInit(t, m, Settings{}, Description{})
+
+	q, err := queueInit(ctx, bot)
+	if err != nil {
+		t.Fatalf("queue init error: %v", err)
+	}
+	defer q.close()
+
+	if err := q.add(ctx, 1, 1, testMessage(1, 1, "old"), -10*time.Minute); err != nil {
+		t.Fatalf("queue add error: %v", err)
+	}
+
+	bot = testBotInit(t, m, Settings{}, Description{})
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 1 || qs.Updates != 1 {
+		t.Fatalf("queue must be kept: %+v", qs)
+	}
+
+	if r := testSent(bot, "deleteWebhook"); len(r) != 1 || len(r[0].Params["drop_pending_updates"]) != 0 {
+		t.Fatalf("wrong deleteWebhook requests: %+v", r)
+	}
+}
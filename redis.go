@@ -1,17 +1,27 @@
 package tg
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math/rand"
+	"reflect"
 	"strconv"
 	"strings"
 	"time"
 
-	rds "github.com/go-redis/redis"
+	rds "github.com/redis/go-redis/v9"
 )
 
 type redis struct {
-	client *rds.Client
+	client  *rds.Client
+	prefix  string
+	sessTTL time.Duration
+
+	// shared defines whether or not client is shared between
+	// several bots (see `Manager`) and must not be closed
+	shared bool
 }
 
 type queueMeta struct {
@@ -24,23 +34,216 @@ const (
 	sessionKey      = "sess"
 	queueMetaKey    = "meta"
 	queueUpdatesKey = "updates"
+	updateSeenKey   = "seen"
+	rateLimitKey    = "ratelimit"
+	toastsKey       = "toasts"
 )
 
-// connect connects to Redis
-func redisConnect(host string) (*redis, error) {
+// toastsTTL is an interval toasts of buttons are kept for since
+// the last message with buttons has been sent into chat
+const toastsTTL = 30 * 24 * time.Hour
+
+const (
+
+	// sessUpdateRetries is a max number of attempts to save session
+	// if it was concurrently modified
+	sessUpdateRetries = 10
+
+	// sessUpdateBackoff is a base interval to wait between attempts to save session
+	sessUpdateBackoff = 5 * time.Millisecond
+)
+
+const (
+	redisPoolSizeDefault     = 10
+	redisDialTimeoutDefault  = 10 * time.Second
+	redisReadTimeoutDefault  = 30 * time.Second
+	redisWriteTimeoutDefault = 30 * time.Second
+	redisPoolTimeoutDefault  = 30 * time.Second
+)
+
+// errSessUpdateSkip is returned by `sessUpdate` callback to finish without saving session
+var errSessUpdateSkip = errors.New("skip session update")
+
+// sessSaveScript saves the session only if it has not been modified
+// since it was read (i.e. stored version equals to expected one).
+// Expired session is considered as not existing.
+// KEYS[1] - sessions hash, ARGV[1] - session field, ARGV[2] - session data,
+// ARGV[3] - whether session existed on read, ARGV[4] - expected version,
+// ARGV[5] - current time (unix milliseconds)
+var sessSaveScript = rds.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+local d = nil
+if cur then
+	d = cjson.decode(cur)
+	local exp = d['expires'] or 0
+	if exp ~= 0 and exp <= tonumber(ARGV[5]) then
+		cur = nil
+	end
+end
+if cur then
+	if ARGV[3] ~= '1' then
+		return 0
+	end
+	local v = d['version'] or 0
+	if v ~= tonumber(ARGV[4]) then
+		return 0
+	end
+elseif ARGV[3] == '1' then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// sessExpiredDelScript deletes the session only if it is expired, so
+// the session concurrently extended (e.g. by other bot instance) is kept.
+// KEYS[1] - sessions hash, ARGV[1] - session field,
+// ARGV[2] - current time (unix milliseconds)
+var sessExpiredDelScript = rds.NewScript(`
+local cur = redis.call('HGET', KEYS[1], ARGV[1])
+if not cur then
+	return 0
+end
+local exp = cjson.decode(cur)['expires'] or 0
+if exp ~= 0 and exp <= tonumber(ARGV[2]) then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// rateLimitScript takes a token from the user bucket refilled with `rate` tokens
+// per second up to `burst` tokens. Returns 1 if token was taken, 2 if bucket
+// is empty and user was not notified about it yet and 0 otherwise.
+// KEYS[1] - bucket hash, ARGV[1] - rate, ARGV[2] - burst,
+// ARGV[3] - current time (unix milliseconds)
+var rateLimitScript = rds.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts', 'notified')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+local notified = b[3] or '0'
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+end
+local res = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	notified = '0'
+	res = 1
+elseif notified ~= '1' then
+	notified = '1'
+	res = 2
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', ARGV[3], 'notified', notified)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst * 1000 / rate) + 1000)
+return res
+`)
+
+// redisOptionsGet gets Redis client options from bot settings.
+// Redis host may be specified either as `host:port` or as URL
+// with `redis://` or `rediss://` (TLS) scheme
+func redisOptionsGet(s Settings) (*rds.Options, error) {
+
+	var (
+		o   *rds.Options
+		err error
+	)
+
+	if strings.HasPrefix(s.RedisHost, "redis://") || strings.HasPrefix(s.RedisHost, "rediss://") {
+
+		o, err = rds.ParseURL(s.RedisHost)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.RedisTLS != nil {
+			if o.TLSConfig == nil {
+				return nil, fmt.Errorf("%w: TLS config specified for non-TLS Redis URL", ErrRedisTLSConflict)
+			}
+			o.TLSConfig = s.RedisTLS
+		}
+	} else {
+		o = &rds.Options{
+			Addr:      s.RedisHost,
+			TLSConfig: s.RedisTLS,
+		}
+	}
+
+	o.PoolSize = redisPoolSizeDefault
+	if s.RedisPoolSize > 0 {
+		o.PoolSize = s.RedisPoolSize
+	}
+
+	o.DialTimeout = redisDialTimeoutDefault
+	if s.RedisDialTimeout > 0 {
+		o.DialTimeout = s.RedisDialTimeout
+	}
+
+	o.ReadTimeout = redisReadTimeoutDefault
+	if s.RedisReadTimeout > 0 {
+		o.ReadTimeout = s.RedisReadTimeout
+	}
+
+	o.WriteTimeout = redisWriteTimeoutDefault
+	if s.RedisWriteTimeout > 0 {
+		o.WriteTimeout = s.RedisWriteTimeout
+	}
+
+	o.PoolTimeout = redisPoolTimeoutDefault
+	if s.RedisPoolTimeout > 0 {
+		o.PoolTimeout = s.RedisPoolTimeout
+	}
+
+	// Redis client retries commands failed with transient errors
+	// by itself, zero values mean its defaults
+	if s.RedisMaxRetries != 0 {
+		o.MaxRetries = s.RedisMaxRetries
+	}
+	if s.RedisMinRetryBackoff != 0 {
+		o.MinRetryBackoff = s.RedisMinRetryBackoff
+	}
+	if s.RedisMaxRetryBackoff != 0 {
+		o.MaxRetryBackoff = s.RedisMaxRetryBackoff
+	}
+
+	return o, nil
+}
+
+// redisOptionsSame checks Redis options `a` and `b` identify the same
+// connection, i.e. the same server, database, credentials and TLS settings
+func redisOptionsSame(a, b *rds.Options) bool {
+
+	network := func(o *rds.Options) string {
+		if len(o.Network) > 0 {
+			return o.Network
+		}
+		if strings.HasPrefix(o.Addr, "/") {
+			return "unix"
+		}
+		return "tcp"
+	}
+
+	return network(a) == network(b) &&
+		a.Addr == b.Addr &&
+		a.DB == b.DB &&
+		a.Username == b.Username &&
+		a.Password == b.Password &&
+		reflect.DeepEqual(a.TLSConfig, b.TLSConfig) == true
+}
+
+// connect connects to Redis. If `prefix` is not empty
+// it will be prepended to all keys
+func redisConnect(ctx context.Context, opts *rds.Options, prefix string) (*redis, error) {
 
 	r := new(redis)
+	r.prefix = prefix
 
-	client := rds.NewClient(&rds.Options{
-		Addr:         host,
-		DialTimeout:  10 * time.Second,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		PoolSize:     10,
-		PoolTimeout:  30 * time.Second,
-	})
+	client := rds.NewClient(opts)
 
-	p := client.Ping()
+	p := client.Ping(ctx)
 
 	if p.Err() != nil {
 		return r, p.Err()
@@ -51,33 +254,116 @@ func redisConnect(host string) (*redis, error) {
 	return r, nil
 }
 
+// redisAttach uses Redis client shared between several bots
+func redisAttach(client *rds.Client, prefix string) *redis {
+	return &redis{
+		client: client,
+		prefix: prefix,
+		shared: true,
+	}
+}
+
+// key gets full Redis key name for specified one
+func (r *redis) key(k string) string {
+
+	if len(r.prefix) == 0 {
+		return k
+	}
+
+	return r.prefix + ":" + k
+}
+
 // close closes Redis connection
 func (r *redis) close() error {
+	if r.shared == true {
+		return nil
+	}
 	return r.client.Close()
 }
 
-// sessSave saves the session into Redis
-func (r *redis) sessSave(chatID, userID int64, d data) error {
+// sessSave saves the session into Redis if it has not been modified
+// since it was read. Returns false if session was concurrently modified
+func (r *redis) sessSave(ctx context.Context, key string, d data, exists bool) (bool, error) {
+
+	var e string
+
+	now := time.Now()
+
+	expected := d.Version
+	d.Version++
+
+	// Every save extends the session lifetime
+	if r.sessTTL > 0 {
+		d.Expires = now.Add(r.sessTTL).UnixNano() / int64(time.Millisecond)
+	} else {
+		d.Expires = 0
+	}
 
 	b, err := json.Marshal(d)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if exists == true {
+		e = "1"
+	} else {
+		e = "0"
 	}
 
-	s := r.client.HSet(sessionKey, strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10), b)
+	s := sessSaveScript.Run(ctx, r.client, []string{r.key(sessionKey)}, key, b, e, expected, now.UnixNano()/int64(time.Millisecond))
 	if s.Err() != nil {
-		return s.Err()
+		return false, s.Err()
 	}
 
-	return nil
+	i, err := s.Int64()
+	if err != nil {
+		return false, err
+	}
+
+	return i == 1, nil
+}
+
+// sessUpdate reads the session, applies `f` to it and saves the result.
+// If session was concurrently modified the whole cycle will be retried.
+// If `f` returns `errSessUpdateSkip` session will not be saved
+func (r *redis) sessUpdate(ctx context.Context, key string, f func(d *data, exists bool) error) error {
+
+	for i := 0; i < sessUpdateRetries; i++ {
+
+		d, e, err := r.sessGet(ctx, key)
+		if err != nil {
+			return err
+		}
+
+		if err := f(&d, e); err != nil {
+			if err == errSessUpdateSkip {
+				return nil
+			}
+			return err
+		}
+
+		b, err := r.sessSave(ctx, key, d, e)
+		if err != nil {
+			return err
+		}
+
+		if b == true {
+			return nil
+		}
+
+		// Wait random interval to reduce a chance of conflict on next attempt
+		time.Sleep(time.Duration(rand.Int63n(int64(sessUpdateBackoff) * int64(i+1))))
+	}
+
+	return ErrSessionConflict
 }
 
 // sessGet gets session from Redis
-func (r *redis) sessGet(chatID, userID int64) (data, bool, error) {
+func (r *redis) sessGet(ctx context.Context, key string) (data, bool, error) {
 
 	var d data
 
-	s := r.client.HGet(sessionKey, strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10))
+	s := r.client.HGet(ctx, r.key(sessionKey), key)
 	if s.Err() != nil {
 		if s.Err() == rds.Nil {
 			// Key not found
@@ -95,14 +381,87 @@ func (r *redis) sessGet(chatID, userID int64) (data, bool, error) {
 		return d, false, err
 	}
 
+	if d.expired() == true {
+		if err := r.sessExpiredDel(ctx, key); err != nil {
+			return data{}, false, err
+		}
+		return data{}, false, nil
+	}
+
 	return d, true, nil
 }
 
+// sessScan iterates over all sessions stored in Redis and calls `f` for each one
+func (r *redis) sessScan(ctx context.Context, f func(key string, d data) error) error {
+
+	var cursor uint64
+
+	for {
+
+		keys, c, err := r.client.HScan(ctx, r.key(sessionKey), cursor, "", 100).Result()
+		if err != nil {
+			return err
+		}
+
+		var expired []string
+
+		// Result contains field and value pairs
+		for i := 0; i+1 < len(keys); i += 2 {
+
+			var d data
+
+			if err := json.Unmarshal([]byte(keys[i+1]), &d); err != nil {
+				return err
+			}
+
+			if d.expired() == true {
+				expired = append(expired, keys[i])
+				continue
+			}
+
+			if err := f(keys[i], d); err != nil {
+				return err
+			}
+		}
+
+		for _, k := range expired {
+			if err := r.sessExpiredDel(ctx, k); err != nil {
+				return err
+			}
+		}
+
+		if c == 0 {
+			return nil
+		}
+		cursor = c
+	}
+}
+
+// sessSet saves the session into Redis regardless of its current version
+func (r *redis) sessSet(ctx context.Context, key string, d data) error {
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	s := r.client.HSet(ctx, r.key(sessionKey), key, b)
+	if s.Err() != nil {
+		return s.Err()
+	}
+
+	return nil
+}
+
+// sessExpiredDel deletes session from Redis if it is expired
+func (r *redis) sessExpiredDel(ctx context.Context, key string) error {
+	return sessExpiredDelScript.Run(ctx, r.client, []string{r.key(sessionKey)}, key, time.Now().UnixNano()/int64(time.Millisecond)).Err()
+}
+
 // sessDel deletes session from Redis
-func (r *redis) sessDel(chatID, userID int64) error {
+func (r *redis) sessDel(ctx context.Context, key string) error {
 
-	// Delete session
-	s := r.client.HDel(sessionKey, strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10))
+	s := r.client.HDel(ctx, r.key(sessionKey), key)
 	if s.Err() != nil {
 		if s.Err() == rds.Nil {
 			// Key not found
@@ -111,24 +470,103 @@ func (r *redis) sessDel(chatID, userID int64) error {
 		return s.Err()
 	}
 
-	// Delete meta
-	if _, err := r.queueMetaDel(chatID, userID); err != nil {
-		return err
+	return nil
+}
+
+// rateLimitCheck takes a token from the bucket of specified user.
+// Returns false if bucket is empty and whether or not it is
+// the first rejected attempt since the last allowed one
+func (r *redis) rateLimitCheck(ctx context.Context, userID int64, rate float64, burst int) (bool, bool, error) {
+
+	s := rateLimitScript.Run(ctx, r.client, []string{r.key(rateLimitKey + ":" + strconv.FormatInt(userID, 10))},
+		strconv.FormatFloat(rate, 'f', -1, 64), burst, time.Now().UnixNano()/int64(time.Millisecond))
+	if s.Err() != nil {
+		return false, false, s.Err()
 	}
 
-	if err := r.queueUpdateDel(chatID, userID); err != nil {
-		return err
+	i, err := s.Int64()
+	if err != nil {
+		return false, false, err
 	}
 
-	return nil
+	return i == 1, i == 2, nil
+}
+
+// updateSeenCheck checks whether the update with specified ID has already been
+// seen within the `window` (e.g. by other bot instance). If not, update ID
+// will be remembered for the `window`
+func (r *redis) updateSeenCheck(ctx context.Context, updateID int, window time.Duration) (bool, error) {
+
+	s := r.client.SetNX(ctx, r.key(updateSeenKey+":"+strconv.Itoa(updateID)), 1, window)
+	if s.Err() != nil {
+		return false, s.Err()
+	}
+
+	// Key already exists
+	return s.Val() == false, nil
+}
+
+// updateSeenDel forgets the update with specified ID, so it
+// will not be dropped on redelivery
+func (r *redis) updateSeenDel(ctx context.Context, updateID int) error {
+	return r.client.Del(ctx, r.key(updateSeenKey+":"+strconv.Itoa(updateID))).Err()
+}
+
+// toastsSave saves toasts for buttons with specified callback data. Toasts of
+// buttons in `noToasts` are deleted, so buttons re-sent without toast will
+// not show the stale one
+func (r *redis) toastsSave(ctx context.Context, key string, toasts map[string]callbackToast, noToasts []string) error {
+
+	k := r.key(toastsKey + ":" + key)
+
+	p := r.client.TxPipeline()
+
+	for d, ct := range toasts {
+		b, err := json.Marshal(ct)
+		if err != nil {
+			return err
+		}
+		p.HSet(ctx, k, d, b)
+	}
+
+	if len(noToasts) > 0 {
+		p.HDel(ctx, k, noToasts...)
+	}
+
+	p.PExpire(ctx, k, toastsTTL)
+
+	_, err := p.Exec(ctx)
+
+	return err
+}
+
+// toastGet gets toast for button with specified callback data.
+// Returns empty toast if button has no one
+func (r *redis) toastGet(ctx context.Context, key, data string) (callbackToast, error) {
+
+	var ct callbackToast
+
+	s := r.client.HGet(ctx, r.key(toastsKey+":"+key), data)
+	if s.Err() == rds.Nil {
+		return ct, nil
+	}
+	if s.Err() != nil {
+		return ct, s.Err()
+	}
+
+	if err := json.Unmarshal([]byte(s.Val()), &ct); err != nil {
+		return ct, err
+	}
+
+	return ct, nil
 }
 
 // queueMetaAdd adds or updates specified meta
-func (r *redis) queueMetaAdd(chatID, userID int64, waitTill time.Time) error {
+func (r *redis) queueMetaAdd(ctx context.Context, chatID, userID int64, waitTill time.Time) error {
 
 	t, _ := waitTill.MarshalJSON()
 
-	s := r.client.HSet(queueMetaKey, strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10), t)
+	s := r.client.HSet(ctx, r.key(queueMetaKey), strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10), t)
 	if s.Err() != nil {
 		return s.Err()
 	}
@@ -137,11 +575,11 @@ func (r *redis) queueMetaAdd(chatID, userID int64, waitTill time.Time) error {
 }
 
 // queueMetasGet gets all meta from Redis
-func (r *redis) queueMetasGet() ([]queueMeta, error) {
+func (r *redis) queueMetasGet(ctx context.Context) ([]queueMeta, error) {
 
 	var qm []queueMeta
 
-	metas := r.client.HGetAll(queueMetaKey)
+	metas := r.client.HGetAll(ctx, r.key(queueMetaKey))
 	if metas.Err() != nil {
 		return qm, metas.Err()
 	}
@@ -181,9 +619,9 @@ func (r *redis) queueMetasGet() ([]queueMeta, error) {
 }
 
 // queueMetaDel deletes specified meta
-func (r *redis) queueMetaDel(chatID, userID int64) (int64, error) {
+func (r *redis) queueMetaDel(ctx context.Context, chatID, userID int64) (int64, error) {
 
-	s := r.client.HDel(queueMetaKey, strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10))
+	s := r.client.HDel(ctx, r.key(queueMetaKey), strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10))
 	if s.Err() != nil {
 		return 0, s.Err()
 	}
@@ -192,14 +630,14 @@ func (r *redis) queueMetaDel(chatID, userID int64) (int64, error) {
 }
 
 // queueUpdateAdd adds new update into specified list
-func (r *redis) queueUpdateAdd(chatID, userID int64, update Update) error {
+func (r *redis) queueUpdateAdd(ctx context.Context, chatID, userID int64, update Update) error {
 
 	b, err := json.Marshal(update)
 	if err != nil {
 		return err
 	}
 
-	s := r.client.RPush(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10), b)
+	s := r.client.RPush(ctx, r.key(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10)), b)
 	if s.Err() != nil {
 		return s.Err()
 	}
@@ -207,12 +645,23 @@ func (r *redis) queueUpdateAdd(chatID, userID int64, update Update) error {
 	return nil
 }
 
+// queueUpdatesLen gets number of updates in specified list
+func (r *redis) queueUpdatesLen(ctx context.Context, chatID, userID int64) (int64, error) {
+
+	l := r.client.LLen(ctx, r.key(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10)))
+	if l.Err() != nil {
+		return 0, l.Err()
+	}
+
+	return l.Val(), nil
+}
+
 // queueUpdatesGet gets all updates from specified list
-func (r *redis) queueUpdatesGet(chatID, userID int64) ([]Update, error) {
+func (r *redis) queueUpdatesGet(ctx context.Context, chatID, userID int64) ([]Update, error) {
 
 	var updates []Update
 
-	l := r.client.LLen(queueUpdatesKey + ":" + strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10))
+	l := r.client.LLen(ctx, r.key(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10)))
 	if l.Err() != nil {
 		return updates, l.Err()
 	}
@@ -221,7 +670,7 @@ func (r *redis) queueUpdatesGet(chatID, userID int64) ([]Update, error) {
 
 		var update Update
 
-		s := r.client.LPop(queueUpdatesKey + ":" + strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10))
+		s := r.client.LPop(ctx, r.key(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10)))
 		if s.Err() != nil {
 			return updates, s.Err()
 		}
@@ -237,10 +686,10 @@ func (r *redis) queueUpdatesGet(chatID, userID int64) ([]Update, error) {
 }
 
 // queueUpdateDel deletes specified list
-func (r *redis) queueUpdateDel(chatID, userID int64) error {
+func (r *redis) queueUpdateDel(ctx context.Context, chatID, userID int64) error {
 
 	// Delete queue
-	s := r.client.Del(queueUpdatesKey + ":" + strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10))
+	s := r.client.Del(ctx, r.key(queueUpdatesKey+":"+strconv.FormatInt(chatID, 10)+":"+strconv.FormatInt(userID, 10)))
 	if s.Err() != nil {
 		if s.Err() == rds.Nil {
 			// Key not found
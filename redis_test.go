@@ -0,0 +1,357 @@
+package tg
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	rds "github.com/redis/go-redis/v9"
+)
+
+// testSessionNew opens session for specified user in private chat
+func testSessionNew(t *testing.T, bot *Telegram, userID int64) *Session {
+
+	t.Helper()
+
+	s, err := sessionNew(context.Background(), bot, userID, userID)
+	if err != nil {
+		t.Fatalf("session open error: %v", err)
+	}
+	t.Cleanup(func() {
+		s.close()
+	})
+
+	return s
+}
+
+func TestSessionTTLTouch(t *testing.T) {
+
+	// Session expiration is tracked within session data (not
+	// by Redis keys TTL), so real time is used instead of
+	// miniredis FastForward
+	const ttl = 300 * time.Millisecond
+
+	m := miniredis.RunT(t)
+
+	bot := testBotInit(t, m, Settings{SessionTTL: ttl}, Description{})
+
+	if err := bot.SessionStateSet(1, 1, SessState("a")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	s := testSessionNew(t, bot, 1)
+
+	time.Sleep(ttl / 2)
+
+	if err := s.Touch(); err != nil {
+		t.Fatalf("session touch error: %v", err)
+	}
+
+	time.Sleep(ttl * 3 / 4)
+
+	// Session lifetime is extended by touch
+	st, e, err := s.StateGet()
+	if err != nil {
+		t.Fatalf("session state get error: %v", err)
+	}
+	if e == false || st != SessState("a") {
+		t.Fatalf("touched session must not expire: exists %v, state %s", e, st)
+	}
+
+	time.Sleep(ttl + ttl/4)
+
+	_, e, err = s.StateGet()
+	if err != nil {
+		t.Fatalf("session state get error: %v", err)
+	}
+	if e == true {
+		t.Fatal("session must expire")
+	}
+
+	// Expired session is deleted from Redis once it's read
+	if v := m.HGet(sessionKey, s.key); len(v) > 0 {
+		t.Fatalf("expired session must be deleted: %s", v)
+	}
+
+	if err := s.Touch(); err != ErrSessionNotExist {
+		t.Fatalf("touch of expired session must fail, got: %v", err)
+	}
+}
+
+func TestSessionTTLScan(t *testing.T) {
+
+	const ttl = 100 * time.Millisecond
+
+	m := miniredis.RunT(t)
+
+	bot := testBotInit(t, m, Settings{SessionTTL: ttl}, Description{})
+
+	if err := bot.SessionStateSet(1, 1, SessState("a")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	time.Sleep(ttl * 2)
+
+	if err := bot.SessionStateSet(2, 2, SessState("a")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	r, err := redisConnect(context.Background(), bot.redisOpts, bot.redisPrefix)
+	if err != nil {
+		t.Fatalf("redis connect error: %v", err)
+	}
+	defer r.close()
+
+	var keys []string
+
+	if err := r.sessScan(context.Background(), func(key string, d data) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatalf("sessions scan error: %v", err)
+	}
+
+	if len(keys) != 1 || keys[0] != sessionKeyGen(bot.sessionScope, 2, 2) {
+		t.Fatalf("wrong scanned sessions: %v", keys)
+	}
+
+	if f, _ := m.HKeys(sessionKey); len(f) != 1 {
+		t.Fatalf("expired session must be deleted by scan: %v", f)
+	}
+}
+
+func TestRedisOptionsTLS(t *testing.T) {
+
+	c := &tls.Config{ServerName: "redis.example.com"}
+
+	o, err := redisOptionsGet(Settings{RedisHost: "redis.example.com:6380", RedisTLS: c})
+	if err != nil {
+		t.Fatalf("redis options error: %v", err)
+	}
+	if o.TLSConfig != c {
+		t.Fatal("TLS config must be applied to options")
+	}
+
+	o, err = redisOptionsGet(Settings{RedisHost: "rediss://redis.example.com:6380/1", RedisTLS: c})
+	if err != nil {
+		t.Fatalf("redis options error: %v", err)
+	}
+	if o.TLSConfig != c || o.DB != 1 {
+		t.Fatalf("TLS config must be applied to options for TLS URL: %+v", o)
+	}
+
+	if _, err := redisOptionsGet(Settings{RedisHost: "redis://redis.example.com:6379", RedisTLS: c}); errors.Is(err, ErrRedisTLSConflict) == false {
+		t.Fatalf("TLS config for non-TLS URL must be rejected, got: %v", err)
+	}
+}
+
+func TestRedisOptionsPool(t *testing.T) {
+
+	o, err := redisOptionsGet(Settings{RedisHost: "localhost:6379"})
+	if err != nil {
+		t.Fatalf("redis options error: %v", err)
+	}
+	if o.PoolSize != redisPoolSizeDefault ||
+		o.DialTimeout != redisDialTimeoutDefault ||
+		o.ReadTimeout != redisReadTimeoutDefault ||
+		o.WriteTimeout != redisWriteTimeoutDefault ||
+		o.PoolTimeout != redisPoolTimeoutDefault {
+		t.Fatalf("default values must be used: %+v", o)
+	}
+
+	o, err = redisOptionsGet(Settings{
+		RedisHost:         "localhost:6379",
+		RedisPoolSize:     50,
+		RedisDialTimeout:  time.Second,
+		RedisReadTimeout:  2 * time.Second,
+		RedisWriteTimeout: 3 * time.Second,
+		RedisPoolTimeout:  4 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("redis options error: %v", err)
+	}
+	if o.PoolSize != 50 ||
+		o.DialTimeout != time.Second ||
+		o.ReadTimeout != 2*time.Second ||
+		o.WriteTimeout != 3*time.Second ||
+		o.PoolTimeout != 4*time.Second {
+		t.Fatalf("custom values must be used: %+v", o)
+	}
+}
+
+// testRedisConnect connects to in-memory Redis with specified keys prefix
+func testRedisConnect(t *testing.T, m *miniredis.Miniredis, prefix string) *redis {
+
+	t.Helper()
+
+	r, err := redisConnect(context.Background(), &rds.Options{Addr: m.Addr()}, prefix)
+	if err != nil {
+		t.Fatalf("redis connect error: %v", err)
+	}
+	t.Cleanup(func() {
+		r.close()
+	})
+
+	return r
+}
+
+func TestRedisSession(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+	r := testRedisConnect(t, m, "bot1")
+
+	if _, e, err := r.sessGet(ctx, "1:1"); err != nil || e == true {
+		t.Fatalf("session must not exist: %v", err)
+	}
+
+	b, err := r.sessSave(ctx, "1:1", data{State: "user:a"}, false)
+	if err != nil || b == false {
+		t.Fatalf("session save error: %v", err)
+	}
+
+	// Save of not existing session fails if it has been created concurrently
+	if b, err := r.sessSave(ctx, "1:1", data{State: "user:b"}, false); err != nil || b == true {
+		t.Fatalf("concurrently created session must not be overwritten: %v", err)
+	}
+
+	d, e, err := r.sessGet(ctx, "1:1")
+	if err != nil || e == false || d.State != "user:a" || d.Version != 1 {
+		t.Fatalf("wrong session: %+v (exists %v, error %v)", d, e, err)
+	}
+
+	// Save of stale version fails
+	if b, err := r.sessSave(ctx, "1:1", data{State: "user:c", Version: 0}, true); err != nil || b == true {
+		t.Fatalf("stale session must not be saved: %v", err)
+	}
+
+	if err := r.sessUpdate(ctx, "1:1", func(d *data, e bool) error {
+		d.State = "user:d"
+		return nil
+	}); err != nil {
+		t.Fatalf("session update error: %v", err)
+	}
+
+	if v := m.HGet("bot1:"+sessionKey, "1:1"); strings.Contains(v, `"state":"user:d"`) == false {
+		t.Fatalf("wrong stored session: %s", v)
+	}
+
+	if err := r.sessDel(ctx, "1:1"); err != nil {
+		t.Fatalf("session delete error: %v", err)
+	}
+	if _, e, err := r.sessGet(ctx, "1:1"); err != nil || e == true {
+		t.Fatalf("deleted session must not exist: %v", err)
+	}
+}
+
+// testRedisFlaky it is a TCP proxy to Redis which drops
+// the connection on the next command once it's armed
+type testRedisFlaky struct {
+	l     net.Listener
+	armed int32
+}
+
+func testRedisFlakyRun(t *testing.T, m *miniredis.Miniredis) *testRedisFlaky {
+
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	f := &testRedisFlaky{l: l}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c, m.Addr())
+		}
+	}()
+
+	return f
+}
+
+func (f *testRedisFlaky) serve(c net.Conn, addr string) {
+
+	defer c.Close()
+
+	u, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer u.Close()
+
+	go io.Copy(c, u)
+
+	b := make([]byte, 4096)
+	for {
+		n, err := c.Read(b)
+		if err != nil {
+			return
+		}
+		if atomic.CompareAndSwapInt32(&f.armed, 1, 0) == true {
+			return
+		}
+		if _, err := u.Write(b[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisRetry(t *testing.T) {
+
+	ctx := context.Background()
+
+	m := miniredis.RunT(t)
+	f := testRedisFlakyRun(t, m)
+
+	for _, retries := range []int{0, -1} {
+
+		o, err := redisOptionsGet(Settings{
+			RedisHost:       f.l.Addr().String(),
+			RedisMaxRetries: retries,
+		})
+		if err != nil {
+			t.Fatalf("redis options error: %v", err)
+		}
+
+		r, err := redisConnect(ctx, o, "")
+		if err != nil {
+			t.Fatalf("redis connect error: %v", err)
+		}
+
+		if err := r.sessSet(ctx, "1:1", data{State: "a"}); err != nil {
+			t.Fatalf("session set error: %v", err)
+		}
+
+		// Connection is dropped once
+		atomic.StoreInt32(&f.armed, 1)
+
+		d, e, err := r.sessGet(ctx, "1:1")
+
+		if retries == 0 {
+			if err != nil || e == false || d.State != "a" {
+				t.Fatalf("session must be got after retry: %+v (exists %t, error %v)", d, e, err)
+			}
+		} else if err == nil {
+			t.Fatalf("session get must fail without retries")
+		}
+
+		r.close()
+	}
+}
@@ -0,0 +1,84 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestSessionRerender(t *testing.T) {
+
+	var renders int
+
+	buttons := [][]Button{
+		{
+			{Text: "Refresh", Identifier: "refresh"},
+		},
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					renders++
+					return StateHandlerRes{
+						Message:      fmt.Sprintf("Rendered %d", renders),
+						StickMessage: true,
+						Buttons:      buttons,
+					}, nil
+				},
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					if err := s.Rerender(t); err != nil {
+						return CallbackHandlerRes{}, err
+					}
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStart(1, 1, SessState("menu")); err != nil {
+		t.Fatalf("session start error: %v", err)
+	}
+
+	ikm, err := keyboardPrepare(buttons, SessState("menu"))
+	if err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	testProcess(t, bot, Update{
+		UpdateID: 1,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "query",
+			From: &tgbotapi.User{ID: 1},
+			Message: &tgbotapi.Message{
+				MessageID: 7,
+				Chat:      &tgbotapi.Chat{ID: 1, Type: "private"},
+			},
+			Data: *ikm.InlineKeyboard[0][0].CallbackData,
+		},
+	})
+
+	// Menu is re-rendered in place
+	sent := testSent(bot, "sendMessage")
+	edited := testSent(bot, "editMessageText")
+	if len(sent) != 1 || sent[0].Params["text"] != "Rendered 1" ||
+		len(edited) != 1 || edited[0].Params["text"] != "Rendered 2" || edited[0].Params["message_id"] != "7" {
+		t.Fatalf("wrong re-rendered messages: sent %+v, edited %+v", sent, edited)
+	}
+
+	st, _, err := testSession(t, bot, 1).StateGet()
+	if err != nil {
+		t.Fatalf("state get error: %v", err)
+	}
+	if st != SessState("menu") {
+		t.Fatalf("session state must not be changed, got %v", st)
+	}
+
+	// Session must exist to be re-rendered
+	if err := testSession(t, bot, 2).Rerender(bot); errors.Is(err, ErrSessionNotExist) == false {
+		t.Fatalf("expected error %v, got %v", ErrSessionNotExist, err)
+	}
+}
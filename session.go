@@ -2,24 +2,66 @@ package tg
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type SessionState struct {
 	state string
 }
 
+// SessionScope defines the way sessions are separated
+type SessionScope int
+
+const (
+
+	// ScopeUser - every user has its own session within a chat
+	ScopeUser SessionScope = iota
+
+	// ScopeChat - all users within a chat share a single session.
+	// Useful for group flows
+	ScopeChat
+)
+
+func (s SessionScope) String() string {
+	return [...]string{"user", "chat"}[s]
+}
+
 // session it is a session context structure
 type Session struct {
+	key           string
+	scope         SessionScope
 	chatID        int64
 	userID        int64
 	userName      string
 	userFirstName string
 	userLastName  string
+	userLang      string
+	localizer     Localizer
 	updateChain   *UpdateChain
 	redis         *redis
+
+	// ctx is a context used for Redis operations within the session
+	ctx context.Context
+
+	// editOriginal overrides `StickMessage` for the next state switch
+	editOriginal *bool
 }
 
+// sessionStateUserPrefix is a prefix for states created by `SessState()`
+const sessionStateUserPrefix = "user:"
+
+// stateSlotPrefix is a prefix for slots namespaced by session state
+const stateSlotPrefix = "state:"
+
+// commandDeniedMessage is a message sent to user not allowed to execute a command
+const commandDeniedMessage = "You are not authorized to use this command"
+
 var (
 
 	// sessionDestroy it's a 'destroy' session state
@@ -29,14 +71,37 @@ var (
 	// PrimeHandler
 	sessionContinue SessionState = SessionState{"internal:continue"}
 
+	// sessionAnswer it's a state for answer-only buttons. Callbacks for
+	// such buttons are answered and never reach the session
+	sessionAnswer SessionState = SessionState{"internal:answer"}
+
 	// sessionBreak it's a 'break' session state
 	sessionBreak SessionState = SessionState{""}
 )
 
 // data contains session data
 type data struct {
-	State string            `json:"state"`
-	Slots map[string][]byte `json:"slots"`
+	State   string            `json:"state"`
+	Slots   map[string][]byte `json:"slots"`
+	Members map[string]Member `json:"members,omitempty"`
+	Version int64             `json:"version"`
+
+	// Expires contains a time (unix milliseconds) session expires at.
+	// Zero means session never expires
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// expired checks whether session data is expired
+func (d data) expired() bool {
+	return d.Expires != 0 && d.Expires <= time.Now().UnixNano()/int64(time.Millisecond)
+}
+
+// Member contains a user who has interacted with the session
+type Member struct {
+	UserID    int64  `json:"user_id"`
+	UserName  string `json:"user_name"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
 }
 
 // SessStateBreak creates a `break` session state
@@ -44,51 +109,83 @@ func SessStateBreak() SessionState {
 	return sessionBreak
 }
 
-// SessStateBreak creates a `continue` session state
+// SessStateContinue creates a `continue` session state
 func SessStateContinue() SessionState {
 	return sessionContinue
 }
 
-// SessStateBreak creates a `destroy` session state
+// SessStateDestroy creates a `destroy` session state
 func SessStateDestroy() SessionState {
 	return sessionDestroy
 }
 
 // SessState creates a specified session state
 func SessState(stateName string) SessionState {
-	return SessionState{"user:" + stateName}
+	return SessionState{sessionStateUserPrefix + stateName}
 }
 
 func (s SessionState) String() string {
 	return s.state
 }
 
-// sessionInit initiates session
-func sessionInit(uc UpdateChain, redisHost string) (*Session, error) {
+// Name gets the state name specified in `SessState()`.
+// Empty string will be returned for special states
+func (s SessionState) Name() string {
+	if strings.HasPrefix(s.state, sessionStateUserPrefix) == false {
+		return ""
+	}
+	return strings.TrimPrefix(s.state, sessionStateUserPrefix)
+}
 
-	var err error
+// sessionInit initiates session
+func sessionInit(ctx context.Context, t *Telegram, uc UpdateChain) (*Session, error) {
 
 	// Skip processing zero-len update chain
 	if len(uc.updates) == 0 {
 		return nil, ErrUpdateChainZeroLen
 	}
 
-	s := new(Session)
+	// Get chat and user IDs from first update from chain
+	chatID, userID := updateIDsGet(uc.updates[0])
 
-	s.updateChain = &uc
+	s, err := sessionNew(ctx, t, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get chat and user IDs from first update from chain
-	s.chatID, s.userID = updateIDsGet(s.updateChain.updates[0])
+	s.updateChain = &uc
 
 	// Get user name from first update from chain
 	s.userName = updateUserNameGet(s.updateChain.updates[0])
 	s.userFirstName = updateFirstNameGet(s.updateChain.updates[0])
 	s.userLastName = updateLastNameGet(s.updateChain.updates[0])
+	s.userLang = updateLanguageGet(s.updateChain.updates[0])
+
+	return s, nil
+}
+
+// sessionNew creates session for specified chat and user with empty update chain
+func sessionNew(ctx context.Context, t *Telegram, chatID, userID int64) (*Session, error) {
+
+	var err error
 
-	s.redis, err = redisConnect(redisHost)
+	s := new(Session)
+
+	s.chatID = chatID
+	s.userID = userID
+	s.updateChain = &UpdateChain{}
+
+	s.scope = t.sessionScope
+	s.localizer = t.localizer
+	s.key = sessionKeyGen(s.scope, s.chatID, s.userID)
+
+	s.ctx = ctx
+
+	s.redis, err = t.redisGet(ctx)
 	if err != nil {
 		return nil, err
 	}
+	s.redis.sessTTL = t.sessionTTL
 
 	return s, nil
 }
@@ -123,39 +220,96 @@ func (s *Session) UserLastNameGet() string {
 	return s.userLastName
 }
 
+// UserLanguageGet gets current session user language code (IETF language tag,
+// e.g. "en" or "pt-br"). It's empty if session was not triggered by user
+// (e.g. with `SessionStart()`) or Telegram did not send it
+func (s *Session) UserLanguageGet() string {
+	return s.userLang
+}
+
 // UpdateChain gets update chain from session
 func (s *Session) UpdateChain() *UpdateChain {
 	return s.updateChain
 }
 
-// SlotSave saves data into specified slot
-func (s *Session) SlotSave(slot string, data interface{}) error {
+// Context gets session context. If `HandlerTimeout` is set, within handlers
+// context has the deadline and is done when handler timeout is exceeded,
+// so long operations (e.g. requests to third-party APIs) should watch it
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
 
-	var buf bytes.Buffer
+// MembersGet gets users who have interacted with the session.
+// Members are tracked only for sessions with `ScopeChat` scope, e.g. to
+// send each participant of a group flow a private message
+// (with `t.SendMessage(m.UserID, 0, ...)`)
+func (s *Session) MembersGet() ([]Member, error) {
+
+	var members []Member
 
-	d, e, err := s.redis.sessGet(s.chatID, s.userID)
+	d, e, err := s.redis.sessGet(s.ctx, s.key)
 	if err != nil {
-		return err
+		return members, err
 	}
 
 	if e == false {
-		return ErrSessionNotExist
+		return members, ErrSessionNotExist
+	}
+
+	for _, m := range d.Members {
+		members = append(members, m)
 	}
 
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].UserID < members[j].UserID
+	})
+
+	return members, nil
+}
+
+// Touch extends the session lifetime (see `SessionTTL` setting) without
+// changing its state or slots. Useful for states that only read session data
+func (s *Session) Touch() error {
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return ErrSessionNotExist
+		}
+
+		return nil
+	})
+}
+
+// SlotSave saves data into specified slot
+func (s *Session) SlotSave(slot string, v interface{}) error {
+
+	var buf bytes.Buffer
+
 	// Encode data to bytes
-	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
 		return err
 	}
 
-	d.Slots[slot] = buf.Bytes()
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return ErrSessionNotExist
+		}
+
+		if d.Slots == nil {
+			d.Slots = make(map[string][]byte)
+		}
+
+		d.Slots[slot] = buf.Bytes()
 
-	return s.redis.sessSave(s.chatID, s.userID, d)
+		return nil
+	})
 }
 
 // SlotGet gets data from specified slot
 func (s *Session) SlotGet(slot string, data interface{}) (bool, error) {
 
-	d, e, err := s.redis.sessGet(s.chatID, s.userID)
+	d, e, err := s.redis.sessGet(s.ctx, s.key)
 	if err != nil {
 		return false, err
 	}
@@ -176,10 +330,181 @@ func (s *Session) SlotGet(slot string, data interface{}) (bool, error) {
 	return true, nil
 }
 
+// SlotSaveMany saves data into several slots at once (with a single
+// session read and write). Map key it's a slot name
+func (s *Session) SlotSaveMany(slots map[string]interface{}) error {
+
+	enc := make(map[string][]byte)
+
+	// Encode data to bytes
+	for slot, v := range slots {
+
+		var buf bytes.Buffer
+
+		if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+			return err
+		}
+
+		enc[slot] = buf.Bytes()
+	}
+
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return ErrSessionNotExist
+		}
+
+		if d.Slots == nil {
+			d.Slots = make(map[string][]byte)
+		}
+
+		for slot, b := range enc {
+			d.Slots[slot] = b
+		}
+
+		return nil
+	})
+}
+
+// SlotGetMany gets data from several slots at once (with a single session
+// read). Map key it's a slot name, value it's a pointer to decode data to.
+// Returns whether or not each slot was found
+func (s *Session) SlotGetMany(slots map[string]interface{}) (map[string]bool, error) {
+
+	found := make(map[string]bool)
+
+	d, e, err := s.redis.sessGet(s.ctx, s.key)
+	if err != nil {
+		return found, err
+	}
+
+	if e == false {
+		return found, ErrSessionNotExist
+	}
+
+	for slot, v := range slots {
+
+		ds, b := d.Slots[slot]
+		if b == false {
+			found[slot] = false
+			continue
+		}
+
+		if err := gob.NewDecoder(bytes.NewBuffer(ds)).Decode(v); err != nil {
+			return found, err
+		}
+
+		found[slot] = true
+	}
+
+	return found, nil
+}
+
+// SlotExists checks whether specified slot exists (without data decoding)
+func (s *Session) SlotExists(slot string) (bool, error) {
+
+	d, e, err := s.redis.sessGet(s.ctx, s.key)
+	if err != nil {
+		return false, err
+	}
+
+	if e == false {
+		return false, ErrSessionNotExist
+	}
+
+	_, b := d.Slots[slot]
+
+	return b, nil
+}
+
 // SlotDel deletes spcified slot
 func (s *Session) SlotDel(slot string) error {
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return ErrSessionNotExist
+		}
+
+		delete(d.Slots, slot)
+
+		return nil
+	})
+}
+
+// SlotsClear deletes all session slots keeping the session state,
+// e.g. to "start over" within a wizard
+func (s *Session) SlotsClear() error {
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return ErrSessionNotExist
+		}
+
+		d.Slots = make(map[string][]byte)
+
+		return nil
+	})
+}
+
+// StateSlotSave saves data into specified slot namespaced by current session
+// state, so the same slot names used in different states do not collide
+func (s *Session) StateSlotSave(slot string, v interface{}) error {
+
+	ss, err := s.stateSlotGen(slot)
+	if err != nil {
+		return err
+	}
+
+	return s.SlotSave(ss, v)
+}
+
+// StateSlotGet gets data from specified slot namespaced by current session state
+func (s *Session) StateSlotGet(slot string, data interface{}) (bool, error) {
+
+	ss, err := s.stateSlotGen(slot)
+	if err != nil {
+		return false, err
+	}
 
-	d, e, err := s.redis.sessGet(s.chatID, s.userID)
+	return s.SlotGet(ss, data)
+}
+
+// StateSlotDel deletes specified slot namespaced by current session state
+func (s *Session) StateSlotDel(slot string) error {
+
+	ss, err := s.stateSlotGen(slot)
+	if err != nil {
+		return err
+	}
+
+	return s.SlotDel(ss)
+}
+
+// stateSlotGen generates slot name namespaced by current session state
+func (s *Session) stateSlotGen(slot string) (string, error) {
+
+	cs, e, err := s.StateGet()
+	if err != nil {
+		return "", err
+	}
+
+	if e == false {
+		return "", ErrSessionNotExist
+	}
+
+	return stateSlotPrefix + cs.Name() + ":" + slot, nil
+}
+
+// Rerender re-invokes the StateHandler of current session state without
+// changing the state. If session processes a callback and state handler
+// sticks message, the message button was pressed in will be updated.
+// Useful for "refresh" buttons. Call it within the CallbackHandler and
+// return a `SessStateBreak()` as a next state
+func (s *Session) Rerender(t *Telegram) error {
+
+	var mID int
+
+	cs, e, err := s.StateGet()
 	if err != nil {
 		return err
 	}
@@ -188,9 +513,11 @@ func (s *Session) SlotDel(slot string) error {
 		return ErrSessionNotExist
 	}
 
-	delete(d.Slots, slot)
+	if s.UpdateChain().TypeGet() == UpdateTypeCallback {
+		mID = s.UpdateChain().MessagesIDGet()
+	}
 
-	return s.redis.sessSave(s.chatID, s.userID, d)
+	return s.stateSwitch(t, cs, mID)
 }
 
 // stateProcessing processes current session state.
@@ -198,6 +525,11 @@ func (s *Session) SlotDel(slot string) error {
 // in accordance with update chain
 func (s *Session) stateProcessing(t *Telegram) error {
 
+	// Remember the user interacted with existing session
+	if err := s.memberTrack(); err != nil {
+		return err
+	}
+
 	// Check `update` is a defined command
 	b, err := s.stateCommandProcessing(t)
 	if b == true {
@@ -210,6 +542,10 @@ func (s *Session) stateProcessing(t *Telegram) error {
 		return s.stateMessageProcessing(t)
 	case UpdateTypeCallback:
 		return s.stateCallbackProcessing(t)
+	case UpdateTypePreCheckout:
+		return s.statePaymentProcessing(t, HandlerSourcePreCheckout)
+	case UpdateTypeShipping:
+		return s.statePaymentProcessing(t, HandlerSourceShipping)
 	}
 
 	return nil
@@ -234,14 +570,19 @@ func (s *Session) stateInitProcessing(t *Telegram) error {
 	}
 
 	// Call initHandler
-	r, err := t.description.InitHandler(t, s)
+	var r InitHandlerRes
+	err = t.handlerCall(s, HandlerSourceInit, sessionBreak, func(s *Session) error {
+		var err error
+		r, err = t.description.InitHandler(t, s)
+		return err
+	})
 	if err != nil {
 
 		if t.description.ErrorHandler == nil {
 			return err
 		}
 
-		r, err := t.description.ErrorHandler(t, s, err)
+		r, err := t.errorHandlerCall(s, err)
 		if err != nil {
 			return err
 		}
@@ -260,17 +601,22 @@ func (s *Session) stateCommandProcessing(t *Telegram) (bool, error) {
 	var ns SessionState
 
 	// Check update contains command
-	cmd, args := s.UpdateChain().commandCheck()
+	cmd, args := s.UpdateChain().commandCheck(t.bot.Self.UserName)
 	if len(cmd) == 0 {
 		return false, nil
 	}
 
 	// Check specified command defined in bot description
-	c := t.description.commandLookup(cmd)
+	c := t.description.commandLookup(cmd, t.commandsCaseInsensitive)
 	if c == nil {
 		return false, nil
 	}
 
+	// Check user and chat are allowed to execute the command
+	if c.allowed(s.chatID, s.userID) == false {
+		return true, s.commandDenied(t, cmd)
+	}
+
 	// Call PrimeHandler if specified
 	phs, err := primeProcessing(t, s, HandlerSourceCommand)
 	if err != nil {
@@ -285,14 +631,19 @@ func (s *Session) stateCommandProcessing(t *Telegram) (bool, error) {
 		return true, nil
 	}
 
-	r, err := c.Handler(t, s, cmd, args)
+	var r CommandHandlerRes
+	err = t.handlerCall(s, HandlerSourceCommand, sessionBreak, func(s *Session) error {
+		var err error
+		r, err = c.Handler(t, s, cmd, args)
+		return err
+	})
 	if err != nil {
 
 		if t.description.ErrorHandler == nil {
 			return true, err
 		}
 
-		r, err := t.description.ErrorHandler(t, s, err)
+		r, err := t.errorHandlerCall(s, err)
 		if err != nil {
 			return true, err
 		}
@@ -305,6 +656,43 @@ func (s *Session) stateCommandProcessing(t *Telegram) (bool, error) {
 	return true, s.stateSwitch(t, ns, 0)
 }
 
+// commandDenied processes command user or chat is not allowed to execute
+func (s *Session) commandDenied(t *Telegram, cmd string) error {
+
+	var ns SessionState
+
+	if t.description.CommandDeniedHandler == nil {
+		_, err := t.SendMessage(s.chatID, 0, SendMessageData{
+			Message: commandDeniedMessage,
+		})
+		return err
+	}
+
+	var r CommandHandlerRes
+	err := t.handlerCall(s, HandlerSourceCommand, sessionBreak, func(s *Session) error {
+		var err error
+		r, err = t.description.CommandDeniedHandler(t, s, cmd)
+		return err
+	})
+	if err != nil {
+
+		if t.description.ErrorHandler == nil {
+			return err
+		}
+
+		r, err := t.errorHandlerCall(s, err)
+		if err != nil {
+			return err
+		}
+
+		ns = r.NextState
+	} else {
+		ns = r.NextState
+	}
+
+	return s.stateSwitch(t, ns, 0)
+}
+
 // stateMessageProcessing processes update chain with `message` type
 func (s *Session) stateMessageProcessing(t *Telegram) error {
 
@@ -318,6 +706,14 @@ func (s *Session) stateMessageProcessing(t *Telegram) error {
 
 	// If session does not exist
 	if e == false {
+
+		// Skip idle chatter in group chats if bot not addressed
+		if t.groupSessionsExplicit == true &&
+			s.UpdateChain().chatPrivate() == false &&
+			s.UpdateChain().BotMentioned(t.bot.Self.UserName) == false {
+			return nil
+		}
+
 		return s.stateInitProcessing(t)
 	}
 
@@ -337,17 +733,51 @@ func (s *Session) stateMessageProcessing(t *Telegram) error {
 	}
 
 	if state.MessageHandler == nil {
-		return nil
+		return s.stateDefaultProcessing(t, HandlerSourceMessage, cs, 0)
+	}
+
+	// Validate user input and re-prompt current state if input is wrong
+	if state.Validator != nil {
+		err := t.handlerCall(s, HandlerSourceValidator, cs, func(s *Session) error {
+			return state.Validator(t, s)
+		})
+		if err == ErrHandlerTimeout {
+
+			if t.description.ErrorHandler == nil {
+				return err
+			}
+
+			r, err := t.errorHandlerCall(s, err)
+			if err != nil {
+				return err
+			}
+
+			return s.stateSwitch(t, r.NextState, 0)
+		}
+		if err != nil {
+			if _, err := t.SendMessage(s.ChatIDGet(), 0, SendMessageData{
+				Message:   html.EscapeString(err.Error()),
+				ParseMode: ParseModeHTML,
+			}); err != nil {
+				return err
+			}
+			return s.stateSwitch(t, cs, 0)
+		}
 	}
 
-	r, err := state.MessageHandler(t, s)
+	var r MessageHandlerRes
+	err = t.handlerCall(s, HandlerSourceMessage, cs, func(s *Session) error {
+		var err error
+		r, err = state.MessageHandler(t, s)
+		return err
+	})
 	if err != nil {
 
 		if t.description.ErrorHandler == nil {
 			return err
 		}
 
-		r, err := t.description.ErrorHandler(t, s, err)
+		r, err := t.errorHandlerCall(s, err)
 		if err != nil {
 			return err
 		}
@@ -365,6 +795,24 @@ func (s *Session) stateCallbackProcessing(t *Telegram) error {
 
 	var ns SessionState
 
+	cbs, identifier, cbErr := s.UpdateChain().callbackSessionStateGet()
+	if cbErr != nil && cbErr != errCallbackDataStale {
+		return cbErr
+	}
+
+	// Button with state can not be resolved (e.g. created by previous bot
+	// version) is pressed within not existing session (e.g. expired one),
+	// so initiate a new session the same way as for messages
+	if t.description.InitHandler != nil && callbackStateResolved(t, cbs, cbErr) == false {
+		_, e, err := s.StateGet()
+		if err != nil {
+			return err
+		}
+		if e == false {
+			return s.stateInitProcessing(t)
+		}
+	}
+
 	// Call PrimeHandler if specified
 	phs, err := primeProcessing(t, s, HandlerSourceCallback)
 	if err != nil {
@@ -374,9 +822,16 @@ func (s *Session) stateCallbackProcessing(t *Telegram) error {
 		return s.stateSwitch(t, phs, 0)
 	}
 
-	cbs, identifier, err := s.UpdateChain().callbackSessionStateGet()
-	if err != nil {
-		return err
+	if cbErr != nil {
+
+		// Buttons created by previous bot version are processed
+		// by DefaultHandler within the current session state
+		cs, _, err := s.StateGet()
+		if err != nil {
+			return err
+		}
+
+		return s.stateDefaultProcessing(t, HandlerSourceCallback, cs, s.UpdateChain().MessagesIDGet())
 	}
 
 	// Check the button contains special states
@@ -390,11 +845,23 @@ func (s *Session) stateCallbackProcessing(t *Telegram) error {
 	// Get state description
 	state, b := t.description.States[cbs]
 	if b == false {
-		return ErrDescriptionStateMissing
+
+		// Button may belong to state removed in the new bot version,
+		// so give ErrorHandler a chance to recover the session
+		if t.description.ErrorHandler == nil {
+			return ErrDescriptionStateMissing
+		}
+
+		r, err := t.errorHandlerCall(s, ErrDescriptionStateMissing)
+		if err != nil {
+			return err
+		}
+
+		return s.stateSwitch(t, r.NextState, s.UpdateChain().MessagesIDGet())
 	}
 
 	if state.CallbackHandler == nil {
-		return nil
+		return s.stateDefaultProcessing(t, HandlerSourceCallback, cbs, s.UpdateChain().MessagesIDGet())
 	}
 
 	// Init session if it not exist
@@ -403,19 +870,24 @@ func (s *Session) stateCallbackProcessing(t *Telegram) error {
 		return err
 	}
 	if b == false {
-		if err := s.stateSet(cbs); err != nil {
+		if err := s.StateSet(cbs); err != nil {
 			return err
 		}
 	}
 
-	r, err := state.CallbackHandler(t, s, identifier)
+	var r CallbackHandlerRes
+	err = t.handlerCall(s, HandlerSourceCallback, cbs, func(s *Session) error {
+		var err error
+		r, err = state.CallbackHandler(t, s, identifier)
+		return err
+	})
 	if err != nil {
 
 		if t.description.ErrorHandler == nil {
 			return err
 		}
 
-		r, err := t.description.ErrorHandler(t, s, err)
+		r, err := t.errorHandlerCall(s, err)
 		if err != nil {
 			return err
 		}
@@ -423,11 +895,68 @@ func (s *Session) stateCallbackProcessing(t *Telegram) error {
 		ns = r.NextState
 	} else {
 		ns = r.NextState
+		s.editOriginal = r.EditOriginal
 	}
 
 	return s.stateSwitch(t, ns, s.UpdateChain().MessagesIDGet())
 }
 
+// callbackStateResolved checks whether the state from pressed button
+// callback data can be processed by bot
+func callbackStateResolved(t *Telegram, cbs SessionState, cbErr error) bool {
+
+	if cbErr != nil {
+		return false
+	}
+
+	switch cbs {
+	case
+		sessionBreak,
+		sessionDestroy:
+		return true
+	}
+
+	_, b := t.description.States[cbs]
+
+	return b
+}
+
+// stateDefaultProcessing processes update chain has no appropriate handler in current state
+func (s *Session) stateDefaultProcessing(t *Telegram, hs HandlerSource, cs SessionState, messageID int) error {
+
+	var (
+		ns SessionState
+		r  DefaultHandlerRes
+	)
+
+	if t.description.DefaultHandler == nil {
+		return nil
+	}
+
+	err := t.handlerCall(s, hs, cs, func(s *Session) error {
+		var err error
+		r, err = t.description.DefaultHandler(t, s)
+		return err
+	})
+	if err != nil {
+
+		if t.description.ErrorHandler == nil {
+			return err
+		}
+
+		r, err := t.errorHandlerCall(s, err)
+		if err != nil {
+			return err
+		}
+
+		ns = r.NextState
+	} else {
+		ns = r.NextState
+	}
+
+	return s.stateSwitch(t, ns, messageID)
+}
+
 func (s *Session) stateSwitch(t *Telegram, newState SessionState, messageID int) error {
 
 	var mID int
@@ -445,7 +974,7 @@ func (s *Session) stateSwitch(t *Telegram, newState SessionState, messageID int)
 	}
 
 	// Put session into new state
-	if err := s.stateSet(newState); err != nil {
+	if err := s.StateSet(newState); err != nil {
 		return err
 	}
 
@@ -454,14 +983,19 @@ func (s *Session) stateSwitch(t *Telegram, newState SessionState, messageID int)
 		return nil
 	}
 
-	hr, err := state.StateHandler(t, s)
+	var hr StateHandlerRes
+	err := t.handlerCall(s, HandlerSourceState, newState, func(s *Session) error {
+		var err error
+		hr, err = state.StateHandler(t, s)
+		return err
+	})
 	if err != nil {
 
 		if t.description.ErrorHandler == nil {
 			return err
 		}
 
-		r, err := t.description.ErrorHandler(t, s, err)
+		r, err := t.errorHandlerCall(s, err)
 		if err != nil {
 			return err
 		}
@@ -469,22 +1003,59 @@ func (s *Session) stateSwitch(t *Telegram, newState SessionState, messageID int)
 		return s.stateSwitch(t, r.NextState, 0)
 	}
 
-	if hr.StickMessage == true {
+	stick := hr.StickMessage
+	if s.editOriginal != nil {
+		// Override is applied to the first state only
+		stick = *s.editOriginal
+		s.editOriginal = nil
+	}
+
+	if stick == true {
 		mID = messageID
 	}
 
-	// Send message to user if set
-	if len(hr.Message) > 0 {
+	var md []SendMessageData
 
-		msgs, err := t.SendMessage(s.ChatIDGet(), mID, SendMessageData{
+	if len(hr.Message) > 0 || len(hr.Template) > 0 {
+		md = append(md, SendMessageData{
 			Message:               hr.Message,
+			Template:              hr.Template,
+			Vars:                  hr.Vars,
 			ParseMode:             hr.ParseMode,
 			DisableWebPagePreview: hr.DisableWebPagePreview,
 			Buttons:               hr.Buttons,
-			ButtonState:           newState,
 		})
-		if err != nil {
-			return err
+	}
+	md = append(md, hr.Messages...)
+
+	// Send messages to user if set
+	if len(md) > 0 {
+
+		var msgs []MessageSent
+
+		for i, m := range md {
+
+			var id int
+
+			// Only the first message can update the stuck one
+			if i == 0 {
+				id = mID
+			}
+
+			m.ButtonState = newState
+			if len(m.Lang) == 0 {
+				m.Lang = s.UserLanguageGet()
+			}
+
+			ms, err := t.SendMessage(s.ChatIDGet(), id, m)
+			if err != nil {
+				if t.destroyBlocked == true && IsBlockedError(err) == true {
+					return s.destroy(t)
+				}
+				return err
+			}
+
+			msgs = append(msgs, ms...)
 		}
 
 		if state.SentHandler != nil {
@@ -499,25 +1070,82 @@ func (s *Session) stateSwitch(t *Telegram, newState SessionState, messageID int)
 		return nil
 	}
 
-	return s.stateSwitch(t, hr.NextState, mID)
+	// Message with pressed button can be updated only once within the
+	// transition, i.e. by the first state which sends messages
+	if len(md) > 0 {
+		messageID = 0
+	}
+
+	return s.stateSwitch(t, hr.NextState, messageID)
+}
+
+// Destroy destroys current session the same way as if `SessStateDestroy()`
+// was returned by handler (i.e. calls DestroyHandler and drops pending updates).
+// Useful for cleanup from outside the handlers, e.g. for blocked users
+func (s *Session) Destroy(t *Telegram) error {
+
+	// Session detached from timed out handler
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.destroy(t)
 }
 
 // destroy destroys current session
 func (s *Session) destroy(t *Telegram) error {
 
 	if t.description.DestroyHandler != nil {
-		if err := t.description.DestroyHandler(t, s); err != nil {
-			return err
+		err := t.handlerCall(s, HandlerSourceDestroy, sessionDestroy, func(s *Session) error {
+			return t.description.DestroyHandler(t, s)
+		})
+		if err != nil {
+
+			if t.description.ErrorHandler == nil {
+				return err
+			}
+
+			r, err := t.errorHandlerCall(s, err)
+			if err != nil {
+				return err
+			}
+
+			if r.NextState != sessionDestroy {
+				return s.stateSwitch(t, r.NextState, 0)
+			}
 		}
 	}
 
-	return s.redis.sessDel(s.chatID, s.userID)
+	if err := s.redis.sessDel(s.ctx, s.key); err != nil {
+		return err
+	}
+
+	// Drop updates pending in queue
+	if _, err := s.redis.queueMetaDel(s.ctx, s.chatID, s.userID); err != nil {
+		return err
+	}
+
+	return s.redis.queueUpdateDel(s.ctx, s.chatID, s.userID)
+}
+
+// StateSwitch switches session into state `state` and processes it the
+// same way as if it was returned by handler (i.e. calls StateHandler,
+// sends message, etc). Useful for out-of-band logic, e.g. moving user
+// forward after a payment provider notification
+func (s *Session) StateSwitch(t *Telegram, state SessionState) error {
+
+	// Session detached from timed out handler
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.stateSwitch(t, state, 0)
 }
 
-// stateGet gets current session state
+// StateGet gets current session state
 func (s *Session) StateGet() (SessionState, bool, error) {
 
-	d, e, err := s.redis.sessGet(s.chatID, s.userID)
+	d, e, err := s.redis.sessGet(s.ctx, s.key)
 	if err != nil {
 		return sessionBreak, false, err
 	}
@@ -525,25 +1153,137 @@ func (s *Session) StateGet() (SessionState, bool, error) {
 	return SessionState{d.State}, e, nil
 }
 
-// stateSet sets session into state `state`.
-// Starts new session if not exist
-func (s *Session) stateSet(state SessionState) error {
+// StateSet sets session into state `state` without calling any handlers.
+// Starts new session if not exist. To switch the state the same way as
+// handlers do (i.e. with StateHandler call and message sending) use `StateSwitch()`
+func (s *Session) StateSet(state SessionState) error {
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
 
-	d, e, err := s.redis.sessGet(s.chatID, s.userID)
-	if err != nil {
-		return err
+		if e == false {
+			*d = data{
+				State: state.state,
+				Slots: make(map[string][]byte),
+			}
+		} else {
+			d.State = state.state
+		}
+
+		s.memberSet(d)
+
+		return nil
+	})
+}
+
+// memberTrack adds current user into existing session members
+func (s *Session) memberTrack() error {
+
+	if s.scope != ScopeChat {
+		return nil
 	}
 
-	if e == false {
-		d = data{
-			State: state.state,
-			Slots: make(map[string][]byte),
+	return s.redis.sessUpdate(s.ctx, s.key, func(d *data, e bool) error {
+
+		if e == false {
+			return errSessUpdateSkip
+		}
+
+		if _, b := d.Members[strconv.FormatInt(s.userID, 10)]; b == true {
+			return errSessUpdateSkip
+		}
+
+		s.memberSet(d)
+
+		return nil
+	})
+}
+
+// memberSet sets current user into session members
+func (s *Session) memberSet(d *data) {
+
+	if s.scope != ScopeChat || s.userID == 0 {
+		return
+	}
+
+	if d.Members == nil {
+		d.Members = make(map[string]Member)
+	}
+
+	d.Members[strconv.FormatInt(s.userID, 10)] = Member{
+		UserID:    s.userID,
+		UserName:  s.userName,
+		FirstName: s.userFirstName,
+		LastName:  s.userLastName,
+	}
+}
+
+// sessionKeyGen generates a session key in accordance with specified scope
+func sessionKeyGen(scope SessionScope, chatID, userID int64) string {
+
+	if scope == ScopeChat {
+		return strconv.FormatInt(chatID, 10)
+	}
+
+	return strconv.FormatInt(chatID, 10) + ":" + strconv.FormatInt(userID, 10)
+}
+
+// handlerCall calls handler wrapped into `f` with session `s` and observes
+// its execution. If handler timeout is set, handler gets a copy of the session
+// with context (see `Session.Context()`) having the deadline. If handler has
+// not been completed in time `ErrHandlerTimeout` will be returned. Note that
+// handler is not interrupted and keeps running in background, its results
+// will be dropped and its session is detached, i.e. Redis operations and
+// state switches made by handler after timeout will fail
+func (t *Telegram) handlerCall(s *Session, hs HandlerSource, state SessionState, f func(s *Session) error) error {
+
+	var err error
+
+	start := time.Now()
+
+	if t.handlerTimeout > 0 {
+
+		ctx, cancel := context.WithTimeout(s.ctx, t.handlerTimeout)
+		defer cancel()
+
+		// Handler works with own copy of the session to
+		// be detached from the session on timeout
+		sess := *s
+		sess.ctx = ctx
+
+		ch := make(chan error, 1)
+		go func() {
+			ch <- f(&sess)
+		}()
+
+		select {
+		case err = <-ch:
+		case <-ctx.Done():
+			err = ErrHandlerTimeout
 		}
 	} else {
-		d.State = state.state
+		err = f(s)
 	}
 
-	return s.redis.sessSave(s.chatID, s.userID, d)
+	t.metrics.ObserveHandler(hs, state.Name(), time.Since(start), err)
+
+	return err
+}
+
+// errorHandlerCall calls ErrorHandler for error `e`.
+// ErrorHandler must be defined
+func (t *Telegram) errorHandlerCall(s *Session, e error) (ErrorHandlerRes, error) {
+
+	var r ErrorHandlerRes
+
+	err := t.handlerCall(s, HandlerSourceError, sessionBreak, func(s *Session) error {
+		var err error
+		r, err = t.description.ErrorHandler(t, s, e)
+		return err
+	})
+	if err != nil {
+		return ErrorHandlerRes{}, err
+	}
+
+	return r, nil
 }
 
 // primeProcessing processes PrimeHandler if set
@@ -555,7 +1295,12 @@ func primeProcessing(t *Telegram, s *Session, hs HandlerSource) (SessionState, e
 	}
 
 	// Call PrimeHandler
-	phr, err := t.description.PrimeHandler(t, s, hs)
+	var phr PrimeHandlerRes
+	err := t.handlerCall(s, HandlerSourcePrime, sessionBreak, func(s *Session) error {
+		var err error
+		phr, err = t.description.PrimeHandler(t, s, hs)
+		return err
+	})
 	if err == nil {
 		return phr.NextState, nil
 	}
@@ -566,7 +1311,7 @@ func primeProcessing(t *Telegram, s *Session, hs HandlerSource) (SessionState, e
 	}
 
 	// Call ErrorHandler
-	ehr, err := t.description.ErrorHandler(t, s, err)
+	ehr, err := t.errorHandlerCall(s, err)
 	if err != nil {
 		return sessionBreak, err
 	}
@@ -0,0 +1,1245 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	rds "github.com/redis/go-redis/v9"
+)
+
+func TestCallbackAfterSessionGone(t *testing.T) {
+
+	var inits, callbacks int
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			inits++
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					callbacks++
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	// Session does not exist, but button of known
+	// state is processed by its handler
+	if err := bot.ProcessUpdate(testCallback(t, 1, 42, 10, SessState("menu"), "x")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if inits != 0 || callbacks != 1 {
+		t.Fatalf("wrong handlers calls: init %d, callback %d", inits, callbacks)
+	}
+
+	// Button of unknown state initiates a new session
+	if err := bot.ProcessUpdate(testCallback(t, 2, 43, 10, SessState("removed"), "x")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if inits != 1 || callbacks != 1 {
+		t.Fatalf("wrong handlers calls: init %d, callback %d", inits, callbacks)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+
+	var handlerErr error
+
+	late := make(chan error, 1)
+
+	bot := testBotInit(t, nil, Settings{HandlerTimeout: 50 * time.Millisecond}, Description{
+		ErrorHandler: func(t *Telegram, s *Session, e error) (ErrorHandlerRes, error) {
+			handlerErr = e
+			return ErrorHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("input"): {
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+
+					time.Sleep(200 * time.Millisecond)
+
+					// Session must be detached after timeout
+					if s.Context().Err() == nil {
+						late <- errors.New("session context is not done")
+						return MessageHandlerRes{}, nil
+					}
+					late <- s.SlotSave("late", "value")
+
+					return MessageHandlerRes{NextState: SessState("input")}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(1, 1, SessState("input")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	start := time.Now()
+	if err := bot.ProcessUpdate(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if d := time.Since(start); d >= 200*time.Millisecond {
+		t.Fatalf("processing has not been interrupted by timeout: %v", d)
+	}
+
+	if handlerErr != ErrHandlerTimeout {
+		t.Fatalf("wrong error passed to ErrorHandler: %v", handlerErr)
+	}
+
+	if err := <-late; err == nil {
+		t.Fatal("late slot save of timed out handler must fail")
+	}
+}
+
+func TestHandlerTimeoutPrime(t *testing.T) {
+
+	var handlerErr error
+
+	bot := testBotInit(t, nil, Settings{HandlerTimeout: 50 * time.Millisecond}, Description{
+		PrimeHandler: func(t *Telegram, s *Session, hs HandlerSource) (PrimeHandlerRes, error) {
+			time.Sleep(200 * time.Millisecond)
+			return PrimeHandlerRes{NextState: SessStateContinue()}, nil
+		},
+		ErrorHandler: func(t *Telegram, s *Session, e error) (ErrorHandlerRes, error) {
+			handlerErr = e
+			return ErrorHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	})
+
+	if err := bot.ProcessUpdate(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if handlerErr != ErrHandlerTimeout {
+		t.Fatalf("wrong error passed to ErrorHandler: %v", handlerErr)
+	}
+}
+
+func TestSessionConcurrentSlotSave(t *testing.T) {
+
+	const (
+		workers = 10
+		saves   = 5
+	)
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if err := bot.SessionStateSet(1, 1, SessState("a")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		saved []string
+	)
+
+	errs := make(chan error, workers*saves)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			// Each worker processes own update for the same session
+			s, err := sessionNew(context.Background(), bot, 1, 1)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer s.close()
+
+			for i := 0; i < saves; i++ {
+
+				slot := fmt.Sprintf("slot-%d-%d", w, i)
+
+				// Conflict may be reported after bounded number of retries,
+				// but write must never be lost silently
+				if err := s.SlotSave(slot, slot); err != nil {
+					if err != ErrSessionConflict {
+						errs <- err
+					}
+					continue
+				}
+
+				mu.Lock()
+				saved = append(saved, slot)
+				mu.Unlock()
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("slot save error: %v", err)
+	}
+
+	if len(saved) == 0 {
+		t.Fatal("no one slot has been saved")
+	}
+
+	s := testSessionNew(t, bot, 1)
+
+	for _, slot := range saved {
+		var v string
+		b, err := s.SlotGet(slot, &v)
+		if err != nil {
+			t.Fatalf("slot get error: %v", err)
+		}
+		if b == false || v != slot {
+			t.Fatalf("slot %s has been lost", slot)
+		}
+	}
+
+	st, _, err := s.StateGet()
+	if err != nil {
+		t.Fatalf("session state get error: %v", err)
+	}
+	if st != SessState("a") {
+		t.Fatalf("session state has been clobbered: %s", st)
+	}
+}
+
+func TestSessionScopeChat(t *testing.T) {
+
+	for _, c := range []struct {
+		scope    SessionScope
+		inits    int
+		messages int
+	}{
+		{ScopeChat, 1, 1},
+		{ScopeUser, 2, 0},
+	} {
+
+		var inits, messages int
+
+		bot := testBotInit(t, nil, Settings{SessionScope: c.scope}, Description{
+			InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+				inits++
+				return InitHandlerRes{NextState: SessState("wait")}, nil
+			},
+			States: map[SessionState]State{
+				SessState("wait"): {
+					MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+						messages++
+						return MessageHandlerRes{NextState: SessStateBreak()}, nil
+					},
+				},
+			},
+		})
+
+		if err := bot.ProcessUpdate(testGroupMessage(1, -100, 1, "first")); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+		if err := bot.ProcessUpdate(testGroupMessage(2, -100, 2, "second")); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+
+		if inits != c.inits || messages != c.messages {
+			t.Fatalf("scope %d: wrong handlers calls: init %d, message %d", c.scope, inits, messages)
+		}
+	}
+}
+
+func TestSessionStart(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("notify"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message:   "Your order is ready",
+						NextState: SessState("wait"),
+					}, nil
+				},
+			},
+			SessState("wait"): {},
+		},
+	})
+
+	if err := bot.SessionStart(1, 1, SessState("notify")); err != nil {
+		t.Fatalf("session start error: %v", err)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 1 {
+		t.Fatalf("expected one sent message, got %d", len(r))
+	}
+	if r[0].Params["chat_id"] != "1" || r[0].Params["text"] != "Your order is ready" {
+		t.Fatalf("wrong sent message: %v", r[0].Params)
+	}
+
+	st, e, err := testSessionNew(t, bot, 1).StateGet()
+	if err != nil {
+		t.Fatalf("session state get error: %v", err)
+	}
+	if e == false || st != SessState("wait") {
+		t.Fatalf("wrong session state: exists %v, state %s", e, st)
+	}
+}
+
+func TestValidateStates(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"):  {},
+			SessState("order"): {},
+		},
+	})
+
+	if err := bot.ValidateStates(SessState("menu"), SessState("order"), SessStateBreak(), SessStateDestroy()); err != nil {
+		t.Fatalf("states validation error: %v", err)
+	}
+
+	// Dangling state reference
+	err := bot.ValidateStates(SessState("menu"), SessState("ordr"))
+	if errors.Is(err, ErrDescriptionStateMissing) == false {
+		t.Fatalf("dangling state must be reported, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "ordr") == false {
+		t.Fatalf("error must contain dangling state: %v", err)
+	}
+
+	if n := SessState("menu").Name(); n != "menu" {
+		t.Fatalf("wrong state name: %s", n)
+	}
+}
+
+func TestValidateStatesWrong(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState(""): {},
+		},
+	})
+
+	if err := bot.ValidateStates(); errors.Is(err, ErrDescriptionStateWrong) == false {
+		t.Fatalf("state with empty name must be reported, got: %v", err)
+	}
+}
+
+func TestDefaultHandler(t *testing.T) {
+
+	var defaults int
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		DefaultHandler: func(t *Telegram, s *Session) (DefaultHandlerRes, error) {
+			defaults++
+			if _, err := t.SendMessage(s.ChatIDGet(), 0, SendMessageData{Message: "I didn't understand that"}); err != nil {
+				return DefaultHandlerRes{}, err
+			}
+			return DefaultHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	// Message within callback-only state
+	if err := bot.ProcessUpdate(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if defaults != 1 {
+		t.Fatalf("default handler called %d times, expected once", defaults)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 1 || r[0].Params["text"] != "I didn't understand that" {
+		t.Fatalf("wrong sent messages: %v", r)
+	}
+
+	// Callback is processed by its handler
+	if err := bot.ProcessUpdate(testCallback(t, 2, 1, 1, SessState("menu"), "x")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if defaults != 1 {
+		t.Fatalf("default handler called %d times, expected once", defaults)
+	}
+}
+
+func TestSessionUserNames(t *testing.T) {
+
+	var names []string
+
+	handler := func(s *Session) {
+		names = append(names, fmt.Sprintf("%s|%s|%s|%s", s.UserNameGet(), s.UserFirstNameGet(), s.UserLastNameGet(), s.UserLanguageGet()))
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			handler(s)
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					handler(s)
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	m := testMessage(1, 42, "hi")
+	m.Message.From.UserName = "jdoe"
+	m.Message.From.FirstName = "John"
+	m.Message.From.LastName = "Doe"
+	m.Message.From.LanguageCode = "en"
+
+	c := testCallback(t, 2, 43, 10, SessState("menu"), "x")
+	c.CallbackQuery.From.FirstName = "Ana"
+	c.CallbackQuery.From.LanguageCode = "pt-br"
+
+	for _, u := range []Update{m, c} {
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	if fmt.Sprint(names) != "[jdoe|John|Doe|en |Ana||pt-br]" {
+		t.Fatalf("wrong user names: %v", names)
+	}
+}
+
+func TestCallbackEditOriginal(t *testing.T) {
+
+	yes, no := true, false
+
+	stateHandler := func(stick bool) func(t *Telegram, s *Session) (StateHandlerRes, error) {
+		return func(t *Telegram, s *Session) (StateHandlerRes, error) {
+			return StateHandlerRes{
+				Message:      "done",
+				StickMessage: stick,
+				NextState:    SessStateBreak(),
+			}, nil
+		}
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					switch identifier {
+					case "edit":
+						return CallbackHandlerRes{NextState: SessState("plain"), EditOriginal: &yes}, nil
+					case "new":
+						return CallbackHandlerRes{NextState: SessState("sticky"), EditOriginal: &no}, nil
+					}
+					return CallbackHandlerRes{NextState: SessState("sticky")}, nil
+				},
+			},
+			SessState("plain"): {
+				StateHandler: stateHandler(false),
+			},
+			SessState("sticky"): {
+				StateHandler: stateHandler(true),
+			},
+		},
+	})
+
+	for i, c := range []struct {
+		identifier string
+		method     string
+	}{
+		{"new", "sendMessage"},
+		{"edit", "editMessageText"},
+		{"default", "editMessageText"},
+	} {
+
+		before := len(bot.SentRequests())
+
+		if err := bot.ProcessUpdate(testCallback(t, i+1, 42, 10, SessState("menu"), c.identifier)); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+
+		var sent []Recorded
+		for _, r := range bot.SentRequests()[before:] {
+			if r.Method != "answerCallbackQuery" {
+				sent = append(sent, r)
+			}
+		}
+
+		if len(sent) != 1 || sent[0].Method != c.method {
+			t.Fatalf("%s: expected %s, got %v", c.identifier, c.method, sent)
+		}
+
+		if c.method == "editMessageText" && sent[0].Params["message_id"] != "10" {
+			t.Fatalf("%s: expected message ID 10 to be edited, got `%s`", c.identifier, sent[0].Params["message_id"])
+		}
+	}
+}
+
+func TestStateMessages(t *testing.T) {
+
+	var (
+		handled []string
+		cb      string
+	)
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("multi")}, nil
+		},
+		SentHandler: func(t *Telegram, messages []MessageSent) {
+			for _, m := range messages {
+				handled = append(handled, m.Text)
+			}
+		},
+		States: map[SessionState]State{
+			SessState("multi"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message: "one",
+						Messages: []SendMessageData{
+							{Message: "two"},
+							{
+								Message: "three",
+								Buttons: [][]Button{{{Text: "OK", Identifier: "ok"}}},
+							},
+						},
+					}, nil
+				},
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					cb = identifier
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ProcessUpdate(testMessage(1, 42, "hi")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	var texts []string
+	for _, r := range testSent(bot, "sendMessage") {
+		texts = append(texts, r.Params["text"])
+	}
+
+	if fmt.Sprint(texts) != "[one two three]" {
+		t.Fatalf("wrong sent messages: %v", texts)
+	}
+	if fmt.Sprint(handled) != "[one two three]" {
+		t.Fatalf("wrong messages passed to sent handler: %v", handled)
+	}
+
+	// Buttons of the last message are handled by the state
+	var ikm tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(testSent(bot, "sendMessage")[2].Params["reply_markup"]), &ikm); err != nil {
+		t.Fatalf("reply markup unmarshal error: %v", err)
+	}
+
+	u := testCallback(t, 2, 42, 3, SessState("multi"), "")
+	u.CallbackQuery.Data = *ikm.InlineKeyboard[0][0].CallbackData
+
+	if err := bot.ProcessUpdate(u); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if cb != "ok" {
+		t.Fatalf("wrong callback identifier: `%s`", cb)
+	}
+}
+
+func TestButtonAnswer(t *testing.T) {
+
+	var callbacks, messages int
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					callbacks++
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					messages++
+					return MessageHandlerRes{NextState: SessState("menu")}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(42, 42, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	if _, err := bot.SendMessage(42, 0, SendMessageData{
+		Message: "Menu",
+		Buttons: [][]Button{
+			{
+				{
+					Text:  "Info",
+					Mode:  ButtonModeAnswer,
+					Toast: "Just info",
+					Alert: true,
+				},
+			},
+		},
+		ButtonState: SessState("menu"),
+	}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	u := testCallback(t, 1, 42, 10, SessState("menu"), "")
+	u.CallbackQuery.Data = testButtonData(t, bot)
+
+	if err := bot.ProcessUpdate(u); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	a := testSent(bot, "answerCallbackQuery")
+	if len(a) != 1 || a[0].Params["text"] != "Just info" || a[0].Params["show_alert"] != "true" {
+		t.Fatalf("wrong callback answer: %+v", a)
+	}
+
+	if callbacks != 0 {
+		t.Fatalf("callback handler must not be called for answer-only button")
+	}
+
+	// Session stays in the same state
+	if err := bot.ProcessUpdate(testMessage(2, 42, "hi")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if messages != 1 {
+		t.Fatalf("message must be processed in the same state, got %d messages", messages)
+	}
+}
+
+func TestSlotsClear(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	s := testSessionNew(t, bot, 1)
+
+	if err := s.StateSet(SessState("wizard")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+	for _, slot := range []string{"name", "age"} {
+		if err := s.SlotSave(slot, "value"); err != nil {
+			t.Fatalf("slot save error: %v", err)
+		}
+	}
+
+	if err := s.SlotsClear(); err != nil {
+		t.Fatalf("slots clear error: %v", err)
+	}
+
+	for _, slot := range []string{"name", "age"} {
+		var v string
+		b, err := s.SlotGet(slot, &v)
+		if err != nil {
+			t.Fatalf("slot get error: %v", err)
+		}
+		if b == true {
+			t.Fatalf("slot `%s` must be cleared, got `%s`", slot, v)
+		}
+	}
+
+	st, e, err := s.StateGet()
+	if err != nil {
+		t.Fatalf("state get error: %v", err)
+	}
+	if e == false || st != SessState("wizard") {
+		t.Fatalf("wrong session state after slots clear: %v (exists %t)", st, e)
+	}
+}
+
+func TestSessionStateSetSwitch(t *testing.T) {
+
+	var calls []string
+
+	state := func(name string) State {
+		return State{
+			StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+				calls = append(calls, name)
+				return StateHandlerRes{Message: name}, nil
+			},
+			MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+				return MessageHandlerRes{NextState: SessStateBreak()}, nil
+			},
+		}
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("a"): state("a"),
+			SessState("b"): state("b"),
+		},
+	})
+
+	s := testSessionNew(t, bot, 1)
+
+	stateCheck := func(expected SessionState) {
+
+		t.Helper()
+
+		st, e, err := s.StateGet()
+		if err != nil {
+			t.Fatalf("state get error: %v", err)
+		}
+		if e == false || st != expected {
+			t.Fatalf("wrong session state: expected %v, got %v (exists %t)", expected, st, e)
+		}
+	}
+
+	// Setting state does not call handlers
+	if err := s.StateSet(SessState("a")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+	stateCheck(SessState("a"))
+
+	if len(calls) != 0 || len(testSent(bot, "sendMessage")) != 0 {
+		t.Fatalf("handlers must not be called on state set: %v", calls)
+	}
+
+	// Switching state calls state handler and sends message
+	if err := s.StateSwitch(bot, SessState("b")); err != nil {
+		t.Fatalf("state switch error: %v", err)
+	}
+	stateCheck(SessState("b"))
+
+	sent := testSent(bot, "sendMessage")
+	if fmt.Sprint(calls) != "[b]" || len(sent) != 1 || sent[0].Params["text"] != "b" {
+		t.Fatalf("wrong state switch handlers calls: %v, sent %+v", calls, sent)
+	}
+}
+
+func TestSlotExists(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	s := testSessionNew(t, bot, 1)
+
+	if err := s.StateSet(SessState("a")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+	if err := s.SlotSave("present", 42); err != nil {
+		t.Fatalf("slot save error: %v", err)
+	}
+
+	for slot, expected := range map[string]bool{"present": true, "absent": false} {
+
+		b, err := s.SlotExists(slot)
+		if err != nil {
+			t.Fatalf("slot exists error: %v", err)
+		}
+		if b != expected {
+			t.Fatalf("slot `%s`: expected exists %t, got %t", slot, expected, b)
+		}
+	}
+}
+
+func TestStateSlots(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	s := testSessionNew(t, bot, 1)
+
+	for _, st := range []string{"a", "b"} {
+		if err := s.StateSet(SessState(st)); err != nil {
+			t.Fatalf("state set error: %v", err)
+		}
+		if err := s.StateSlotSave("input", "value "+st); err != nil {
+			t.Fatalf("state slot save error: %v", err)
+		}
+	}
+
+	for _, st := range []string{"a", "b"} {
+
+		if err := s.StateSet(SessState(st)); err != nil {
+			t.Fatalf("state set error: %v", err)
+		}
+
+		var v string
+
+		b, err := s.StateSlotGet("input", &v)
+		if err != nil {
+			t.Fatalf("state slot get error: %v", err)
+		}
+		if b == false || v != "value "+st {
+			t.Fatalf("wrong slot value in state `%s`: `%s` (found %t)", st, v, b)
+		}
+	}
+
+	// Plain slot with the same name is not affected
+	b, err := s.SlotExists("input")
+	if err != nil {
+		t.Fatalf("slot exists error: %v", err)
+	}
+	if b == true {
+		t.Fatalf("state slots must not collide with plain slots")
+	}
+}
+
+// testRedisWrites it is a Redis hook counting successful session writes
+type testRedisWrites struct {
+	n int32
+}
+
+func (h *testRedisWrites) DialHook(next rds.DialHook) rds.DialHook {
+	return next
+}
+
+func (h *testRedisWrites) ProcessHook(next rds.ProcessHook) rds.ProcessHook {
+	return func(ctx context.Context, cmd rds.Cmder) error {
+
+		err := next(ctx, cmd)
+
+		switch cmd.Name() {
+		case "eval", "evalsha":
+			if err == nil {
+				atomic.AddInt32(&h.n, 1)
+			}
+		}
+
+		return err
+	}
+}
+
+func (h *testRedisWrites) ProcessPipelineHook(next rds.ProcessPipelineHook) rds.ProcessPipelineHook {
+	return next
+}
+
+func TestSlotSaveMany(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	s := testSessionNew(t, bot, 1)
+
+	if err := s.StateSet(SessState("form")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+
+	h := &testRedisWrites{}
+	s.redis.client.AddHook(h)
+
+	if err := s.SlotSaveMany(map[string]interface{}{
+		"name": "John",
+		"age":  42,
+		"tags": []string{"a", "b"},
+	}); err != nil {
+		t.Fatalf("slots save error: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&h.n); n != 1 {
+		t.Fatalf("expected one session write, got %d", n)
+	}
+
+	var (
+		name string
+		age  int
+		tags []string
+		miss string
+	)
+
+	found, err := s.SlotGetMany(map[string]interface{}{
+		"name":    &name,
+		"age":     &age,
+		"tags":    &tags,
+		"missing": &miss,
+	})
+	if err != nil {
+		t.Fatalf("slots get error: %v", err)
+	}
+
+	if name != "John" || age != 42 || fmt.Sprint(tags) != "[a b]" {
+		t.Fatalf("wrong slots values: %s, %d, %v", name, age, tags)
+	}
+	if found["name"] == false || found["age"] == false || found["tags"] == false || found["missing"] == true {
+		t.Fatalf("wrong found slots: %v", found)
+	}
+}
+
+func TestSessionDestroy(t *testing.T) {
+
+	var existed []bool
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		DestroyHandler: func(t *Telegram, s *Session) error {
+			_, e, err := s.StateGet()
+			if err != nil {
+				return err
+			}
+			existed = append(existed, e)
+			return nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {},
+		},
+	})
+
+	s := testSessionNew(t, bot, 1)
+
+	if err := s.StateSet(SessState("menu")); err != nil {
+		t.Fatalf("state set error: %v", err)
+	}
+
+	// Session is destroyed out of handlers
+	if err := s.Destroy(bot); err != nil {
+		t.Fatalf("session destroy error: %v", err)
+	}
+
+	// DestroyHandler is called before session deletion
+	if fmt.Sprint(existed) != "[true]" {
+		t.Fatalf("destroy handler must be called for existing session: %v", existed)
+	}
+
+	if _, e, _ := testSessionNew(t, bot, 1).StateGet(); e == true {
+		t.Fatal("session must be deleted")
+	}
+}
+
+func TestDestroyHandler(t *testing.T) {
+
+	errDestroy := errors.New("destroy failed")
+
+	for _, fail := range []bool{false, true} {
+
+		var (
+			existed []bool
+			errs    []error
+		)
+
+		bot := testBotInit(t, nil, Settings{}, Description{
+			InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+				return InitHandlerRes{NextState: SessState("menu")}, nil
+			},
+			DestroyHandler: func(t *Telegram, s *Session) error {
+				_, e, err := s.StateGet()
+				if err != nil {
+					return err
+				}
+				existed = append(existed, e)
+				if fail == true {
+					return errDestroy
+				}
+				return nil
+			},
+			ErrorHandler: func(t *Telegram, s *Session, e error) (ErrorHandlerRes, error) {
+				errs = append(errs, e)
+				return ErrorHandlerRes{NextState: SessStateDestroy()}, nil
+			},
+			States: map[SessionState]State{
+				SessState("menu"): {
+					MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+						return MessageHandlerRes{NextState: SessStateDestroy()}, nil
+					},
+				},
+			},
+		})
+
+		for i, text := range []string{"hello", "bye"} {
+			if err := bot.ProcessUpdate(testMessage(i+1, 1, text)); err != nil {
+				t.Fatalf("process update error: %v", err)
+			}
+		}
+
+		// DestroyHandler is called before session deletion
+		if fmt.Sprint(existed) != "[true]" {
+			t.Fatalf("destroy handler must be called once for existing session: %v", existed)
+		}
+
+		// DestroyHandler errors are routed through ErrorHandler
+		if fail == true {
+			if len(errs) != 1 || errors.Is(errs[0], errDestroy) == false {
+				t.Fatalf("destroy handler error must be passed to error handler, got: %v", errs)
+			}
+		} else if len(errs) != 0 {
+			t.Fatalf("error handler must not be called, got: %v", errs)
+		}
+
+		if _, e, _ := testSessionNew(t, bot, 1).StateGet(); e == true {
+			t.Fatal("session must be deleted")
+		}
+	}
+}
+
+func TestPrimeHandler(t *testing.T) {
+
+	cases := []struct {
+		source HandlerSource
+		update Update
+		called string
+	}{
+		{HandlerSourceInit, testMessage(1, 1, "hello"), "init"},
+		{HandlerSourceCommand, testCommand(1, 1, "/help"), "command"},
+		{HandlerSourceMessage, testMessage(1, 1, "hello"), "message"},
+		{HandlerSourceCallback, testCallback(t, 1, 1, 1, SessState("menu"), "ok"), "callback"},
+	}
+
+	for _, c := range cases {
+		for _, redirect := range []bool{false, true} {
+
+			var calls []string
+
+			bot := testBotInit(t, nil, Settings{}, Description{
+				PrimeHandler: func(t *Telegram, s *Session, hs HandlerSource) (PrimeHandlerRes, error) {
+					calls = append(calls, "prime:"+string(hs))
+					if redirect == true {
+						return PrimeHandlerRes{NextState: SessState("redirect")}, nil
+					}
+					return PrimeHandlerRes{NextState: SessStateContinue()}, nil
+				},
+				InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+					calls = append(calls, "init")
+					return InitHandlerRes{NextState: SessStateBreak()}, nil
+				},
+				Commands: []Command{
+					{
+						Command: "help",
+						Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+							calls = append(calls, "command")
+							return CommandHandlerRes{NextState: SessStateBreak()}, nil
+						},
+					},
+				},
+				States: map[SessionState]State{
+					SessState("menu"): {
+						MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+							calls = append(calls, "message")
+							return MessageHandlerRes{NextState: SessStateBreak()}, nil
+						},
+						CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+							calls = append(calls, "callback")
+							return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+						},
+					},
+					SessState("redirect"): {
+						StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+							calls = append(calls, "redirect")
+							return StateHandlerRes{Message: "redirected"}, nil
+						},
+					},
+				},
+			})
+
+			if c.source != HandlerSourceInit {
+				if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+					t.Fatalf("session state set error: %v", err)
+				}
+			}
+
+			if err := bot.ProcessUpdate(c.update); err != nil {
+				t.Fatalf("%s: process update error: %v", c.source, err)
+			}
+
+			// PrimeHandler is called with the source of following handler
+			// and either lets it run or switches session to other state
+			expected := "[prime:" + string(c.source) + " " + c.called + "]"
+			if redirect == true {
+				expected = "[prime:" + string(c.source) + " redirect]"
+			}
+			if fmt.Sprint(calls) != expected {
+				t.Fatalf("%s (redirect %t): wrong handlers calls: expected %s, got %v", c.source, redirect, expected, calls)
+			}
+
+			if redirect == true {
+				st, _, err := testSessionNew(t, bot, 1).StateGet()
+				if err != nil {
+					t.Fatalf("state get error: %v", err)
+				}
+				if st != SessState("redirect") {
+					t.Fatalf("%s: session must be switched to redirect state, got %v", c.source, st)
+				}
+			}
+		}
+	}
+}
+
+func TestSessStateContinue(t *testing.T) {
+
+	if SessStateContinue() == SessStateBreak() || SessStateContinue() == SessStateDestroy() {
+		t.Fatal("continue state must differ from other special states")
+	}
+
+	var handled []string
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		PrimeHandler: func(t *Telegram, s *Session, hs HandlerSource) (PrimeHandlerRes, error) {
+			return PrimeHandlerRes{NextState: SessStateContinue()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					handled = append(handled, s.UpdateChain().LastMessageText())
+					return MessageHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ValidateStates(SessStateContinue()); err != nil {
+		t.Fatalf("continue state must be valid: %v", err)
+	}
+
+	if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	if err := bot.ProcessUpdate(testMessage(1, 1, "hello")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	// Continue proceeds to the normal handler keeping session state
+	if fmt.Sprint(handled) != "[hello]" {
+		t.Fatalf("message handler must be called, got: %v", handled)
+	}
+
+	st, _, err := testSessionNew(t, bot, 1).StateGet()
+	if err != nil {
+		t.Fatalf("state get error: %v", err)
+	}
+	if st != SessState("menu") {
+		t.Fatalf("session state must be kept, got %v", st)
+	}
+}
+
+func TestCallbackStateMissing(t *testing.T) {
+
+	for _, withErrorHandler := range []bool{true, false} {
+
+		var errs []error
+
+		d := Description{
+			States: map[SessionState]State{
+				SessState("menu"): {},
+				SessState("start"): {
+					StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+						return StateHandlerRes{Message: "Please /start again"}, nil
+					},
+				},
+			},
+		}
+
+		if withErrorHandler == true {
+			d.ErrorHandler = func(t *Telegram, s *Session, e error) (ErrorHandlerRes, error) {
+				errs = append(errs, e)
+				return ErrorHandlerRes{NextState: SessState("start")}, nil
+			}
+		}
+
+		bot := testBotInit(t, nil, Settings{}, d)
+
+		if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+			t.Fatalf("session state set error: %v", err)
+		}
+
+		// Button belongs to state removed from description
+		err := bot.ProcessUpdate(testCallback(t, 1, 1, 1, SessState("removed"), "ok"))
+
+		if withErrorHandler == false {
+			if errors.Is(err, ErrDescriptionStateMissing) == false {
+				t.Fatalf("missing state error expected, got: %v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+
+		if len(errs) != 1 || errors.Is(errs[0], ErrDescriptionStateMissing) == false {
+			t.Fatalf("missing state error must be passed to error handler, got: %v", errs)
+		}
+
+		st, _, err := testSessionNew(t, bot, 1).StateGet()
+		if err != nil {
+			t.Fatalf("state get error: %v", err)
+		}
+		if st != SessState("start") {
+			t.Fatalf("session must be switched to state returned by error handler, got %v", st)
+		}
+
+		var texts []string
+		for _, r := range append(testSent(bot, "sendMessage"), testSent(bot, "editMessageText")...) {
+			texts = append(texts, r.Params["text"])
+		}
+		if fmt.Sprint(texts) != "[Please /start again]" {
+			t.Fatalf("user must be asked to start again, got: %v", texts)
+		}
+	}
+}
+
+func TestCallbackTransitionSingleEdit(t *testing.T) {
+
+	stuck := func(text string, next SessionState) State {
+		return State{
+			StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+				return StateHandlerRes{
+					Message:      text,
+					StickMessage: true,
+					NextState:    next,
+				}, nil
+			},
+		}
+	}
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					return CallbackHandlerRes{NextState: SessState("silent")}, nil
+				},
+			},
+
+			// State without messages does not consume the edit
+			SessState("silent"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{StickMessage: true, NextState: SessState("a")}, nil
+				},
+			},
+			SessState("a"): stuck("A", SessState("b")),
+			SessState("b"): stuck("B", SessStateBreak()),
+		},
+	})
+
+	if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	if err := bot.ProcessUpdate(testCallback(t, 1, 1, 9, SessState("menu"), "next")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	var methods []string
+	for _, r := range bot.SentRequests() {
+		switch r.Method {
+		case "answerCallbackQuery":
+			methods = append(methods, r.Method)
+		case "editMessageText":
+			methods = append(methods, r.Method+":"+r.Params["message_id"]+":"+r.Params["text"])
+		case "sendMessage":
+			methods = append(methods, r.Method+":"+r.Params["text"])
+		}
+	}
+
+	// Pressed message is edited exactly once, by the first state with
+	// messages, following states send new messages
+	if fmt.Sprint(methods) != "[answerCallbackQuery editMessageText:9:A sendMessage:B]" {
+		t.Fatalf("wrong requests for callback transition: %v", methods)
+	}
+}
@@ -7,12 +7,17 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	rds "github.com/redis/go-redis/v9"
 	"golang.org/x/net/proxy"
 )
 
@@ -22,20 +27,244 @@ type MessageSent tgbotapi.Message
 // ChatMember it's an alias for tgbotapi.ChatMember
 type ChatMember tgbotapi.ChatMember
 
+// BotUser contains an info about the bot itself
+type BotUser struct {
+	ID        int64
+	UserName  string
+	FirstName string
+	LastName  string
+
+	// CanJoinGroups defines whether the bot can be invited to groups
+	CanJoinGroups bool
+
+	// CanReadAllGroupMessages defines whether privacy mode is disabled for the bot
+	CanReadAllGroupMessages bool
+
+	// SupportsInlineQueries defines whether the bot supports inline queries
+	SupportsInlineQueries bool
+}
+
 // Telegram it is a module context structure
 type Telegram struct {
 	bot             *tgbotapi.BotAPI
 	description     Description
 	usrCtx          interface{}
-	redisHost       string
+	redisOpts       *rds.Options
+	redisPrefix     string
+	redisClient     *rds.Client
+	logger          Logger
 	updateQueueWait time.Duration
+	mediaGroupWait  time.Duration
+	updateQueueFair bool
+	synchronous     bool
+	callbackManual  bool
+	uploadSizeLimit int64
+	maxDownloadSize int64
+	sessionScope    SessionScope
+	sessionTTL      time.Duration
+	dedup           *updateDedup
+	destroyBlocked  bool
+	templates       *Templates
+	localizer       Localizer
+	updatesOffset   *int64
+
+	groupSessionsExplicit   bool
+	commandsCaseInsensitive bool
+	autoSplitMessages       bool
+	metrics                 Metrics
+	handlerTimeout          time.Duration
+	webhook                 *SettingsBotWebhook
+	rateLimit               SettingsRateLimit
+	dryRun                  *dryRunClient
+	fileEndpoint            string
+	localAPIMode            bool
 }
 
 // Settings contains data to setting up bot
 type Settings struct {
-	BotSettings     SettingsBot
-	RedisHost       string
+	BotSettings SettingsBot
+
+	// RedisHost defines Redis host either as `host:port` or
+	// as URL with `redis://` or `rediss://` (TLS) scheme
+	RedisHost string
+
+	// RedisTLS defines TLS config to connect to Redis (e.g. managed Redis
+	// with in-transit encryption). Can not be used with `redis://` URL
+	RedisTLS *tls.Config
+
+	// Redis client pool and timeouts settings.
+	// If not set defaults are: pool size 10, dial timeout 10s,
+	// read, write and pool timeouts 30s
+	RedisPoolSize     int
+	RedisDialTimeout  time.Duration
+	RedisReadTimeout  time.Duration
+	RedisWriteTimeout time.Duration
+	RedisPoolTimeout  time.Duration
+
+	// RedisKeysWithBotID defines whether or not Redis keys will be prefixed
+	// with bot ID, so several bots can share the same Redis database. Note that
+	// sessions and queues stored without prefix become unavailable after
+	// enabling. It is always enabled for bots within the `Manager`
+	RedisKeysWithBotID bool
+
+	// Redis commands retries on transient (e.g. network) errors. Retries are
+	// made with exponential backoff between min and max intervals.
+	// If not set defaults are: 3 retries, backoff from 8ms to 512ms.
+	// Set `RedisMaxRetries` to -1 to disable retries
+	RedisMaxRetries      int
+	RedisMinRetryBackoff time.Duration
+	RedisMaxRetryBackoff time.Duration
+
 	UpdateQueueWait time.Duration
+
+	// MediaGroupWait defines a min queue wait interval for updates of
+	// media group (album), so all album items are processed within a single
+	// update chain. If zero, 1 second will be used. Note that albums are
+	// not grouped in `Synchronous` mode
+	MediaGroupWait time.Duration
+
+	// UpdateQueueFair defines whether or not queues will be processed in
+	// order of their wait intervals expiration (oldest first). Otherwise
+	// order is arbitrary and a chatty user may delay processing of others
+	UpdateQueueFair bool
+
+	// Synchronous defines whether or not updates will be processed right
+	// in `UpdateAbsorb` bypassing the queue. It removes the queue latency
+	// for simple request/reply bots, but updates are not coalesced
+	// into chains and may be processed concurrently for the same chat
+	// (e.g. with webhook), so `Processing()` is not needed in this mode
+	Synchronous bool
+
+	// APIEndpoint defines Telegram Bot API endpoint, e.g. for self-hosted
+	// Bot API server. It must contain verbs for bot token and method the
+	// same way as default one, e.g. `http://localhost:8081/bot%s/%s`.
+	// Endpoint to download files is derived from it. If empty, public
+	// Telegram Bot API endpoint will be used
+	APIEndpoint string
+
+	// LocalAPIMode defines whether or not Bot API server specified by
+	// `APIEndpoint` runs in local mode (with `--local` flag). In this mode
+	// files are downloaded directly from disk by paths returned by server,
+	// so the server files directory must be accessible for the bot
+	LocalAPIMode bool
+
+	// HTTPClient defines HTTP client used for requests to Telegram Bot API,
+	// e.g. with custom timeouts or instrumentation. If proxy is specified
+	// in bot settings it is applied to a copy of this client (client transport
+	// must be either nil or `*http.Transport` in this case). If nil, default
+	// client will be used
+	HTTPClient *http.Client
+
+	// DropPendingUpdates defines whether or not updates received by Telegram
+	// while the bot was down will be dropped on init. Queues expired more than
+	// `DropPendingUpdatesAge` ago (1 minute if zero) are dropped as well.
+	// Note that the age should be larger than a processing lag of other
+	// running bot instances
+	DropPendingUpdates    bool
+	DropPendingUpdatesAge time.Duration
+
+	// Debug defines whether or not requests to Telegram Bot API and responses
+	// will be written into `Logger`. Bot tokens are redacted in messages.
+	// Note that Telegram Bot API library logger is global, so it's shared
+	// by all bots in debug mode
+	Debug bool
+
+	// Logger defines a logger for debug messages and errors occurred
+	// while getting updates (see `GetUpdates()`). If nil, messages
+	// will be written to stderr
+	Logger Logger
+
+	// DryRun defines whether or not requests to Telegram will be recorded
+	// instead of sending (see `SentRequests()`). Telegram replies with fake
+	// successful results in this mode. Useful to run the bot within tests
+	DryRun bool
+
+	// CallbackAnswerManual defines whether or not implicit answer to callback
+	// queries will be suppressed, so handlers own the answer entirely and
+	// can answer with `CallbackAnswer()` (e.g. to show an alert). Note that
+	// spinner on the pressed button stays until handler answers (or Telegram
+	// timeout expires). Buttons with toast and answer-only buttons are
+	// still answered implicitly
+	CallbackAnswerManual bool
+
+	// UploadSizeLimit defines max size of file (in bytes) can be uploaded
+	// to Telegram. If zero, Telegram Bot API limit (50 MB) will be used.
+	// Set it if you use a local Bot API server with other limit
+	UploadSizeLimit int64
+
+	// MaxDownloadSize defines max size of file (in bytes) can be downloaded
+	// from Telegram. Protects from disk or memory exhaustion by large files
+	// sent by users. If zero, size of downloaded files is not limited
+	MaxDownloadSize int64
+
+	// SessionScope defines whether sessions are separated by
+	// chat and user (default) or by chat only
+	SessionScope SessionScope
+
+	// SessionTTL defines an interval after which inactive session expires.
+	// Every session modification (or `Touch()`) extends it. Expired session
+	// is considered as not existing (i.e. next update initiates a new one)
+	// and is deleted from Redis once it's read. Note that DestroyHandler is
+	// never called for expired sessions. If zero, sessions never expire
+	SessionTTL time.Duration
+
+	// UpdateDedupWindow defines time interval within which updates with
+	// the same ID (e.g. webhook retries) are dropped by `UpdateAbsorb`.
+	// Update ID is remembered only after the update has been successfully
+	// added into queue (or processed in synchronous mode), so updates
+	// failed to be absorbed are not dropped on redelivery. Seen update IDs
+	// are stored in Redis as well, so the same update delivered to several
+	// bot instances sharing Redis will be absorbed by one of them.
+	// If zero, default value (10 seconds) will be used. Negative value
+	// disables deduplication
+	UpdateDedupWindow time.Duration
+
+	// RateLimit defines per-user limit of updates rate. Updates exceeding
+	// the limit are dropped. Limit is shared between all bot instances
+	// using the same Redis. Payment queries are never limited
+	RateLimit SettingsRateLimit
+
+	// DestroyBlockedSessions defines whether or not destroy session
+	// if user blocked the bot (checked when state message sent)
+	DestroyBlockedSessions bool
+
+	// Templates contains message templates can be used
+	// within `SendMessageData` and `StateHandlerRes`
+	Templates *Templates
+
+	// Localizer defines a localizer to translate messages into
+	// session user language with `Session.T()`
+	Localizer Localizer
+
+	// GroupSessionsExplicit defines whether or not sessions in non-private
+	// chats are created only when user explicitly addresses the bot, i.e.
+	// executes a command or mentions the bot. Otherwise messages from users
+	// without session will be ignored
+	GroupSessionsExplicit bool
+
+	// CommandsCaseInsensitive defines whether or not commands
+	// received from users are matched case-insensitively
+	CommandsCaseInsensitive bool
+
+	// AutoSplitMessages defines whether or not messages longer than
+	// MessageMaxLen will be split (by line breaks or spaces) and sent
+	// as a several messages. Buttons are attached to the last part.
+	// Length is measured by the text user will see (i.e. without markup).
+	// Messages with formatting (e.g. HTML tags or Markdown entities) are
+	// never split, so `ErrMessageTooLong` is returned if they are too long
+	AutoSplitMessages bool
+
+	// Metrics defines hooks to observe handlers and sends (e.g. for Prometheus).
+	// If nil, nothing will be observed
+	Metrics Metrics
+
+	// HandlerTimeout defines max execution time for user handlers
+	// (StateHandler, MessageHandler, CallbackHandler, etc). Handlers get
+	// session with context (see `Session.Context()`) having the deadline.
+	// On timeout the `ErrHandlerTimeout` error will be passed to ErrorHandler
+	// and session of timed out handler is detached, i.e. its Redis operations
+	// and state switches fail. If zero, handlers execution time is not limited
+	HandlerTimeout time.Duration
 }
 
 // SettingsBot contains settings for Telegram bot
@@ -51,6 +280,10 @@ type SettingsBotWebhook struct {
 	BotToken string
 	CertFile string
 	WithCert bool
+
+	// KeyFile defines a private key file for `CertFile`. If set
+	// `ServeWebhook` will serve HTTPS with this certificate
+	KeyFile string
 }
 
 // SettingsBotProxy contains proxy settings for Telegram bot
@@ -61,6 +294,38 @@ type SettingsBotProxy struct {
 	Password string
 }
 
+// SettingsRateLimit contains per-user rate limit settings.
+// Limit is implemented as a token bucket
+type SettingsRateLimit struct {
+
+	// Rate defines a number of updates per second allowed for each user.
+	// If zero, updates are not limited
+	Rate float64
+
+	// Burst defines a max number of updates user can send at once.
+	// If zero, it equals to `Rate` (but at least one)
+	Burst int
+
+	// Message defines a message sent to user when limit is exceeded.
+	// It is sent once until user will be allowed again. If empty
+	// updates are dropped silently
+	Message string
+}
+
+// burstGet gets bucket size for rate limit
+func (rl SettingsRateLimit) burstGet() int {
+
+	if rl.Burst > 0 {
+		return rl.Burst
+	}
+
+	if b := int(math.Ceil(rl.Rate)); b > 1 {
+		return b
+	}
+
+	return 1
+}
+
 // Description describes bot
 type Description struct {
 
@@ -85,12 +350,71 @@ type Description struct {
 	// PrimeHandler is a handler called before any user action handlers, i.e.
 	// CommandHandler, InitHandler, MessageHandler, CallbackHandler.
 	// If PrimeHandler returns an error, ErrorHandler will be called.
-	// If PrimeHandler returns a `sessionContinue` as a new session state, following handlers
+	// If PrimeHandler returns a `SessStateContinue()` as a new session state, following handlers
 	// will be called. Otherwise session will be switched to specified state.
 	PrimeHandler func(t *Telegram, s *Session, hs HandlerSource) (PrimeHandlerRes, error)
 
-	// DestroyHandler is a handler called before session will be destroyed
+	// DestroyHandler is a handler called before session will be destroyed.
+	// If it returns an error, ErrorHandler will be called. Session will be
+	// destroyed only if ErrorHandler returns a `destroy` session state,
+	// otherwise session will be switched to returned state
 	DestroyHandler func(t *Telegram, s *Session) error
+
+	// CommandDeniedHandler is a handler called instead of command handler
+	// if user or chat is not allowed to execute the command (see `AllowedUserIDs`
+	// and `AllowedChatIDs` in command description). If not defined, standard
+	// "not authorized" message will be sent and session state will not be changed
+	CommandDeniedHandler func(t *Telegram, s *Session, cmd string) (CommandHandlerRes, error)
+
+	// DefaultHandler is a handler called if current session state has no
+	// appropriate handler for update chain, e.g. message received in state
+	// without MessageHandler
+	DefaultHandler func(t *Telegram, s *Session) (DefaultHandlerRes, error)
+
+	// SentHandler is a global handler called after messages have been
+	// successfully sent (or edited) with `SendMessage`, `UploadFile` or
+	// `UploadFileStream` from any place, e.g. for logging or audit.
+	// Unlike the state SentHandler it's called for direct sends too
+	SentHandler func(t *Telegram, messages []MessageSent)
+
+	// BotDescriptions contains bot profile descriptions for different
+	// languages. Descriptions will be set for bot at Init if specified
+	BotDescriptions []BotDescription
+
+	// UnknownUpdateHandler is a handler called for updates of types bot
+	// can not process (e.g. polls or new Telegram features), such updates
+	// are dropped. Useful for observability
+	UnknownUpdateHandler func(t *Telegram, update Update)
+
+	// PreCheckoutHandler is a handler called when user confirms payment and
+	// Telegram asks the bot to check the order. Query can be got with
+	// `UpdateChain().PreCheckoutQueryGet()` and must be answered with
+	// `AnswerPreCheckoutQuery()`. Session is keyed by user in private chat.
+	// If not defined, queries will be declined
+	PreCheckoutHandler func(t *Telegram, s *Session) (PaymentHandlerRes, error)
+
+	// ShippingHandler is a handler called for invoices with flexible price when
+	// user specifies shipping address. Query can be got with
+	// `UpdateChain().ShippingQueryGet()` and must be answered with
+	// `AnswerShippingQuery()`. Session is keyed by user in private chat.
+	// If not defined, queries will be declined
+	ShippingHandler func(t *Telegram, s *Session) (PaymentHandlerRes, error)
+}
+
+// BotDescription contains bot profile descriptions for the language
+type BotDescription struct {
+
+	// LanguageCode defines two-letter ISO 639-1 language code. If empty,
+	// descriptions will be applied to all users without dedicated ones
+	LanguageCode string
+
+	// Description defines a text shown in the chat with the bot if the chat
+	// is empty, 0-512 characters
+	Description string
+
+	// ShortDescription defines a text shown on the bot's profile page and sent
+	// together with the link when users share the bot, 0-120 characters
+	ShortDescription string
 }
 
 // InitHandlerRes contains data returned by the InitHandler
@@ -120,6 +444,15 @@ type ErrorHandlerRes struct {
 	NextState SessionState
 }
 
+// DefaultHandlerRes contains data returned by the DefaultHandler
+type DefaultHandlerRes struct {
+
+	// New state to switch the session.
+	// All values of NextState must exist in States map
+	// within the bot description
+	NextState SessionState
+}
+
 // StateHandlerRes contains data returned by the StateHandler
 type StateHandlerRes struct {
 
@@ -127,6 +460,13 @@ type StateHandlerRes struct {
 	// Message can not be zero length
 	Message string
 
+	// Template defines a template name from bot settings to render
+	// message text. If set `Message` will be ignored
+	Template string
+
+	// Vars contains values for template placeholders
+	Vars map[string]string
+
 	// ParseMode defines a Telegram message Parse mode
 	ParseMode ParseMode
 
@@ -138,12 +478,21 @@ type StateHandlerRes struct {
 	// If Buttons has zero length message will not contains buttons
 	Buttons [][]Button
 
+	// Messages contains additional messages to be sent to user in order
+	// (after `Message` if set). Buttons of all messages are processed
+	// by the state's CallbackHandler, `ButtonState` is ignored.
+	// If `StickMessage` is set only the first message will be updated
+	Messages []SendMessageData
+
 	// NextState defines next state for current session.
 	// NextState will be ignored if MessageHandler defined for state
 	NextState SessionState
 
 	// Whether or not stick message. If true appropriate message will
-	// be updated when a new state initiate by the `update` of callback type
+	// be updated when a new state initiate by the `update` of callback type.
+	// Within a chain of states (switched by `NextState`) the message is
+	// updated at most once: by the first state which sends messages.
+	// Following states send new messages
 	StickMessage bool
 }
 
@@ -159,6 +508,12 @@ type CallbackHandlerRes struct {
 
 	// NextState contains next session state
 	NextState SessionState
+
+	// EditOriginal overrides `StickMessage` of the next state handler result,
+	// i.e. defines whether the message with pressed button will be edited
+	// (if true) or a new message will be sent (if false). If nil,
+	// `StickMessage` will be used
+	EditOriginal *bool
 }
 
 // CommandHandlerRes contains data returned by the CommandHandler
@@ -178,6 +533,22 @@ type Command struct {
 	// Command description that users will see in Telegram
 	Description string
 
+	// Aliases contains alternative names for command (without leading
+	// '/' character), e.g. `h` for `help`
+	Aliases []string
+
+	// AliasesInMenu defines whether or not register aliases
+	// within Telegram commands menu
+	AliasesInMenu bool
+
+	// AllowedUserIDs restricts command to specified users only.
+	// If empty, command is allowed for all users
+	AllowedUserIDs []int64
+
+	// AllowedChatIDs restricts command to specified chats only.
+	// If empty, command is allowed in all chats
+	AllowedChatIDs []int64
+
 	// Handler to processing command received from user
 	Handler func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error)
 }
@@ -191,6 +562,11 @@ type State struct {
 	// Handler to processing messages received from user
 	MessageHandler func(t *Telegram, s *Session) (MessageHandlerRes, error)
 
+	// Validator checks messages received from user before MessageHandler
+	// will be called. If validator returns an error, its text will be sent
+	// to user and state will be re-prompted (StateHandler called again)
+	Validator func(t *Telegram, s *Session) error
+
 	// Handler to processing callbacks received from user for specific state of session
 	CallbackHandler func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error)
 
@@ -203,10 +579,49 @@ var (
 	// ErrCallbackDataFormat contains error "wrong callback data format"
 	ErrCallbackDataFormat = errors.New("wrong callback data format")
 
+	// ErrBotBlocked contains error "bot was blocked or can not write into chat"
+	ErrBotBlocked = errors.New("bot was blocked or can not write into chat")
+
+	// ErrChatNotFound contains error "chat not found"
+	ErrChatNotFound = errors.New("chat not found")
+
+	// ErrMessageNotModified contains error "message is not modified"
+	ErrMessageNotModified = errors.New("message is not modified")
+
+	// ErrMessageToDeleteNotFound contains error "message to delete not found"
+	ErrMessageToDeleteNotFound = errors.New("message to delete not found")
+
+	// ErrTooManyRequests contains error "too many requests"
+	ErrTooManyRequests = errors.New("too many requests")
+
+	// ErrAPIEndpointFormat contains error "wrong API endpoint format"
+	ErrAPIEndpointFormat = errors.New("wrong API endpoint format")
+
+	// ErrManagerBotNotFound contains error "bot not found in manager"
+	ErrManagerBotNotFound = errors.New("bot not found in manager")
+
+	// ErrManagerRedisMismatch contains error "bot uses Redis other than manager"
+	ErrManagerRedisMismatch = errors.New("bot uses Redis other than manager")
+
+	// ErrMessageEmpty contains error "message is empty"
+	ErrMessageEmpty = errors.New("message is empty")
+
+	// ErrMessageTooLong contains error "message is too long"
+	ErrMessageTooLong = errors.New("message is too long")
+
+	// ErrButtonsTooMany contains error "too many buttons"
+	ErrButtonsTooMany = errors.New("too many buttons")
+
+	// ErrCallbackDataTooLong contains error "callback data too long"
+	ErrCallbackDataTooLong = errors.New("callback data too long")
+
 	// ErrDescriptionState contains error "session state not defined in bot description"
 	ErrDescriptionStateMissing = errors.New("session state not defined in bot description")
 
 	// ErrUpdatesChanClosed contains error "updates channel has been closed"
+	//
+	// Deprecated: updates are not received via channel anymore, so
+	// `GetUpdates()` never returns this error. It's kept for compatibility
 	ErrUpdatesChanClosed = errors.New("updates channel has been closed")
 
 	// ErrUpdateChainZeroLen contains error "update has zero len"
@@ -217,6 +632,45 @@ var (
 
 	// ErrSessionNotExist contains error "session does not exist"
 	ErrSessionNotExist = errors.New("session does not exist")
+
+	// ErrSessionConflict contains error "session has been concurrently modified"
+	ErrSessionConflict = errors.New("session has been concurrently modified")
+
+	// ErrDescriptionStateWrong contains error "wrong session state in bot description"
+	ErrDescriptionStateWrong = errors.New("wrong session state in bot description")
+
+	// ErrCommandArgsCount contains error "wrong number of command arguments"
+	ErrCommandArgsCount = errors.New("wrong number of command arguments")
+
+	// ErrHandlerTimeout contains error "handler timeout exceeded"
+	ErrHandlerTimeout = errors.New("handler timeout exceeded")
+
+	// ErrWebhookNotSet contains error "webhook settings not set"
+	ErrWebhookNotSet = errors.New("webhook settings not set")
+
+	// ErrRedisTLSConflict contains error "Redis TLS settings conflict"
+	ErrRedisTLSConflict = errors.New("Redis TLS settings conflict")
+
+	// ErrTemplateNotFound contains error "template not found"
+	ErrTemplateNotFound = errors.New("template not found")
+
+	// ErrFileTooLarge contains error "file too large"
+	ErrFileTooLarge = errors.New("file too large")
+)
+
+const (
+
+	// uploadSizeLimitDefault is a Telegram Bot API limit for uploading files
+	uploadSizeLimitDefault = 50 * 1024 * 1024
+
+	// dropPendingUpdatesAgeDefault is a default age of expired queues dropped on init
+	dropPendingUpdatesAgeDefault = 1 * time.Minute
+
+	// mediaGroupWaitDefault is a default min queue wait interval for media group updates
+	mediaGroupWaitDefault = 1 * time.Second
+
+	// getUpdatesRetryInterval is an interval to wait before retry to get updates after error
+	getUpdatesRetryInterval = 3 * time.Second
 )
 
 // Button contains buttons data for state
@@ -225,11 +679,26 @@ type Button struct {
 	// Button text
 	Text string
 
-	// Defines a button identifier for processing in handler
+	// Defines a button identifier for processing in handler.
+	// For "url" mode it's a URL to open, for "switch" modes
+	// it's an inline query to insert into input field
 	Identifier string
 
-	// Defines a button mode for processing in handler ("data" (default), "url", "switch")
+	// Defines a button mode for processing in handler ("data" (default), "url",
+	// "switch", "switch_current", "answer"). Pressing the button in "answer" mode
+	// just shows the `Toast` to user, session state is not changed
 	Mode ButtonMode
+
+	// Defines a notification text will be shown to user after button pressed
+	// (e.g. "Cancelled" for buttons with `SessStateDestroy()` state).
+	// Only for "data" and "answer" modes. Toast is not a part of callback
+	// data: toasts are kept in Redis for 30 days since the last message
+	// with buttons has been sent into chat
+	Toast string
+
+	// Defines whether or not `Toast` will be shown as an alert
+	// instead of notification. Only for "data" and "answer" modes
+	Alert bool
 }
 
 // File contains file descrition received from Telegram
@@ -240,6 +709,12 @@ type File struct {
 	f tgbotapi.File
 }
 
+// FileIDGet gets file ID. It can be used to send the same file
+// again without re-uploading (see `SendFileID`)
+func (f File) FileIDGet() string {
+	return f.f.FileID
+}
+
 // FileSendStream contains options for sending file to Telegram as stream
 type FileSendStream struct {
 	FileType  FileType
@@ -248,6 +723,26 @@ type FileSendStream struct {
 	Caption   string
 	ParseMode ParseMode
 	Buttons   [][]Button
+
+	// ButtonState defines a state with callback handler for buttons
+	ButtonState SessionState
+
+	// Thumbnail defines a reader for file preview (JPEG less than 200 kB
+	// and 320x320 px). Used for video, audio and document files
+	Thumbnail     io.Reader
+	ThumbnailName string
+
+	// Width and Height define video dimensions. Duration defines
+	// video, audio or voice duration in seconds. Zero values are omitted
+	Width    int
+	Height   int
+	Duration int
+
+	// SupportsStreaming defines whether uploaded video is suitable for streaming
+	SupportsStreaming bool
+
+	// Spoiler defines whether photo or video will be covered with spoiler animation
+	Spoiler bool
 }
 
 // FileSend contains options for sending file to Telegram
@@ -257,6 +752,25 @@ type FileSend struct {
 	Caption   string
 	ParseMode ParseMode
 	Buttons   [][]Button
+
+	// ButtonState defines a state with callback handler for buttons
+	ButtonState SessionState
+
+	// ThumbnailPath defines a path to file preview (JPEG less than 200 kB
+	// and 320x320 px). Used for video, audio and document files
+	ThumbnailPath string
+
+	// Width and Height define video dimensions. Duration defines
+	// video, audio or voice duration in seconds. Zero values are omitted
+	Width    int
+	Height   int
+	Duration int
+
+	// SupportsStreaming defines whether uploaded video is suitable for streaming
+	SupportsStreaming bool
+
+	// Spoiler defines whether photo or video will be covered with spoiler animation
+	Spoiler bool
 }
 
 // SendMessageData contains an options for message
@@ -265,6 +779,17 @@ type SendMessageData struct {
 	// Message defines a message text will sent to user
 	Message string
 
+	// Template defines a template name from bot settings to render
+	// message text. If set `Message` will be ignored
+	Template string
+
+	// Vars contains values for template placeholders
+	Vars map[string]string
+
+	// Lang defines a language of template. If template is not found
+	// for specified language, default one will be used
+	Lang string
+
 	// ParseMode defines a Telegram message Parse mode
 	ParseMode ParseMode
 
@@ -280,7 +805,8 @@ type SendMessageData struct {
 	ButtonState SessionState
 }
 
-// HandlerSource is a type of source handler where PrimeHandler was called
+// HandlerSource is a type of source handler where PrimeHandler was called.
+// Also it's used to identify the handler observed by Metrics
 type HandlerSource string
 
 const (
@@ -288,6 +814,19 @@ const (
 	HandlerSourceCommand  HandlerSource = "command"
 	HandlerSourceMessage  HandlerSource = "message"
 	HandlerSourceCallback HandlerSource = "callback"
+
+	HandlerSourcePreCheckout HandlerSource = "pre_checkout"
+	HandlerSourceShipping    HandlerSource = "shipping"
+
+	// HandlerSourceState is used only for Metrics to observe StateHandler
+	HandlerSourceState HandlerSource = "state"
+
+	// Following sources are used only for Metrics to observe
+	// PrimeHandler, Validator, ErrorHandler and DestroyHandler
+	HandlerSourcePrime     HandlerSource = "prime"
+	HandlerSourceValidator HandlerSource = "validator"
+	HandlerSourceError     HandlerSource = "error"
+	HandlerSourceDestroy   HandlerSource = "destroy"
 )
 
 func (hs HandlerSource) String() string {
@@ -310,6 +849,36 @@ func (f FileType) String() string {
 	return [...]string{"document", "photo", "voice", "video", "audio", "sticker"}[f]
 }
 
+// CommandScopeType it's a type of bot commands scope
+// (see https://core.telegram.org/bots/api#botcommandscope for details)
+type CommandScopeType int
+
+const (
+	CommandScopeDefault CommandScopeType = iota
+	CommandScopeAllPrivateChats
+	CommandScopeAllGroupChats
+	CommandScopeAllChatAdministrators
+	CommandScopeChat
+	CommandScopeChatAdministrators
+	CommandScopeChatMember
+)
+
+func (c CommandScopeType) String() string {
+	return [...]string{"default", "all_private_chats", "all_group_chats", "all_chat_administrators", "chat", "chat_administrators", "chat_member"}[c]
+}
+
+// CommandScope contains scope of bot commands
+type CommandScope struct {
+	Type CommandScopeType
+
+	// ChatID defines a chat for `CommandScopeChat`,
+	// `CommandScopeChatAdministrators` and `CommandScopeChatMember` types
+	ChatID int64
+
+	// UserID defines a user for `CommandScopeChatMember` type
+	UserID int64
+}
+
 // ButtonMode it's a type of button mode (see https://core.telegram.org/bots/api#inlinekeyboardbutton for details)
 type ButtonMode int
 
@@ -317,10 +886,12 @@ const (
 	ButtonModeData ButtonMode = iota
 	ButtonModeURL
 	ButtonModeSwitch
+	ButtonModeSwitchCurrent
+	ButtonModeAnswer
 )
 
 func (b ButtonMode) String() string {
-	return [...]string{"data", "url", "switch"}[b]
+	return [...]string{"data", "url", "switch", "switch_current", "answer"}[b]
 }
 
 type ParseMode int
@@ -340,28 +911,115 @@ func Init(s Settings, description Description, usrCtx interface{}) (Telegram, er
 
 	var t Telegram
 
-	bot, err := botConnect(s.BotSettings.BotAPI, s.BotSettings.Proxy)
+	ro, err := redisOptionsGet(s)
+	if err != nil {
+		return t, err
+	}
+
+	var bot *tgbotapi.BotAPI
+
+	endpoint := s.APIEndpoint
+	if len(endpoint) == 0 {
+		endpoint = tgbotapi.APIEndpoint
+	}
+
+	t.localAPIMode = s.LocalAPIMode
+	t.fileEndpoint, err = fileEndpointGet(endpoint)
+	if err != nil {
+		return t, err
+	}
+
+	if s.DryRun == true {
+		t.dryRun = &dryRunClient{}
+		bot, err = tgbotapi.NewBotAPIWithClient(s.BotSettings.BotAPI, endpoint, t.dryRun)
+	} else {
+		bot, err = botConnect(s.BotSettings.BotAPI, endpoint, s.BotSettings.Proxy, s.HTTPClient)
+	}
 	if err != nil {
 		return t, err
 	}
 
 	t.bot = bot
 	t.description = description
+
+	t.logger = s.Logger
+	if t.logger == nil {
+		t.logger = loggerDefault()
+	}
+	t.logger = loggerRedact{l: t.logger}
+
+	if s.Debug == true {
+		tgbotapi.SetLogger(t.logger)
+		t.bot.Debug = true
+	}
+
+	if s.RedisKeysWithBotID == true {
+		t.redisPrefix = "bot" + strconv.FormatInt(bot.Self.ID, 10)
+	}
 	t.usrCtx = usrCtx
-	t.redisHost = s.RedisHost
+	t.redisOpts = ro
 	t.updateQueueWait = s.UpdateQueueWait
+	t.mediaGroupWait = s.MediaGroupWait
+	if t.mediaGroupWait == 0 {
+		t.mediaGroupWait = mediaGroupWaitDefault
+	}
+	t.updateQueueFair = s.UpdateQueueFair
+	t.synchronous = s.Synchronous
+	t.callbackManual = s.CallbackAnswerManual
+	t.sessionScope = s.SessionScope
+	t.sessionTTL = s.SessionTTL
+	t.destroyBlocked = s.DestroyBlockedSessions
+	t.templates = s.Templates
+	t.localizer = s.Localizer
+	t.updatesOffset = new(int64)
+	t.groupSessionsExplicit = s.GroupSessionsExplicit
+	t.commandsCaseInsensitive = s.CommandsCaseInsensitive
+	t.autoSplitMessages = s.AutoSplitMessages
+
+	t.handlerTimeout = s.HandlerTimeout
+
+	t.metrics = s.Metrics
+	if t.metrics == nil {
+		t.metrics = metricsNoop{}
+	}
+
+	switch {
+	case s.UpdateDedupWindow == 0:
+		t.dedup = updateDedupInit(updateDedupWindowDefault)
+	case s.UpdateDedupWindow > 0:
+		t.dedup = updateDedupInit(s.UpdateDedupWindow)
+	}
+
+	t.maxDownloadSize = s.MaxDownloadSize
+	t.uploadSizeLimit = s.UploadSizeLimit
+	if t.uploadSizeLimit == 0 {
+		t.uploadSizeLimit = uploadSizeLimitDefault
+	}
+
+	t.webhook = s.BotSettings.Webhook
+	t.rateLimit = s.RateLimit
 
 	if s.BotSettings.Webhook != nil {
-		if err := t.webhookSet(s.BotSettings.Webhook); err != nil {
+		if err := t.webhookSet(s.BotSettings.Webhook, s.DropPendingUpdates); err != nil {
 			return t, err
 		}
 	} else {
-		if err := t.webhookDel(); err != nil {
+		if err := t.webhookDel(s.DropPendingUpdates); err != nil {
+			return t, err
+		}
+	}
+
+	if s.DropPendingUpdates == true {
+		if err := t.queuePurge(s.DropPendingUpdatesAge); err != nil {
 			return t, err
 		}
 	}
 
-	err = t.commandsSet()
+	if err := t.commandsSet(); err != nil {
+		return t, err
+	}
+
+	err = t.botDescriptionsSet()
 
 	return t, err
 }
@@ -370,22 +1028,69 @@ func (t *Telegram) SelfIDGet() int64 {
 	return t.bot.Self.ID
 }
 
+// Self gets an info about the bot received from Telegram at init
+func (t *Telegram) Self() BotUser {
+	return BotUser{
+		ID:                      t.bot.Self.ID,
+		UserName:                t.bot.Self.UserName,
+		FirstName:               t.bot.Self.FirstName,
+		LastName:                t.bot.Self.LastName,
+		CanJoinGroups:           t.bot.Self.CanJoinGroups,
+		CanReadAllGroupMessages: t.bot.Self.CanReadAllGroupMessages,
+		SupportsInlineQueries:   t.bot.Self.SupportsInlineQueries,
+	}
+}
+
+// HealthCheck checks both Redis and Telegram Bot API are reachable.
+// Useful for liveness and readiness probes
+func (t *Telegram) HealthCheck(ctx context.Context) error {
+
+	var errs []string
+
+	r, err := t.redisGet(ctx)
+	if err == nil {
+		err = r.client.Ping(ctx).Err()
+		r.close()
+	}
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("redis: %v", err))
+	}
+
+	if _, err := t.bot.GetMe(); err != nil {
+		errs = append(errs, fmt.Sprintf("telegram: %v", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("health check failed: %s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
 // Processing processes available updates from queue
 func (t *Telegram) Processing() error {
 
-	q, err := queueInit(t.redisHost, t.updateQueueWait)
+	ctx := context.Background()
+
+	q, err := queueInit(ctx, t)
 	if err != nil {
 		return err
 	}
 	defer q.close()
 
 	// Get all available updates from queue
-	uc, err := q.chainGet()
+	uc, err := q.chainGet(ctx)
 	if err != nil {
 		return err
 	}
 
-	sess, err := sessionInit(uc, t.redisHost)
+	return t.chainProcess(ctx, uc)
+}
+
+// chainProcess processes update chain got from queue
+func (t *Telegram) chainProcess(ctx context.Context, uc UpdateChain) error {
+
+	sess, err := sessionInit(ctx, t, uc)
 	if err != nil {
 		if err == ErrUpdateChainZeroLen {
 			return nil
@@ -398,143 +1103,678 @@ func (t *Telegram) Processing() error {
 	return sess.stateProcessing(t)
 }
 
-// GetUpdates creates to Telegram API and processes a receiving updates
-func (t *Telegram) GetUpdates(ctx context.Context) error {
+// redisGet gets Redis connection. Bots within the `Manager` use the
+// client shared by manager, other bots open a new connection
+func (t *Telegram) redisGet(ctx context.Context) (*redis, error) {
+
+	if t.redisClient != nil {
+		return redisAttach(t.redisClient, t.redisPrefix), nil
+	}
+
+	return redisConnect(ctx, t.redisOpts, t.redisPrefix)
+}
+
+// QueueStats gets statistics of updates waiting for processing in queue
+func (t *Telegram) QueueStats() (QueueStats, error) {
+
+	ctx := context.Background()
+
+	q, err := queueInit(ctx, t)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	defer q.close()
+
+	return q.stats(ctx)
+}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
+// GetUpdates creates to Telegram API and processes a receiving updates.
+// Errors occurred while getting updates are written into `Logger` and
+// request is retried, except non-retryable ones (i.e. bot token is revoked
+// or updates are got by other bot instance or webhook) which are returned.
+// Returns nil when `ctx` is done
+func (t *Telegram) GetUpdates(ctx context.Context) error {
 
-	c := t.bot.GetUpdatesChan(u)
-	defer t.bot.StopReceivingUpdates()
+	// Use copy of Bot API with requests bound to `ctx`,
+	// so pending request is cancelled with it
+	bot := *t.bot
+	bot.Client = ctxClient{
+		client: t.bot.Client,
+		ctx:    ctx,
+	}
 
 	for {
-		select {
-		case <-ctx.Done():
+
+		u := tgbotapi.NewUpdate(t.UpdatesOffsetGet())
+		u.Timeout = 60
+
+		updates, err := bot.GetUpdates(u)
+		if ctx.Err() != nil {
 			return nil
-		case u, b := <-c:
-			if b == false {
-				return ErrUpdatesChanClosed
+		}
+		if err != nil {
+
+			if getUpdatesRetryable(err) == false {
+				return fmt.Errorf("get updates error: %w", err)
 			}
-			if err := t.UpdateAbsorb(Update(u)); err != nil {
+
+			t.logger.Printf("get updates error (retry in %s): %v", getUpdatesRetryInterval, err)
+
+			// Wait before retry to get updates
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(getUpdatesRetryInterval):
+			}
+			continue
+		}
+
+		for _, update := range updates {
+			if update.UpdateID < t.UpdatesOffsetGet() {
+				continue
+			}
+			if err := t.UpdateAbsorb(Update(update)); err != nil {
 				return fmt.Errorf("bot add request into queue error: %v", err)
 			}
+			atomic.StoreInt64(t.updatesOffset, int64(update.UpdateID)+1)
 		}
 	}
 }
 
+// ctxClient it is a HTTP client for Telegram Bot API
+// binding all requests to the context
+type ctxClient struct {
+	client tgbotapi.HTTPClient
+	ctx    context.Context
+}
+
+func (c ctxClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req.WithContext(c.ctx))
+}
+
+// UpdatesOffsetGet gets the offset (i.e. ID of the next expected update)
+// the poller started by `GetUpdates` is at
+func (t *Telegram) UpdatesOffsetGet() int {
+	return int(atomic.LoadInt64(t.updatesOffset))
+}
+
 // UpdateAbsorb absorbs specified `update` and put it into queue
 func (t *Telegram) UpdateAbsorb(update Update) error {
+	return t.updateAbsorb(update, t.updateQueueWait)
+}
 
-	chatID, userID := updateIDsGet(update)
+// UpdateAbsorbWithWait absorbs specified `update` and put it into queue with
+// `wait` interval instead of `UpdateQueueWait` from settings. E.g. useful to
+// coalesce files sent by user as several messages with longer interval.
+// Note that the interval of the last update put into queue is applied to the queue.
+// Payment queries are always put into queue without wait
+func (t *Telegram) UpdateAbsorbWithWait(update Update, wait time.Duration) error {
+	return t.updateAbsorb(update, wait)
+}
 
-	if update.CallbackQuery != nil {
-		// Do not check errors to prevent
-		// `query is too old and response timeout expired or query ID is invalid` error
-		t.bot.Request(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
-	}
+// updateAbsorb absorbs specified `update` and put it into queue with `wait` interval
+func (t *Telegram) updateAbsorb(update Update, wait time.Duration) error {
 
-	if chatID == 0 || userID == 0 {
-		return nil
+	// Drop already absorbed updates
+	if t.dedup != nil && update.UpdateID != 0 {
+		if t.dedup.check(update.UpdateID) == true {
+			return nil
+		}
 	}
 
-	q, err := queueInit(t.redisHost, t.updateQueueWait)
-	if err != nil {
+	if err := t.updateEnqueue(update, wait); err != nil {
 		return err
 	}
-	defer q.close()
 
-	return q.add(chatID, userID, update)
-}
+	// Update is remembered only after it has been absorbed, so
+	// the failed one will not be dropped on redelivery
+	if t.dedup != nil && update.UpdateID != 0 {
+		t.dedup.commit(update.UpdateID)
+	}
 
-// UsrCtxGet gets user context
-func (t *Telegram) UsrCtxGet() interface{} {
-	return t.usrCtx
+	return nil
 }
 
-// sendMessage sends specified message to client
-// Messages can be of two types: either new message, or edit existing message (if messageID is set).
-func (t *Telegram) SendMessage(chatID int64, messageID int, msgData SendMessageData) ([]MessageSent, error) {
-
-	var (
-		bm  [][]tgbotapi.InlineKeyboardButton
-		ikm tgbotapi.InlineKeyboardMarkup
-		mr  tgbotapi.Message
-		err error
-	)
-
-	// If buttons set
-	if len(msgData.Buttons) > 0 {
-		for _, br := range msgData.Buttons {
-			var b []tgbotapi.InlineKeyboardButton
-			for _, be := range br {
+// updateEnqueue puts specified `update` into queue (or processes it
+// immediately in synchronous mode)
+func (t *Telegram) updateEnqueue(update Update, wait time.Duration) error {
 
-				d, err := callbackDataGen(msgData.ButtonState, be.Identifier)
-				if err != nil {
-					return []MessageSent{}, err
-				}
-				b = append(b, buttonPrepare(be.Text, d, be.Mode))
-			}
-			bm = append(bm, b)
-		}
+	ctx := context.Background()
 
-		ikm = tgbotapi.NewInlineKeyboardMarkup(bm...)
+	q, err := queueInit(ctx, t)
+	if err != nil {
+		return err
 	}
+	defer q.close()
 
-	if messageID == 0 {
-		msg := tgbotapi.NewMessage(chatID, msgData.Message)
-		msg.ParseMode = msgData.ParseMode.String()
-		msg.DisableWebPagePreview = msgData.DisableWebPagePreview
-
-		if len(msgData.Buttons) > 0 {
-			msg.ReplyMarkup = ikm
+	// Drop updates absorbed by other bot instances
+	if t.dedup != nil && update.UpdateID != 0 {
+		b, err := q.seen(ctx, update.UpdateID, t.dedup.window)
+		if err != nil {
+			return err
+		}
+		if b == true {
+			return nil
 		}
+	}
 
-		mr, err = t.bot.Send(msg)
-	} else {
-		msg := tgbotapi.NewEditMessageText(chatID, messageID, msgData.Message)
-		msg.ParseMode = msgData.ParseMode.String()
-		msg.DisableWebPagePreview = msgData.DisableWebPagePreview
+	if err := t.updateAdd(ctx, q, update, wait); err != nil {
 
-		if len(msgData.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
+		// Release the update claimed above, so other bot
+		// instances will not drop it on redelivery
+		if t.dedup != nil && update.UpdateID != 0 {
+			if e := q.unseen(ctx, update.UpdateID); e != nil {
+				return fmt.Errorf("%w (release update error: %v)", err, e)
+			}
 		}
 
-		mr, err = t.bot.Send(msg)
+		return err
 	}
 
-	return []MessageSent{MessageSent(mr)}, err
+	return nil
 }
 
-// DownloadFileStream returns io.ReadCloser to download specified file
-func (t *Telegram) DownloadFileStream(file File) (io.ReadCloser, error) {
+// updateAdd adds specified `update` into queue (or processes it
+// immediately in synchronous mode) if it must not be dropped
+func (t *Telegram) updateAdd(ctx context.Context, q queue, update Update, wait time.Duration) error {
 
-	// Make request
-	req, err := http.NewRequest("GET", file.f.Link(t.bot.Token), nil)
+	chatID, userID := updateIDsGet(update)
+
+	// Answer-only buttons do not affect the session
+	answerOnly, err := t.callbackAnswerImplicit(ctx, q.redis, update)
 	if err != nil {
-		return nil, fmt.Errorf("can't create new request: %v", err)
+		return err
 	}
-
-	// Make request
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: false,
-		},
+	if answerOnly == true {
+		return nil
 	}
-	client := &http.Client{Transport: tr}
 
-	// Do request
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("request error: %v", err)
+	if t.updateUnknown(update) == true {
+		return nil
 	}
 
-	if res.StatusCode == http.StatusOK {
-		return res.Body, nil
+	if chatID == 0 || userID == 0 {
+		return nil
 	}
 
-	res.Body.Close()
+	// Payment queries must be answered within seconds,
+	// so they are neither rate limited nor wait in queue
+	payment := update.PreCheckoutQuery != nil || update.ShippingQuery != nil
+	if payment == true {
+		wait = 0
+	}
 
-	return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	if t.rateLimit.Rate > 0 && payment == false {
+		b, notify, err := q.limit(ctx, userID, t.rateLimit)
+		if err != nil {
+			return err
+		}
+		if b == false {
+			if notify == true && len(t.rateLimit.Message) > 0 {
+				_, err := t.SendMessage(chatID, 0, SendMessageData{
+					Message: t.rateLimit.Message,
+				})
+				return err
+			}
+			return nil
+		}
+	}
+
+	if t.synchronous == true {
+		return t.updateProcess(ctx, update)
+	}
+
+	// Wait for the rest album items
+	if update.Message != nil && len(update.Message.MediaGroupID) > 0 && wait < t.mediaGroupWait {
+		wait = t.mediaGroupWait
+	}
+
+	return q.add(ctx, chatID, userID, update, wait)
+}
+
+// queuePurge drops queues expired more than `age` ago
+func (t *Telegram) queuePurge(age time.Duration) error {
+
+	ctx := context.Background()
+
+	if age <= 0 {
+		age = dropPendingUpdatesAgeDefault
+	}
+
+	q, err := queueInit(ctx, t)
+	if err != nil {
+		return err
+	}
+	defer q.close()
+
+	return q.purge(ctx, time.Now().Add(-age))
+}
+
+// ProcessUpdate processes specified `update` immediately the same way as
+// updates from queue (i.e. routes it to appropriate handlers and switches
+// session state) bypassing the queue, deduplication and rate limit.
+// It's useful to test the bot, e.g. in conjunction with `DryRun` setting
+func (t *Telegram) ProcessUpdate(update Update) error {
+
+	ctx := context.Background()
+
+	if update.CallbackQuery != nil {
+
+		r, err := t.redisGet(ctx)
+		if err != nil {
+			return err
+		}
+
+		answerOnly, err := t.callbackAnswerImplicit(ctx, r, update)
+		r.close()
+		if err != nil {
+			return err
+		}
+		if answerOnly == true {
+			return nil
+		}
+	}
+
+	if t.updateUnknown(update) == true {
+		return nil
+	}
+
+	return t.updateProcess(ctx, update)
+}
+
+// updateUnknown checks whether the update has type bot can not process.
+// Such updates are passed to UnknownUpdateHandler if defined
+func (t *Telegram) updateUnknown(update Update) bool {
+
+	if updateTypeEltGet(update) != UpdateTypeUnknown {
+		return false
+	}
+
+	if t.description.UnknownUpdateHandler != nil {
+		t.description.UnknownUpdateHandler(t, update)
+	}
+
+	return true
+}
+
+// callbackAnswerImplicit answers to callback query from `update` if any
+// (unless answer is suppressed by settings) with toast of pressed button.
+// Returns true if update is a press of answer-only button and must not be
+// processed further
+func (t *Telegram) callbackAnswerImplicit(ctx context.Context, r *redis, update Update) (bool, error) {
+
+	if update.CallbackQuery == nil {
+		return false, nil
+	}
+
+	answerOnly := callbackAnswerOnly(update.CallbackQuery.Data)
+
+	var ct callbackToast
+
+	if key := callbackToastsKeyGet(update.CallbackQuery); len(key) > 0 {
+		var err error
+		ct, err = r.toastGet(ctx, key, update.CallbackQuery.Data)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	c := tgbotapi.NewCallback(update.CallbackQuery.ID, ct.T)
+	c.ShowAlert = ct.A
+
+	// Do not check errors to prevent
+	// `query is too old and response timeout expired or query ID is invalid` error
+	if t.callbackManual == false || answerOnly == true || len(ct.T) > 0 {
+		t.bot.Request(c)
+	}
+
+	return answerOnly, nil
+}
+
+// updateProcess processes specified update immediately as a single-element chain
+func (t *Telegram) updateProcess(ctx context.Context, update Update) error {
+
+	var uc UpdateChain
+
+	uc.add([]Update{update})
+
+	sess, err := sessionInit(ctx, t, uc)
+	if err != nil {
+		if err == ErrUpdateChainZeroLen {
+			return nil
+		}
+		return err
+	}
+	defer sess.close()
+
+	return sess.stateProcessing(t)
+}
+
+// SessionStart switches session for specified chat and user into `state`
+// (session will be started if not exist) and processes it as if it was
+// triggered by user. It's useful to send proactive notifications that land
+// user in an interactive flow
+func (t *Telegram) SessionStart(chatID, userID int64, state SessionState) error {
+
+	s, err := sessionNew(context.Background(), t, chatID, userID)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return s.stateSwitch(t, state, 0)
+}
+
+// SessionStateSet sets session for specified chat and user into `state`
+// (session will be started if not exist) without calling any handlers.
+// Use `SessionStart()` to process the state as if it was triggered by user
+func (t *Telegram) SessionStateSet(chatID, userID int64, state SessionState) error {
+
+	s, err := sessionNew(context.Background(), t, chatID, userID)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	return s.StateSet(state)
+}
+
+// ValidateStates checks the states defined in bot description are correct,
+// i.e. created with `SessState()` and have non-empty names. Also specified
+// `refs` (e.g. states returned by handlers or used as buttons state) are
+// checked to be defined in bot description. Useful to call at startup
+func (t *Telegram) ValidateStates(refs ...SessionState) error {
+
+	for state := range t.description.States {
+		if state.Name() == "" {
+			return fmt.Errorf("%w: `%s`", ErrDescriptionStateWrong, state)
+		}
+	}
+
+	for _, state := range refs {
+		switch state {
+		case
+			sessionBreak,
+			sessionDestroy,
+			sessionContinue:
+			continue
+		}
+		if _, b := t.description.States[state]; b == false {
+			return fmt.Errorf("%w: `%s`", ErrDescriptionStateMissing, state)
+		}
+	}
+
+	return nil
+}
+
+// IsBlockedError checks whether `err` is a Telegram error occurred due to
+// the bot can not send messages into chat (e.g. user blocked the bot)
+func IsBlockedError(err error) bool {
+	return errors.Is(classifyError(err), ErrBotBlocked)
+}
+
+// CallbackAnswer answers to callback query with specified `text`. If `alert` is true
+// an alert will be shown to user instead of toast. Use it within the handlers if
+// `CallbackAnswerManual` setting is enabled, otherwise query is already answered
+func (t *Telegram) CallbackAnswer(queryID, text string, alert bool) error {
+
+	c := tgbotapi.NewCallback(queryID, text)
+	c.ShowAlert = alert
+
+	_, err := t.bot.Request(c)
+
+	return classifyError(err)
+}
+
+// UsrCtxGet gets user context
+func (t *Telegram) UsrCtxGet() interface{} {
+	return t.usrCtx
+}
+
+// sendMessage sends specified message to client
+// Messages can be of two types: either new message, or edit existing message (if messageID is set).
+// If edited message already has the same content it is not considered as an error.
+func (t *Telegram) SendMessage(chatID int64, messageID int, msgData SendMessageData) ([]MessageSent, error) {
+
+	var msgs []MessageSent
+
+	if len(msgData.Template) > 0 {
+		m, err := t.templateRender(msgData.Template, msgData.Lang, msgData.Vars)
+		if err != nil {
+			return []MessageSent{}, err
+		}
+		msgData.Message = m
+	}
+
+	parts := []string{msgData.Message}
+	if t.autoSplitMessages == true {
+		parts = messageSplit(msgData.Message, msgData.ParseMode)
+	}
+
+	for _, p := range parts {
+		if err := messageCheck(p, msgData.ParseMode); err != nil {
+			return []MessageSent{}, err
+		}
+	}
+
+	ikm, err := keyboardPrepare(msgData.Buttons, msgData.ButtonState)
+	if err != nil {
+		return []MessageSent{}, err
+	}
+
+	if err := t.toastsSave(toastsKeyGet(chatID, ""), msgData.Buttons, msgData.ButtonState); err != nil {
+		return []MessageSent{}, err
+	}
+
+	for i, p := range parts {
+
+		var mr tgbotapi.Message
+
+		// Buttons are attached to the last part only
+		last := i == len(parts)-1
+
+		// If message to edit is specified, first part will replace it
+		// and the rest parts will be sent as a new messages
+		if messageID == 0 || i > 0 {
+			msg := tgbotapi.NewMessage(chatID, p)
+			msg.ParseMode = msgData.ParseMode.String()
+			msg.DisableWebPagePreview = msgData.DisableWebPagePreview
+
+			if len(msgData.Buttons) > 0 && last == true {
+				msg.ReplyMarkup = ikm
+			}
+
+			mr, err = t.bot.Send(msg)
+		} else {
+			msg := tgbotapi.NewEditMessageText(chatID, messageID, p)
+			msg.ParseMode = msgData.ParseMode.String()
+			msg.DisableWebPagePreview = msgData.DisableWebPagePreview
+
+			if len(msgData.Buttons) > 0 && last == true {
+				msg.ReplyMarkup = &ikm
+			}
+
+			mr, err = t.bot.Send(msg)
+
+			// Message already has the same content, nothing to do
+			if errors.Is(classifyError(err), ErrMessageNotModified) == true {
+				mr = tgbotapi.Message{
+					MessageID: messageID,
+					Chat:      &tgbotapi.Chat{ID: chatID},
+				}
+				err = nil
+			}
+		}
+
+		t.metrics.ObserveSend(err)
+
+		if err != nil {
+			return append(msgs, MessageSent(mr)), classifyError(err)
+		}
+
+		msgs = append(msgs, MessageSent(mr))
+	}
+
+	t.sentHandlerCall(msgs)
+
+	return msgs, nil
+}
+
+// EditInlineMessage edits message sent via the bot in inline mode (i.e. message
+// has `inlineMessageID` instead of chat and message IDs). Message is not split
+// even if `AutoSplitMessages` is enabled. If message already has the same
+// content it is not considered as an error.
+func (t *Telegram) EditInlineMessage(inlineMessageID string, msgData SendMessageData) error {
+
+	if len(msgData.Template) > 0 {
+		m, err := t.templateRender(msgData.Template, msgData.Lang, msgData.Vars)
+		if err != nil {
+			return err
+		}
+		msgData.Message = m
+	}
+
+	if err := messageCheck(msgData.Message, msgData.ParseMode); err != nil {
+		return err
+	}
+
+	ikm, err := keyboardPrepare(msgData.Buttons, msgData.ButtonState)
+	if err != nil {
+		return err
+	}
+
+	if err := t.toastsSave(toastsKeyGet(0, inlineMessageID), msgData.Buttons, msgData.ButtonState); err != nil {
+		return err
+	}
+
+	msg := tgbotapi.EditMessageTextConfig{
+		BaseEdit: tgbotapi.BaseEdit{
+			InlineMessageID: inlineMessageID,
+		},
+		Text:                  msgData.Message,
+		ParseMode:             msgData.ParseMode.String(),
+		DisableWebPagePreview: msgData.DisableWebPagePreview,
+	}
+
+	if len(msgData.Buttons) > 0 {
+		msg.ReplyMarkup = &ikm
+	}
+
+	// Telegram returns `true` instead of message for inline messages
+	_, err = t.bot.Request(msg)
+
+	t.metrics.ObserveSend(err)
+
+	err = classifyError(err)
+	if errors.Is(err, ErrMessageNotModified) == true {
+		return nil
+	}
+
+	return err
+}
+
+// sentHandlerCall calls global sent handler if defined
+func (t *Telegram) sentHandlerCall(messages []MessageSent) {
+	if t.description.SentHandler != nil {
+		t.description.SentHandler(t, messages)
+	}
+}
+
+// DownloadFileStream returns io.ReadCloser to download specified file
+func (t *Telegram) DownloadFileStream(file File) (io.ReadCloser, error) {
+
+	if t.maxDownloadSize > 0 && int64(file.FileSize) > t.maxDownloadSize {
+		return nil, fmt.Errorf("%w: file `%s` size %d bytes exceeds download limit %d bytes", ErrFileTooLarge, file.FileName, file.FileSize, t.maxDownloadSize)
+	}
+
+	// Local Bot API server stores files on its own disk
+	// and returns absolute paths to them
+	if t.localAPIMode == true && path.IsAbs(file.f.FilePath) == true {
+
+		f, err := os.Open(file.f.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("can't open local file: %v", err)
+		}
+
+		return t.downloadLimit(f), nil
+	}
+
+	// Make request
+	req, err := http.NewRequest("GET", fmt.Sprintf(t.fileEndpoint, t.bot.Token, file.f.FilePath), nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't create new request: %v", err)
+	}
+
+	// Make request
+	tr := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: false,
+		},
+	}
+	client := &http.Client{Transport: tr}
+
+	// Do request
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request error: %v", err)
+	}
+
+	if res.StatusCode == http.StatusOK {
+		return t.downloadLimit(res.Body), nil
+	}
+
+	res.Body.Close()
+
+	return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+}
+
+// downloadLimit wraps downloaded file stream with size limit check if limit is set
+func (t *Telegram) downloadLimit(rc io.ReadCloser) io.ReadCloser {
+
+	if t.maxDownloadSize <= 0 {
+		return rc
+	}
+
+	// File size may be unknown or wrong, so check it while reading too
+	return &downloadLimitReader{
+		rc:    rc,
+		left:  t.maxDownloadSize,
+		limit: t.maxDownloadSize,
+	}
+}
+
+// downloadLimitReader reads from `rc` until `limit` bytes has been
+// read. If the stream has more data ErrFileTooLarge will be returned
+type downloadLimitReader struct {
+	rc    io.ReadCloser
+	left  int64
+	limit int64
+}
+
+func (r *downloadLimitReader) Read(p []byte) (int, error) {
+
+	if r.left <= 0 {
+		// Check whether stream has more data than limit
+		var b [1]byte
+		n, err := r.rc.Read(b[:])
+		if n > 0 {
+			return 0, fmt.Errorf("%w: downloaded data exceeds download limit %d bytes", ErrFileTooLarge, r.limit)
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+
+	n, err := r.rc.Read(p)
+	r.left -= int64(n)
+
+	return n, err
+}
+
+func (r *downloadLimitReader) Close() error {
+	return r.rc.Close()
 }
 
 // DownloadFile downloads file from Telegram to specified path
@@ -553,83 +1793,184 @@ func (t *Telegram) DownloadFile(file File, dstPath string) error {
 	defer lf.Close()
 
 	if _, err := io.Copy(lf, s); err != nil {
+		// Do not leave partially downloaded file
+		lf.Close()
+		os.Remove(dstPath)
 		return err
 	}
 
 	return nil
 }
 
-// UploadFileStream uploads file to Telegram by specified reader
+// UploadFileStream uploads file to Telegram by specified reader.
+// If `file.FileSize` is set it will be checked against upload size limit
 func (t *Telegram) UploadFileStream(chatID int64, file FileSendStream, r io.Reader) (MessageSent, error) {
 
-	var c tgbotapi.Chattable
+	if file.FileSize > t.uploadSizeLimit {
+		return MessageSent{}, fmt.Errorf("%w: file `%s` size %d bytes exceeds upload limit %d bytes", ErrFileTooLarge, file.FileName, file.FileSize, t.uploadSizeLimit)
+	}
+
+	ikm, err := keyboardPrepare(file.Buttons, file.ButtonState)
+	if err != nil {
+		return MessageSent{}, err
+	}
+
+	if err := t.toastsSave(toastsKeyGet(chatID, ""), file.Buttons, file.ButtonState); err != nil {
+		return MessageSent{}, err
+	}
+
+	reader := tgbotapi.FileReader{
+		Name:   file.FileName,
+		Reader: r,
+	}
+
+	return t.fileSend(chatID, file, reader, ikm)
+}
+
+// SendFileID sends file already stored on Telegram servers by its file ID
+// (e.g. `File.FileIDGet()` of received file) without re-uploading
+func (t *Telegram) SendFileID(chatID int64, fileType FileType, fileID string, caption string) (MessageSent, error) {
+	return t.fileSend(chatID, FileSendStream{
+		FileType: fileType,
+		Caption:  caption,
+	}, tgbotapi.FileID(fileID), tgbotapi.InlineKeyboardMarkup{})
+}
+
+// SendFileURL sends file by specified URL. File will be downloaded by Telegram
+func (t *Telegram) SendFileURL(chatID int64, fileType FileType, url string, caption string) (MessageSent, error) {
+	return t.fileSend(chatID, FileSendStream{
+		FileType: fileType,
+		Caption:  caption,
+	}, tgbotapi.FileURL(url), tgbotapi.InlineKeyboardMarkup{})
+}
+
+// fileSend sends file with specified data (either reader, file ID or URL) to Telegram.
+// Request parameters are composed here rather than with tgbotapi configs
+// because latter don't support some options (e.g. video width and height)
+func (t *Telegram) fileSend(chatID int64, file FileSendStream, fd tgbotapi.RequestFileData, ikm tgbotapi.InlineKeyboardMarkup) (MessageSent, error) {
+
+	var (
+		m    tgbotapi.Message
+		resp *tgbotapi.APIResponse
+		err  error
+	)
 
-	reader, ikm := uploadStreamPrepare(file, r)
+	method, field := fileMethodGet(file.FileType)
+
+	params := make(tgbotapi.Params)
+	params.AddNonZero64("chat_id", chatID)
+
+	files := []tgbotapi.RequestFile{
+		{
+			Name: field,
+			Data: fd,
+		},
+	}
+
+	thumb := uploadThumbnailPrepare(file)
 
 	switch file.FileType {
 	case FileTypePhoto:
-		msg := tgbotapi.NewPhoto(chatID, reader)
-		msg.ParseMode = file.ParseMode.String()
-		msg.Caption = file.Caption
-
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
-		}
-		c = msg
+		params.AddNonEmpty("caption", file.Caption)
+		params.AddNonEmpty("parse_mode", file.ParseMode.String())
+		params.AddBool("has_spoiler", file.Spoiler)
 
 	case FileTypeVoice:
-		msg := tgbotapi.NewVoice(chatID, reader)
-		msg.ParseMode = file.ParseMode.String()
-		msg.Caption = file.Caption
-
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
-		}
-		c = msg
+		params.AddNonEmpty("caption", file.Caption)
+		params.AddNonEmpty("parse_mode", file.ParseMode.String())
+		params.AddNonZero("duration", file.Duration)
 
 	case FileTypeVideo:
-		msg := tgbotapi.NewVideo(chatID, reader)
-		msg.ParseMode = file.ParseMode.String()
-		msg.Caption = file.Caption
-
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
-		}
-		c = msg
+		params.AddNonEmpty("caption", file.Caption)
+		params.AddNonEmpty("parse_mode", file.ParseMode.String())
+		params.AddNonZero("duration", file.Duration)
+		params.AddNonZero("width", file.Width)
+		params.AddNonZero("height", file.Height)
+		params.AddBool("supports_streaming", file.SupportsStreaming)
+		params.AddBool("has_spoiler", file.Spoiler)
 
 	case FileTypeAudio:
-		msg := tgbotapi.NewAudio(chatID, reader)
-		msg.ParseMode = file.ParseMode.String()
-		msg.Caption = file.Caption
-
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
-		}
-		c = msg
+		params.AddNonEmpty("caption", file.Caption)
+		params.AddNonEmpty("parse_mode", file.ParseMode.String())
+		params.AddNonZero("duration", file.Duration)
 
 	case FileTypeSticker:
-		msg := tgbotapi.NewSticker(chatID, reader)
+		// Sticker has no caption
+
+	default: // including FileTypeDocument case
+		params.AddNonEmpty("caption", file.Caption)
+		params.AddNonEmpty("parse_mode", file.ParseMode.String())
+	}
 
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
+	switch file.FileType {
+	case FileTypeVideo, FileTypeAudio, FileTypeDocument:
+		if thumb != nil {
+			files = append(files, tgbotapi.RequestFile{
+				Name: "thumb",
+				Data: thumb,
+			})
 		}
-		c = msg
+	}
 
-	default: // including FileTypeDocument case
-		// For other examples see: https://github.com/go-telegram-bot-api/telegram-bot-api/blob/master/bot_test.go
-		msg := tgbotapi.NewDocument(chatID, reader)
-		msg.ParseMode = file.ParseMode.String()
-		msg.Caption = file.Caption
+	if len(file.Buttons) > 0 {
+		if err := params.AddInterface("reply_markup", ikm); err != nil {
+			return MessageSent{}, err
+		}
+	}
 
-		if len(file.Buttons) > 0 {
-			msg.ReplyMarkup = &ikm
+	if fileNeedsUpload(files) == true {
+		resp, err = t.bot.UploadFiles(method, params, files)
+		if err != nil {
+			// Upload errors contain no error code
+			var e *tgbotapi.Error
+			if errors.As(err, &e) == true && resp != nil {
+				e.Code = resp.ErrorCode
+			}
 		}
+	} else {
+		for _, f := range files {
+			params[f.Name] = f.Data.SendData()
+		}
+		resp, err = t.bot.MakeRequest(method, params)
+	}
+	if err != nil {
+		return MessageSent{}, classifyError(err)
+	}
 
-		c = msg
+	if err := json.Unmarshal(resp.Result, &m); err != nil {
+		return MessageSent{}, err
 	}
 
-	m, err := t.bot.Send(c)
-	return MessageSent(m), err
+	t.sentHandlerCall([]MessageSent{MessageSent(m)})
+
+	return MessageSent(m), nil
+}
+
+// fileMethodGet gets Telegram API method and request field name to send file of specified type
+func fileMethodGet(fileType FileType) (string, string) {
+	switch fileType {
+	case FileTypePhoto:
+		return "sendPhoto", "photo"
+	case FileTypeVoice:
+		return "sendVoice", "voice"
+	case FileTypeVideo:
+		return "sendVideo", "video"
+	case FileTypeAudio:
+		return "sendAudio", "audio"
+	case FileTypeSticker:
+		return "sendSticker", "sticker"
+	}
+	return "sendDocument", "document"
+}
+
+// fileNeedsUpload checks whether any of files must be uploaded
+func fileNeedsUpload(files []tgbotapi.RequestFile) bool {
+	for _, f := range files {
+		if f.Data.NeedsUpload() == true {
+			return true
+		}
+	}
+	return false
 }
 
 // UploadFile uploads file as to Telegram
@@ -646,14 +1987,34 @@ func (t *Telegram) UploadFile(chatID int64, file FileSend) (MessageSent, error)
 		return MessageSent{}, err
 	}
 
-	return t.UploadFileStream(chatID, FileSendStream{
+	fs := FileSendStream{
 		FileType:  file.FileType,
 		FileName:  path.Base(file.FilePath),
 		FileSize:  stat.Size(),
 		Caption:   file.Caption,
 		ParseMode: file.ParseMode,
 		Buttons:   file.Buttons,
-	}, f)
+		Width:     file.Width,
+		Height:    file.Height,
+		Duration:  file.Duration,
+
+		ButtonState:       file.ButtonState,
+		SupportsStreaming: file.SupportsStreaming,
+		Spoiler:           file.Spoiler,
+	}
+
+	if len(file.ThumbnailPath) > 0 {
+		th, err := os.Open(file.ThumbnailPath)
+		if err != nil {
+			return MessageSent{}, err
+		}
+		defer th.Close()
+
+		fs.Thumbnail = th
+		fs.ThumbnailName = path.Base(file.ThumbnailPath)
+	}
+
+	return t.UploadFileStream(chatID, fs, f)
 }
 
 func (t *Telegram) ChatMemberGet(chatID, userID int64) (ChatMember, error) {
@@ -672,7 +2033,7 @@ func (t *Telegram) ChatMemberGet(chatID, userID int64) (ChatMember, error) {
 }
 
 // webhookSet sets Telegram webhook
-func (t *Telegram) webhookSet(s *SettingsBotWebhook) error {
+func (t *Telegram) webhookSet(s *SettingsBotWebhook, dropPending bool) error {
 
 	var (
 		wh  tgbotapi.WebhookConfig
@@ -684,11 +2045,7 @@ func (t *Telegram) webhookSet(s *SettingsBotWebhook) error {
 	}
 
 	// Prepare webhook URL
-	whURL := s.URL
-	if whURL[len(whURL)-1] != '/' {
-		whURL += "/"
-	}
-	whURL += s.BotToken
+	whURL := webhookURLGet(s)
 
 	// Set webhook (each time when server starting)
 	if s.WithCert == true {
@@ -703,6 +2060,8 @@ func (t *Telegram) webhookSet(s *SettingsBotWebhook) error {
 		}
 	}
 
+	wh.DropPendingUpdates = dropPending
+
 	if _, err := t.bot.Request(wh); err != nil {
 		return fmt.Errorf("Telegram bot set webhook error: %v", err)
 	}
@@ -710,13 +2069,45 @@ func (t *Telegram) webhookSet(s *SettingsBotWebhook) error {
 	return nil
 }
 
-func (t *Telegram) webhookDel() error {
-	if _, err := t.bot.Request(tgbotapi.DeleteWebhookConfig{}); err != nil {
+// webhookURLGet gets full webhook URL (incl. bot token)
+func webhookURLGet(s *SettingsBotWebhook) string {
+	whURL := s.URL
+	if len(whURL) == 0 || whURL[len(whURL)-1] != '/' {
+		whURL += "/"
+	}
+	return whURL + s.BotToken
+}
+
+func (t *Telegram) webhookDel(dropPending bool) error {
+	if _, err := t.bot.Request(tgbotapi.DeleteWebhookConfig{DropPendingUpdates: dropPending}); err != nil {
 		return fmt.Errorf("Telegram bot delete webhook error: %v", err)
 	}
 	return nil
 }
 
+// CommandsClear deletes bot commands (i.e. clears commands menu) for
+// specified scopes. If no scopes specified commands of default scope
+// will be deleted. Useful when migrating commands between scopes
+func (t *Telegram) CommandsClear(scope ...CommandScope) error {
+
+	if len(scope) == 0 {
+		_, err := t.bot.Request(tgbotapi.NewDeleteMyCommands())
+		return err
+	}
+
+	for _, s := range scope {
+		if _, err := t.bot.Request(tgbotapi.NewDeleteMyCommandsWithScope(tgbotapi.BotCommandScope{
+			Type:   s.Type.String(),
+			ChatID: s.ChatID,
+			UserID: s.UserID,
+		})); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Set specified bot commands
 func (t *Telegram) commandsSet() error {
 
@@ -727,6 +2118,17 @@ func (t *Telegram) commandsSet() error {
 			Command:     c.Command,
 			Description: c.Description,
 		})
+
+		if c.AliasesInMenu == false {
+			continue
+		}
+
+		for _, a := range c.Aliases {
+			bcmds = append(bcmds, tgbotapi.BotCommand{
+				Command:     a,
+				Description: c.Description,
+			})
+		}
 	}
 
 	// Set specified commands
@@ -737,11 +2139,40 @@ func (t *Telegram) commandsSet() error {
 	return nil
 }
 
+// botDescriptionsSet sets bot profile descriptions specified in bot description
+func (t *Telegram) botDescriptionsSet() error {
+
+	for _, d := range t.description.BotDescriptions {
+
+		params := make(tgbotapi.Params)
+		params["description"] = d.Description
+		params.AddNonEmpty("language_code", d.LanguageCode)
+
+		if _, err := t.bot.MakeRequest("setMyDescription", params); err != nil {
+			return fmt.Errorf("Telegram bot set description error: %v", err)
+		}
+
+		params = make(tgbotapi.Params)
+		params["short_description"] = d.ShortDescription
+		params.AddNonEmpty("language_code", d.LanguageCode)
+
+		if _, err := t.bot.MakeRequest("setMyShortDescription", params); err != nil {
+			return fmt.Errorf("Telegram bot set short description error: %v", err)
+		}
+	}
+
+	return nil
+}
+
 // botConnect sets up Telegram bot
-func botConnect(botAPI string, p *SettingsBotProxy) (*tgbotapi.BotAPI, error) {
+func botConnect(botAPI, endpoint string, p *SettingsBotProxy, client *http.Client) (*tgbotapi.BotAPI, error) {
+
+	if client == nil {
+		client = &http.Client{}
+	}
 
 	if p == nil {
-		return tgbotapi.NewBotAPI(botAPI)
+		return tgbotapi.NewBotAPIWithClient(botAPI, endpoint, client)
 	}
 
 	switch p.Type {
@@ -756,62 +2187,237 @@ func botConnect(botAPI string, p *SettingsBotProxy) (*tgbotapi.BotAPI, error) {
 			return nil, fmt.Errorf("connect to proxy error: %v", err)
 		}
 
-		t := &http.Transport{Dial: dialer.Dial}
+		// Proxy is applied to a copy of specified client
+		// to keep its other settings (e.g. timeouts)
+		var t *http.Transport
+
+		switch tr := client.Transport.(type) {
+		case nil:
+			t = &http.Transport{}
+		case *http.Transport:
+			t = tr.Clone()
+			t.Proxy = nil
+			t.DialContext = nil
+		default:
+			return nil, fmt.Errorf("proxy can not be used with custom HTTP client transport")
+		}
+		t.Dial = dialer.Dial
 
-		return tgbotapi.NewBotAPIWithClient(botAPI, tgbotapi.APIEndpoint, &http.Client{Transport: t})
+		c := *client
+		c.Transport = t
+
+		return tgbotapi.NewBotAPIWithClient(botAPI, endpoint, &c)
 	}
 
 	return nil, fmt.Errorf("unknown proxy type")
 }
 
-func (d *Description) commandLookup(cmd string) *Command {
-	for _, c := range d.Commands {
-		if c.Command == cmd {
-			return &c
+// fileEndpointGet gets endpoint to download files for specified Bot API endpoint
+func fileEndpointGet(endpoint string) (string, error) {
+
+	if strings.HasSuffix(endpoint, "/bot%s/%s") == false {
+		return "", ErrAPIEndpointFormat
+	}
+
+	return strings.TrimSuffix(endpoint, "/bot%s/%s") + "/file/bot%s/%s", nil
+}
+
+// commandLookup lookups command by its name or alias.
+// Returned pointer refers to the element of `d.Commands`
+func (d *Description) commandLookup(cmd string, caseInsensitive bool) *Command {
+
+	eq := func(a, b string) bool {
+		if caseInsensitive == true {
+			return strings.EqualFold(a, b)
+		}
+		return a == b
+	}
+
+	for i, c := range d.Commands {
+		if eq(c.Command, cmd) == true {
+			return &d.Commands[i]
+		}
+		for _, a := range c.Aliases {
+			if eq(a, cmd) == true {
+				return &d.Commands[i]
+			}
 		}
 	}
 	return nil
 }
 
-// uploadStreamPrepare prepares reader and inline keyboard markup for stream uploading
-func uploadStreamPrepare(file FileSendStream, r io.Reader) (tgbotapi.FileReader, tgbotapi.InlineKeyboardMarkup) {
+// allowed checks whether command is allowed for specified chat and user
+func (c *Command) allowed(chatID, userID int64) bool {
 
-	var (
-		bm  [][]tgbotapi.InlineKeyboardButton
-		ikm tgbotapi.InlineKeyboardMarkup
-	)
+	in := func(ids []int64, id int64) bool {
+		for _, i := range ids {
+			if i == id {
+				return true
+			}
+		}
+		return false
+	}
 
-	reader := tgbotapi.FileReader{
-		Name:   file.FileName,
-		Reader: r,
+	if len(c.AllowedUserIDs) > 0 && in(c.AllowedUserIDs, userID) == false {
+		return false
 	}
 
-	// If buttons set
-	if len(file.Buttons) > 0 {
-		for _, br := range file.Buttons {
-			var b []tgbotapi.InlineKeyboardButton
-			for _, be := range br {
+	if len(c.AllowedChatIDs) > 0 && in(c.AllowedChatIDs, chatID) == false {
+		return false
+	}
+
+	return true
+}
+
+// apiErrorGet gets Telegram API error from `err` if it is
+func apiErrorGet(err error) *tgbotapi.Error {
+
+	var e *tgbotapi.Error
+
+	if errors.As(err, &e) == false {
+		return nil
+	}
+
+	return e
+}
+
+// keyboardPrepare prepares inline keyboard markup for specified buttons.
+// Buttons callback data will be bound to `state`
+func keyboardPrepare(buttons [][]Button, state SessionState) (tgbotapi.InlineKeyboardMarkup, error) {
+
+	var bm [][]tgbotapi.InlineKeyboardButton
+
+	if len(buttons) == 0 {
+		return tgbotapi.InlineKeyboardMarkup{}, nil
+	}
+
+	if err := buttonsCheck(buttons); err != nil {
+		return tgbotapi.InlineKeyboardMarkup{}, err
+	}
+
+	for _, br := range buttons {
+		var b []tgbotapi.InlineKeyboardButton
+		for _, be := range br {
+
+			s, ok := buttonStateGet(be, state)
+			if ok == false {
+				// Identifier is used as is
 				b = append(b, buttonPrepare(be.Text, be.Identifier, be.Mode))
+				continue
+			}
+
+			d, err := callbackDataGen(s, be.Identifier)
+			if err != nil {
+				return tgbotapi.InlineKeyboardMarkup{}, err
 			}
-			bm = append(bm, b)
+
+			if len(d) > callbackDataMaxLen {
+				return tgbotapi.InlineKeyboardMarkup{}, fmt.Errorf("%w: identifier `%s` in state `%s` takes %d bytes, max %d bytes", ErrCallbackDataTooLong, be.Identifier, state, len(d), callbackDataMaxLen)
+			}
+			b = append(b, buttonPrepare(be.Text, d, be.Mode))
 		}
-		ikm = tgbotapi.NewInlineKeyboardMarkup(bm...)
+		bm = append(bm, b)
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(bm...), nil
+}
+
+// buttonStateGet gets state button callback data will be bound to.
+// Returns false if button has no callback data (e.g. "url" mode)
+func buttonStateGet(button Button, state SessionState) (SessionState, bool) {
+
+	switch button.Mode {
+	case ButtonModeURL, ButtonModeSwitch, ButtonModeSwitchCurrent:
+		return SessionState{}, false
+	case ButtonModeAnswer:
+		return sessionAnswer, true
 	}
 
-	return reader, ikm
+	return state, true
 }
 
-// buttonPrepare prepare a button for inline keyboard markup
+// toastsSave saves toasts of specified buttons bound to `state` for message
+// with key `key` (see `callbackToastsKeyGet()`), so they will be shown to user
+// when the buttons pressed
+func (t *Telegram) toastsSave(key string, buttons [][]Button, state SessionState) error {
+
+	var noToasts []string
+
+	toasts := make(map[string]callbackToast)
+
+	for _, br := range buttons {
+		for _, be := range br {
+
+			s, ok := buttonStateGet(be, state)
+			if ok == false {
+				continue
+			}
+
+			d, err := callbackDataGen(s, be.Identifier)
+			if err != nil {
+				return err
+			}
+
+			if len(be.Toast) == 0 {
+				noToasts = append(noToasts, d)
+				continue
+			}
+
+			toasts[d] = callbackToast{
+				T: be.Toast,
+				A: be.Alert,
+			}
+		}
+	}
+
+	if len(toasts) == 0 && len(noToasts) == 0 {
+		return nil
+	}
+
+	ctx := context.Background()
+
+	r, err := t.redisGet(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	return r.toastsSave(ctx, key, toasts, noToasts)
+}
+
+// uploadThumbnailPrepare prepares thumbnail for stream uploading.
+// Returns nil if thumbnail is not set
+func uploadThumbnailPrepare(file FileSendStream) tgbotapi.RequestFileData {
+
+	if file.Thumbnail == nil {
+		return nil
+	}
+
+	name := file.ThumbnailName
+	if len(name) == 0 {
+		name = "thumb.jpg"
+	}
+
+	return tgbotapi.FileReader{
+		Name:   name,
+		Reader: file.Thumbnail,
+	}
+}
+
+// buttonPrepare prepare a button for inline keyboard markup.
+// For "url" and "switch" modes `identifier` it's a raw URL or inline query,
+// for other modes it's a callback data
 func buttonPrepare(text, identifier string, mode ButtonMode) tgbotapi.InlineKeyboardButton {
 	switch mode {
 	case ButtonModeURL:
-		d := callbackData{}
-		json.Unmarshal([]byte(identifier), &d)
-		return tgbotapi.NewInlineKeyboardButtonURL(text, d.I)
+		return tgbotapi.NewInlineKeyboardButtonURL(text, identifier)
 	case ButtonModeSwitch:
-		d := callbackData{}
-		json.Unmarshal([]byte(identifier), &d)
-		return tgbotapi.NewInlineKeyboardButtonSwitch(text, d.I)
+		return tgbotapi.NewInlineKeyboardButtonSwitch(text, identifier)
+	case ButtonModeSwitchCurrent:
+		return tgbotapi.InlineKeyboardButton{
+			Text:                         text,
+			SwitchInlineQueryCurrentChat: &identifier,
+		}
 	}
 	return tgbotapi.NewInlineKeyboardButtonData(text, identifier)
 }
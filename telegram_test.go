@@ -0,0 +1,1257 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// errTestHandler is an error returned by handlers in tests
+var errTestHandler = errors.New("handler error")
+
+// testBotInit initializes a bot in dry-run mode with in-memory Redis
+func testBotInit(t *testing.T, m *miniredis.Miniredis, s Settings, d Description) *Telegram {
+
+	t.Helper()
+
+	if m == nil {
+		m = miniredis.RunT(t)
+	}
+
+	s.RedisHost = m.Addr()
+	s.DryRun = true
+
+	bot, err := Init(s, d, nil)
+	if err != nil {
+		t.Fatalf("bot init error: %v", err)
+	}
+
+	return &bot
+}
+
+// testMessage makes an update with text message from user in private chat
+func testMessage(updateID int, userID int64, text string) Update {
+	return Update{
+		UpdateID: updateID,
+		Message: &tgbotapi.Message{
+			MessageID: updateID,
+			From:      &tgbotapi.User{ID: userID},
+			Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+			Text:      text,
+		},
+	}
+}
+
+// testCommand makes an update with command message (e.g. `/start arg`)
+// from user in private chat
+func testCommand(updateID int, userID int64, text string) Update {
+
+	u := testMessage(updateID, userID, text)
+	u.Message.Entities = []tgbotapi.MessageEntity{
+		{
+			Type:   "bot_command",
+			Offset: 0,
+			Length: len(strings.Fields(text)[0]),
+		},
+	}
+
+	return u
+}
+
+// testGroupMessage makes an update with text message from user in group chat
+func testGroupMessage(updateID int, chatID, userID int64, text string) Update {
+
+	u := testMessage(updateID, userID, text)
+	u.Message.Chat = &tgbotapi.Chat{ID: chatID, Type: "group"}
+
+	return u
+}
+
+// testCallback makes an update with press of button with `identifier`
+// for `state` on message with `messageID` from user in private chat
+func testCallback(t *testing.T, updateID int, userID int64, messageID int, state SessionState, identifier string) Update {
+
+	t.Helper()
+
+	data, err := callbackDataGen(state, identifier)
+	if err != nil {
+		t.Fatalf("callback data gen error: %v", err)
+	}
+
+	return Update{
+		UpdateID: updateID,
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:   "query",
+			From: &tgbotapi.User{ID: userID},
+			Message: &tgbotapi.Message{
+				MessageID: messageID,
+				Chat:      &tgbotapi.Chat{ID: userID, Type: "private"},
+			},
+			Data: data,
+		},
+	}
+}
+
+// testButtonData gets callback data of the first button of the keyboard
+// attached to the last message sent by bot
+func testButtonData(t *testing.T, bot *Telegram) string {
+
+	t.Helper()
+
+	r := testSent(bot, "sendMessage")
+	if len(r) == 0 {
+		t.Fatal("no messages sent")
+	}
+
+	var ikm tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(r[len(r)-1].Params["reply_markup"]), &ikm); err != nil {
+		t.Fatalf("reply markup unmarshal error: %v", err)
+	}
+
+	if len(ikm.InlineKeyboard) == 0 || len(ikm.InlineKeyboard[0]) == 0 || ikm.InlineKeyboard[0][0].CallbackData == nil {
+		t.Fatalf("message has no callback buttons: %+v", ikm)
+	}
+
+	return *ikm.InlineKeyboard[0][0].CallbackData
+}
+
+// testSent gets requests with specified method recorded in dry-run mode
+func testSent(bot *Telegram, method string) []Recorded {
+
+	var r []Recorded
+
+	for _, e := range bot.SentRequests() {
+		if e.Method == method {
+			r = append(r, e)
+		}
+	}
+
+	return r
+}
+
+// testRoundTripper it is a HTTP transport replying with specified function
+type testRoundTripper func(req *http.Request) (*http.Response, error)
+
+func (f testRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// testResponse makes Telegram Bot API response with specified status and body
+func testResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+// testBotInitHTTP initializes a bot with in-memory Redis and Telegram Bot API
+// replying with `reply` for requests. If `reply` returns nil response and
+// error, request is replied the same way as in dry-run mode
+func testBotInitHTTP(t *testing.T, s Settings, d Description, reply func(method string, req *http.Request) (*http.Response, error)) *Telegram {
+
+	t.Helper()
+
+	m := miniredis.RunT(t)
+
+	dr := &dryRunClient{}
+
+	s.RedisHost = m.Addr()
+	s.BotSettings.BotAPI = "1:test"
+	s.HTTPClient = &http.Client{
+		Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+			resp, err := reply(path.Base(req.URL.Path), req)
+			if resp == nil && err == nil {
+				return dr.Do(req)
+			}
+			return resp, err
+		}),
+	}
+
+	bot, err := Init(s, d, nil)
+	if err != nil {
+		t.Fatalf("bot init error: %v", err)
+	}
+
+	return &bot
+}
+
+// testSendError makes Telegram Bot API error response for send requests
+// to `chatID`. Returns nil for other requests
+func testSendError(method string, req *http.Request, chatID string, code int, description string) *http.Response {
+
+	if strings.HasPrefix(method, "send") == false {
+		return nil
+	}
+
+	if err := req.ParseForm(); err != nil || req.PostForm.Get("chat_id") != chatID {
+		return nil
+	}
+
+	return testResponse(req, code, fmt.Sprintf(`{"ok":false,"error_code":%d,"description":%q}`, code, description))
+}
+
+// testLogger it is a Logger sending messages into channel
+type testLogger chan string
+
+func (l testLogger) Println(v ...interface{}) {
+	l <- fmt.Sprintln(v...)
+}
+
+func (l testLogger) Printf(format string, v ...interface{}) {
+	l <- fmt.Sprintf(format, v...)
+}
+
+func TestGetUpdatesOffset(t *testing.T) {
+
+	var calls int32
+
+	offsets := make(chan string, 2)
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+
+		if method != "getUpdates" {
+			return nil, nil
+		}
+
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		offsets <- req.PostForm.Get("offset")
+
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return testResponse(req, http.StatusOK, `{"ok":true,"result":[`+
+				`{"update_id":5,"message":{"message_id":1,"date":0,"chat":{"id":1,"type":"private"},"from":{"id":1},"text":"a"}},`+
+				`{"update_id":6,"message":{"message_id":2,"date":0,"chat":{"id":1,"type":"private"},"from":{"id":1},"text":"b"}}]}`), nil
+		}
+
+		// Long polling request is pending until cancelled
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.GetUpdates(ctx)
+	}()
+
+	// Zero offset is omitted
+	if o := <-offsets; o != "" {
+		t.Fatalf("wrong first offset: %s", o)
+	}
+	if o := <-offsets; o != "7" {
+		t.Fatalf("wrong next offset: %s", o)
+	}
+	if o := bot.UpdatesOffsetGet(); o != 7 {
+		t.Fatalf("wrong poller offset: %d", o)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("get updates error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending request has not been cancelled")
+	}
+}
+
+func TestGetUpdatesNonRetryable(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if method != "getUpdates" {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusConflict, `{"ok":false,"error_code":409,"description":"Conflict: terminated by other getUpdates request"}`), nil
+	})
+
+	err := bot.GetUpdates(context.Background())
+	if e := apiErrorGet(err); e == nil || e.Code != http.StatusConflict {
+		t.Fatalf("get updates must fail with conflict, got: %v", err)
+	}
+}
+
+func TestGetUpdatesLogError(t *testing.T) {
+
+	l := make(testLogger, 1)
+
+	bot := testBotInitHTTP(t, Settings{Logger: l}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if method != "getUpdates" {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusBadGateway, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`), nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.GetUpdates(ctx)
+	}()
+
+	if m := <-l; strings.Contains(m, "Bad Gateway") == false {
+		t.Fatalf("wrong logged message: %s", m)
+	}
+
+	// Retryable error must not stop polling
+	select {
+	case err := <-done:
+		t.Fatalf("get updates stopped on retryable error: %v", err)
+	default:
+	}
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Fatalf("get updates error: %v", err)
+	}
+}
+
+func TestSentHandler(t *testing.T) {
+
+	var sent [][]MessageSent
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		SentHandler: func(t *Telegram, messages []MessageSent) {
+			sent = append(sent, messages)
+		},
+	})
+
+	ms, err := bot.SendMessage(1, 0, SendMessageData{Message: "direct"})
+	if err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	if len(sent) != 1 || len(sent[0]) != 1 || sent[0][0].MessageID != ms[0].MessageID {
+		t.Fatalf("sent handler must be called for direct send: %+v", sent)
+	}
+}
+
+// TestDownloadSizeLimit checks file size is checked before download
+func TestDownloadSizeLimit(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{MaxDownloadSize: 10}, Description{})
+
+	_, err := bot.DownloadFileStream(File{
+		FileSize: 100,
+		FileName: "big.bin",
+		f:        tgbotapi.File{FilePath: "documents/big.bin"},
+	})
+	if errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+}
+
+// TestDownloadSizeLimitStream checks download is cut off when file
+// stream exceeds the limit (file size is unknown beforehand)
+func TestDownloadSizeLimitStream(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file/bot1:test/documents/big.bin" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(strings.Repeat("a", 100)))
+	}))
+	defer srv.Close()
+
+	bot := testBotInit(t, nil, Settings{
+		BotSettings:     SettingsBot{BotAPI: "1:test"},
+		APIEndpoint:     srv.URL + "/bot%s/%s",
+		MaxDownloadSize: 10,
+	}, Description{})
+
+	f := File{
+		FileName: "big.bin",
+		f:        tgbotapi.File{FilePath: "documents/big.bin"},
+	}
+
+	s, err := bot.DownloadFileStream(f)
+	if err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := io.ReadAll(s); errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+
+	// Partially downloaded file must be removed
+	dst := path.Join(t.TempDir(), "big.bin")
+	if err := bot.DownloadFile(f, dst); errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+	if _, err := os.Stat(dst); os.IsNotExist(err) == false {
+		t.Fatalf("expected partially downloaded file to be removed, got %v", err)
+	}
+}
+
+// testUpload uploads file with specified options and gets the recorded request
+func testUpload(t *testing.T, file FileSendStream) Recorded {
+
+	t.Helper()
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if _, err := bot.UploadFileStream(1, file, strings.NewReader("data")); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+
+	method, _ := fileMethodGet(file.FileType)
+
+	r := testSent(bot, method)
+	if len(r) != 1 {
+		t.Fatalf("expected one %s request, got %d", method, len(r))
+	}
+
+	return r[0]
+}
+
+// TestUploadThumbnail checks thumbnail is uploaded with video
+func TestUploadThumbnail(t *testing.T) {
+
+	r := testUpload(t, FileSendStream{
+		FileType:      FileTypeVideo,
+		FileName:      "video.mp4",
+		Thumbnail:     strings.NewReader("thumb"),
+		ThumbnailName: "preview.jpg",
+	})
+
+	if fmt.Sprint(r.Files) != "[thumb video]" {
+		t.Fatalf("expected uploaded files [thumb video], got %v", r.Files)
+	}
+}
+
+// TestSendFileIDURL checks files are sent by file ID or URL without upload
+func TestSendFileIDURL(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if _, err := bot.SendFileID(1, FileTypePhoto, "AgACAgIAAxkBAAI", "by id"); err != nil {
+		t.Fatalf("send file ID error: %v", err)
+	}
+
+	if _, err := bot.SendFileURL(1, FileTypeDocument, "https://example.com/doc.pdf", "by url"); err != nil {
+		t.Fatalf("send file URL error: %v", err)
+	}
+
+	for _, c := range []struct {
+		method string
+		field  string
+		value  string
+		cap    string
+	}{
+		{"sendPhoto", "photo", "AgACAgIAAxkBAAI", "by id"},
+		{"sendDocument", "document", "https://example.com/doc.pdf", "by url"},
+	} {
+
+		r := testSent(bot, c.method)
+		if len(r) != 1 {
+			t.Fatalf("expected one %s request, got %d", c.method, len(r))
+		}
+
+		if len(r[0].Files) != 0 {
+			t.Fatalf("%s: expected no uploaded files, got %v", c.method, r[0].Files)
+		}
+		if r[0].Params[c.field] != c.value {
+			t.Fatalf("%s: expected %s `%s`, got `%s`", c.method, c.field, c.value, r[0].Params[c.field])
+		}
+		if r[0].Params["caption"] != c.cap {
+			t.Fatalf("%s: expected caption `%s`, got `%s`", c.method, c.cap, r[0].Params["caption"])
+		}
+	}
+}
+
+// TestUploadDimensions checks video dimensions and duration are sent
+// and zero values are omitted
+func TestUploadDimensions(t *testing.T) {
+
+	r := testUpload(t, FileSendStream{
+		FileType: FileTypeVideo,
+		FileName: "video.mp4",
+		Width:    1280,
+		Height:   720,
+		Duration: 42,
+	})
+
+	for k, v := range map[string]string{"width": "1280", "height": "720", "duration": "42"} {
+		if r.Params[k] != v {
+			t.Fatalf("expected %s `%s`, got `%s`", k, v, r.Params[k])
+		}
+	}
+
+	r = testUpload(t, FileSendStream{
+		FileType: FileTypeAudio,
+		FileName: "audio.mp3",
+		Duration: 180,
+	})
+
+	if r.Params["duration"] != "180" {
+		t.Fatalf("expected duration `180`, got `%s`", r.Params["duration"])
+	}
+
+	r = testUpload(t, FileSendStream{
+		FileType: FileTypeVoice,
+		FileName: "voice.ogg",
+	})
+
+	for _, k := range []string{"width", "height", "duration"} {
+		if _, b := r.Params[k]; b == true {
+			t.Fatalf("expected %s to be omitted, got `%s`", k, r.Params[k])
+		}
+	}
+}
+
+// TestUploadSupportsStreaming checks streaming flag is sent with video
+func TestUploadSupportsStreaming(t *testing.T) {
+
+	r := testUpload(t, FileSendStream{
+		FileType:          FileTypeVideo,
+		FileName:          "video.mp4",
+		SupportsStreaming: true,
+	})
+
+	if r.Params["supports_streaming"] != "true" {
+		t.Fatalf("expected supports_streaming `true`, got `%s`", r.Params["supports_streaming"])
+	}
+}
+
+// TestUploadSpoiler checks spoiler flag is sent with photo and video
+func TestUploadSpoiler(t *testing.T) {
+
+	for _, ft := range []FileType{FileTypePhoto, FileTypeVideo} {
+
+		r := testUpload(t, FileSendStream{
+			FileType: ft,
+			FileName: "media",
+			Spoiler:  true,
+		})
+
+		if r.Params["has_spoiler"] != "true" {
+			t.Fatalf("%s: expected has_spoiler `true`, got `%s`", ft, r.Params["has_spoiler"])
+		}
+	}
+}
+
+// TestButtonSwitchCurrent checks button inserts inline query in the current chat
+func TestButtonSwitchCurrent(t *testing.T) {
+
+	ikm, err := keyboardPrepare([][]Button{
+		{
+			{
+				Text:       "Search",
+				Identifier: "query",
+				Mode:       ButtonModeSwitchCurrent,
+			},
+		},
+	}, SessState("menu"))
+	if err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	b := ikm.InlineKeyboard[0][0]
+	if b.SwitchInlineQueryCurrentChat == nil || *b.SwitchInlineQueryCurrentChat != "query" {
+		t.Fatalf("expected switch_inline_query_current_chat `query`, got %v", b.SwitchInlineQueryCurrentChat)
+	}
+	if b.SwitchInlineQuery != nil || b.CallbackData != nil {
+		t.Fatalf("unexpected button fields: %+v", b)
+	}
+}
+
+// TestButtonURL checks URL buttons take plain URL as identifier
+func TestButtonURL(t *testing.T) {
+
+	ikm, err := keyboardPrepare([][]Button{
+		{
+			{
+				Text:       "Open",
+				Identifier: "https://example.com/path?q=1&lang=en",
+				Mode:       ButtonModeURL,
+			},
+		},
+	}, SessState("menu"))
+	if err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	b := ikm.InlineKeyboard[0][0]
+	if b.URL == nil || *b.URL != "https://example.com/path?q=1&lang=en" {
+		t.Fatalf("wrong button URL: %v", b.URL)
+	}
+	if b.CallbackData != nil {
+		t.Fatalf("URL button must have no callback data: %s", *b.CallbackData)
+	}
+}
+
+// TestButtonURLSend checks URL buttons are sent the same way with messages and files
+func TestButtonURLSend(t *testing.T) {
+
+	const url = "https://example.com/path?q=1"
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	buttons := [][]Button{
+		{
+			{Text: "Open", Identifier: url, Mode: ButtonModeURL},
+			{Text: "OK", Identifier: "ok"},
+		},
+	}
+
+	if _, err := bot.SendMessage(1, 0, SendMessageData{
+		Message:     "message",
+		Buttons:     buttons,
+		ButtonState: SessState("menu"),
+	}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	if _, err := bot.UploadFileStream(1, FileSendStream{
+		FileType:    FileTypeDocument,
+		FileName:    "doc.txt",
+		Buttons:     buttons,
+		ButtonState: SessState("menu"),
+	}, strings.NewReader("data")); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+
+	for _, method := range []string{"sendMessage", "sendDocument"} {
+
+		r := testSent(bot, method)
+		if len(r) != 1 {
+			t.Fatalf("expected one %s request, got %d", method, len(r))
+		}
+
+		var ikm tgbotapi.InlineKeyboardMarkup
+		if err := json.Unmarshal([]byte(r[0].Params["reply_markup"]), &ikm); err != nil {
+			t.Fatalf("%s: reply markup unmarshal error: %v", method, err)
+		}
+
+		bs := ikm.InlineKeyboard[0]
+		if bs[0].URL == nil || *bs[0].URL != url {
+			t.Fatalf("%s: wrong button URL: %v", method, bs[0].URL)
+		}
+		if bs[1].CallbackData == nil {
+			t.Fatalf("%s: data button must have callback data", method)
+		}
+	}
+}
+
+// TestBotDescriptions checks bot profile descriptions are set at init
+func TestBotDescriptions(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		BotDescriptions: []BotDescription{
+			{
+				Description:      "Shop bot",
+				ShortDescription: "Shop",
+			},
+			{
+				LanguageCode:     "ru",
+				Description:      "Бот магазина",
+				ShortDescription: "Магазин",
+			},
+		},
+	})
+
+	var r []string
+	for _, method := range []string{"setMyDescription", "setMyShortDescription"} {
+		for _, e := range testSent(bot, method) {
+			r = append(r, fmt.Sprintf("%s:%s:%s%s", method, e.Params["language_code"], e.Params["description"], e.Params["short_description"]))
+		}
+	}
+
+	if fmt.Sprint(r) != "[setMyDescription::Shop bot setMyDescription:ru:Бот магазина setMyShortDescription::Shop setMyShortDescription:ru:Магазин]" {
+		t.Fatalf("wrong bot descriptions requests: %v", r)
+	}
+}
+
+// TestBotDescriptionsEmpty checks no descriptions requests are made if not set
+func TestBotDescriptionsEmpty(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if n := len(testSent(bot, "setMyDescription")) + len(testSent(bot, "setMyShortDescription")); n != 0 {
+		t.Fatalf("expected no descriptions requests, got %d", n)
+	}
+}
+
+// TestCallbackAnswerManual checks callback queries are not answered
+// implicitly during absorb if manual answer is enabled
+func TestCallbackAnswerManual(t *testing.T) {
+
+	for _, manual := range []bool{true, false} {
+
+		bot := testBotInit(t, nil, Settings{
+			CallbackAnswerManual: manual,
+			UpdateQueueWait:      time.Minute,
+		}, Description{
+			States: map[SessionState]State{
+				SessState("menu"): {
+					CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+						return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+					},
+				},
+			},
+		})
+
+		if err := bot.UpdateAbsorb(testCallback(t, 1, 42, 10, SessState("menu"), "x")); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+
+		n := len(testSent(bot, "answerCallbackQuery"))
+
+		if manual == true && n != 0 {
+			t.Fatalf("callback must not be answered with manual answer enabled, got %d answers", n)
+		}
+		if manual == false && n != 1 {
+			t.Fatalf("callback must be answered implicitly, got %d answers", n)
+		}
+	}
+}
+
+// TestCallbackAnswerManualHandler checks handler owns the callback answer
+func TestCallbackAnswerManualHandler(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{CallbackAnswerManual: true}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					if err := t.CallbackAnswer(s.UpdateChain().CallbackQueryIDGet(), "Not allowed", true); err != nil {
+						return CallbackHandlerRes{}, err
+					}
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ProcessUpdate(testCallback(t, 1, 42, 10, SessState("menu"), "x")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	a := testSent(bot, "answerCallbackQuery")
+	if len(a) != 1 || a[0].Params["text"] != "Not allowed" || a[0].Params["show_alert"] != "true" {
+		t.Fatalf("wrong callback answers: %+v", a)
+	}
+}
+
+// TestSelf checks bot info received at init is returned
+func TestSelf(t *testing.T) {
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		if method != "getMe" {
+			return nil, nil
+		}
+		return testResponse(req, http.StatusOK, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Shop","username":"shop_bot","can_join_groups":true,"supports_inline_queries":true}}`), nil
+	})
+
+	u := bot.Self()
+	if u.ID != 1 || u.UserName != "shop_bot" || u.FirstName != "Shop" {
+		t.Fatalf("wrong bot info: %+v", u)
+	}
+	if u.CanJoinGroups == false || u.CanReadAllGroupMessages == true || u.SupportsInlineQueries == false {
+		t.Fatalf("wrong bot capabilities: %+v", u)
+	}
+	if bot.SelfIDGet() != u.ID {
+		t.Fatalf("wrong bot ID: %d", bot.SelfIDGet())
+	}
+}
+
+// TestUploadThumbnailSpoiler checks both thumbnail and spoiler
+// are applied to the same upload
+func TestUploadThumbnailSpoiler(t *testing.T) {
+
+	r := testUpload(t, FileSendStream{
+		FileType:  FileTypeVideo,
+		FileName:  "video.mp4",
+		Thumbnail: strings.NewReader("thumb"),
+		Spoiler:   true,
+	})
+
+	if fmt.Sprint(r.Files) != "[thumb video]" || r.Params["has_spoiler"] != "true" {
+		t.Fatalf("expected thumbnail and spoiler for video, got files %v, params %v", r.Files, r.Params)
+	}
+
+	// Photos have no thumbnails
+	r = testUpload(t, FileSendStream{
+		FileType:  FileTypePhoto,
+		FileName:  "photo.jpg",
+		Thumbnail: strings.NewReader("thumb"),
+		Spoiler:   true,
+	})
+
+	if fmt.Sprint(r.Files) != "[photo]" || r.Params["has_spoiler"] != "true" {
+		t.Fatalf("expected spoiler only for photo, got files %v, params %v", r.Files, r.Params)
+	}
+}
+
+// TestProcessUpdate checks update is processed immediately
+// by the full pipeline bypassing the queue
+func TestProcessUpdate(t *testing.T) {
+
+	var (
+		item          string
+		stateMessages []string
+	)
+
+	bot := testBotInit(t, nil, Settings{UpdateQueueWait: time.Minute}, Description{
+		Commands: []Command{
+			{
+				Command: "order",
+				Handler: func(t *Telegram, s *Session, cmd string, args string) (CommandHandlerRes, error) {
+					item = args
+					return CommandHandlerRes{NextState: SessState("confirm")}, nil
+				},
+			},
+		},
+		States: map[SessionState]State{
+			SessState("confirm"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{Message: "Confirm order of " + item + "?"}, nil
+				},
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					stateMessages = append(stateMessages, s.UpdateChain().LastMessageText())
+					return MessageHandlerRes{NextState: SessStateDestroy()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ProcessUpdate(testCommand(1, 42, "/order pizza")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 1 || r[0].Params["chat_id"] != "42" || r[0].Params["text"] != "Confirm order of pizza?" {
+		t.Fatalf("wrong sent messages: %+v", r)
+	}
+
+	// Session is switched into the new state
+	if err := bot.ProcessUpdate(testMessage(2, 42, "yes")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+	if fmt.Sprint(stateMessages) != "[yes]" {
+		t.Fatalf("wrong messages processed in state: %v", stateMessages)
+	}
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 0 || qs.Updates != 0 {
+		t.Fatalf("queue must not be used: %+v", qs)
+	}
+}
+
+// TestHTTPClient checks specified HTTP client is used for requests to Telegram
+func TestHTTPClient(t *testing.T) {
+
+	var methods []string
+
+	bot := testBotInitHTTP(t, Settings{}, Description{}, func(method string, req *http.Request) (*http.Response, error) {
+		methods = append(methods, method)
+		return nil, nil
+	})
+
+	if _, err := bot.SendMessage(1, 0, SendMessageData{Message: "hello"}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	if fmt.Sprint(methods) != "[getMe deleteWebhook setMyCommands sendMessage]" {
+		t.Fatalf("wrong requests made via client: %v", methods)
+	}
+}
+
+// TestHTTPClientProxy checks proxy is applied to a copy of specified HTTP client
+func TestHTTPClientProxy(t *testing.T) {
+
+	// Address with no proxy listening
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	l.Close()
+
+	p := &SettingsBotProxy{
+		Type: "socks5",
+		Host: l.Addr().String(),
+	}
+
+	tr := &http.Transport{MaxIdleConns: 7}
+	client := &http.Client{
+		Transport: tr,
+		Timeout:   7 * time.Second,
+	}
+
+	// Connection fails as there is no proxy, but client must stay intact
+	if _, err := botConnect("1:test", tgbotapi.APIEndpoint, p, client); err == nil {
+		t.Fatalf("bot must not be connected without proxy")
+	}
+
+	if client.Transport != tr || tr.Dial != nil {
+		t.Fatalf("specified client must not be modified")
+	}
+
+	_, err = botConnect("1:test", tgbotapi.APIEndpoint, p, &http.Client{Transport: testRoundTripper(nil)})
+	if err == nil || strings.Contains(err.Error(), "custom HTTP client transport") == false {
+		t.Fatalf("expected error for custom transport with proxy, got %v", err)
+	}
+}
+
+// TestAPIEndpoint checks requests and file downloads are made to specified
+// Bot API endpoint, and local Bot API server files are read from disk
+func TestAPIEndpoint(t *testing.T) {
+
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/api/bot1:test/getMe":
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"username":"local_bot"}}`))
+		case "/api/file/bot1:test/documents/remote.txt":
+			w.Write([]byte("remote"))
+		default:
+			w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	local := path.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(local, []byte("local"), 0600); err != nil {
+		t.Fatalf("write file error: %v", err)
+	}
+
+	bot, err := Init(Settings{
+		BotSettings:  SettingsBot{BotAPI: "1:test"},
+		RedisHost:    miniredis.RunT(t).Addr(),
+		APIEndpoint:  srv.URL + "/api/bot%s/%s",
+		LocalAPIMode: true,
+	}, Description{}, nil)
+	if err != nil {
+		t.Fatalf("bot init error: %v", err)
+	}
+
+	if bot.Self().UserName != "local_bot" {
+		t.Fatalf("wrong bot info: %+v", bot.Self())
+	}
+
+	for _, c := range []struct {
+		path     string
+		expected string
+	}{
+		{"documents/remote.txt", "remote"},
+		{local, "local"},
+	} {
+
+		s, err := bot.DownloadFileStream(File{f: tgbotapi.File{FilePath: c.path}})
+		if err != nil {
+			t.Fatalf("download `%s` error: %v", c.path, err)
+		}
+
+		b, err := io.ReadAll(s)
+		s.Close()
+		if err != nil || string(b) != c.expected {
+			t.Fatalf("wrong `%s` content: `%s` (%v)", c.path, b, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if fmt.Sprint(paths) != "[/api/bot1:test/getMe /api/bot1:test/deleteWebhook /api/bot1:test/setMyCommands /api/file/bot1:test/documents/remote.txt]" {
+		t.Fatalf("wrong requested paths: %v", paths)
+	}
+}
+
+// TestAPIEndpointFormat checks endpoint without verbs is rejected
+func TestAPIEndpointFormat(t *testing.T) {
+
+	_, err := Init(Settings{
+		BotSettings: SettingsBot{BotAPI: "1:test"},
+		RedisHost:   miniredis.RunT(t).Addr(),
+		APIEndpoint: "http://localhost:8081/",
+		DryRun:      true,
+	}, Description{}, nil)
+	if errors.Is(err, ErrAPIEndpointFormat) == false {
+		t.Fatalf("expected error %v, got %v", ErrAPIEndpointFormat, err)
+	}
+}
+
+// TestDownloadLocalAPIMode checks absolute file paths are read
+// from disk in local mode only
+func TestDownloadLocalAPIMode(t *testing.T) {
+
+	dir := t.TempDir()
+
+	local := path.Join(dir, "local.txt")
+	if err := os.WriteFile(local, []byte(strings.Repeat("a", 100)), 0600); err != nil {
+		t.Fatalf("write file error: %v", err)
+	}
+
+	var requested []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		w.Write([]byte("remote"))
+	}))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		localMode bool
+		path      string
+		content   string
+		err       bool
+	}{
+		{true, local, strings.Repeat("a", 100), false},
+		{false, local, "remote", false},
+		{true, path.Join(dir, "missing.txt"), "", true},
+	} {
+
+		bot := testBotInit(t, nil, Settings{
+			BotSettings:  SettingsBot{BotAPI: "1:test"},
+			APIEndpoint:  srv.URL + "/bot%s/%s",
+			LocalAPIMode: c.localMode,
+		}, Description{})
+
+		s, err := bot.DownloadFileStream(File{f: tgbotapi.File{FilePath: c.path}})
+		if c.err == true {
+			if err == nil {
+				s.Close()
+				t.Fatalf("expected error for `%s`", c.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("download `%s` error: %v", c.path, err)
+		}
+
+		b, err := io.ReadAll(s)
+		s.Close()
+		if err != nil || string(b) != c.content {
+			t.Fatalf("wrong `%s` content (local mode %t): `%s` (%v)", c.path, c.localMode, b, err)
+		}
+	}
+
+	// Only the file in non-local mode is downloaded over HTTP
+	if fmt.Sprint(requested) != "[/file/bot1:test/"+local+"]" {
+		t.Fatalf("wrong downloaded paths: %v", requested)
+	}
+
+	// Local files are limited the same way
+	bot := testBotInit(t, nil, Settings{
+		LocalAPIMode:    true,
+		MaxDownloadSize: 10,
+	}, Description{})
+
+	s, err := bot.DownloadFileStream(File{f: tgbotapi.File{FilePath: local}})
+	if err != nil {
+		t.Fatalf("download error: %v", err)
+	}
+	defer s.Close()
+
+	if _, err := io.ReadAll(s); errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+}
+
+// testHealthErrs gets dependencies mentioned in health check error
+func testHealthErrs(err error) []string {
+
+	var r []string
+
+	for _, e := range []string{"redis:", "telegram:"} {
+		if strings.Contains(err.Error(), e) == true {
+			r = append(r, e)
+		}
+	}
+
+	return r
+}
+
+// TestHealthCheck checks both Redis and Telegram availability is checked
+func TestHealthCheck(t *testing.T) {
+
+	var telegramDown int32
+
+	m := miniredis.RunT(t)
+	dr := &dryRunClient{}
+
+	bot, err := Init(Settings{
+		BotSettings: SettingsBot{BotAPI: "1:test"},
+		RedisHost:   m.Addr(),
+		HTTPClient: &http.Client{
+			Transport: testRoundTripper(func(req *http.Request) (*http.Response, error) {
+				if atomic.LoadInt32(&telegramDown) == 1 {
+					return testResponse(req, http.StatusBadGateway, `{"ok":false,"error_code":502,"description":"Bad Gateway"}`), nil
+				}
+				return dr.Do(req)
+			}),
+		},
+	}, Description{}, nil)
+	if err != nil {
+		t.Fatalf("bot init error: %v", err)
+	}
+
+	for _, c := range []struct {
+		redisDown    bool
+		telegramDown bool
+		errs         []string
+	}{
+		{false, false, nil},
+		{true, false, []string{"redis:"}},
+		{false, true, []string{"telegram:"}},
+		{true, true, []string{"redis:", "telegram:"}},
+	} {
+
+		m.SetError("")
+		if c.redisDown == true {
+			m.SetError("LOADING Redis is loading the dataset in memory")
+		}
+
+		atomic.StoreInt32(&telegramDown, 0)
+		if c.telegramDown == true {
+			atomic.StoreInt32(&telegramDown, 1)
+		}
+
+		err := bot.HealthCheck(context.Background())
+
+		if len(c.errs) == 0 {
+			if err != nil {
+				t.Fatalf("health check must pass, got: %v", err)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Fatalf("health check must fail (redis down %t, telegram down %t)", c.redisDown, c.telegramDown)
+		}
+
+		// Error contains failed dependencies only
+		if fmt.Sprint(testHealthErrs(err)) != fmt.Sprint(c.errs) {
+			t.Fatalf("health check error must contain %v, got: %v", c.errs, err)
+		}
+	}
+}
+
+func TestDebug(t *testing.T) {
+
+	token := "123456789:" + strings.Repeat("A", 35)
+
+	// Debug logger is global for Telegram Bot API package
+	t.Cleanup(func() {
+		tgbotapi.SetLogger(log.New(os.Stderr, "", log.LstdFlags))
+	})
+
+	for _, debug := range []bool{false, true} {
+
+		logs := make(testLogger, 64)
+
+		bot := testBotInit(t, nil, Settings{
+			BotSettings: SettingsBot{BotAPI: token},
+			Debug:       debug,
+			Logger:      logs,
+		}, Description{})
+
+		if bot.bot.Debug != debug {
+			t.Fatalf("wrong Bot API debug mode: expected %t, got %t", debug, bot.bot.Debug)
+		}
+
+		// Token leaked into message text must not be written into logs
+		if _, err := bot.SendMessage(1, 0, SendMessageData{Message: "token " + token}); err != nil {
+			t.Fatalf("send message error: %v", err)
+		}
+		close(logs)
+
+		var sent bool
+		for l := range logs {
+			if strings.Contains(l, "123456789:") == true {
+				t.Fatalf("bot token must be redacted in logs: %s", l)
+			}
+			if strings.Contains(l, "sendMessage") == true && strings.Contains(l, tokenRedacted) == true {
+				sent = true
+			}
+		}
+		if sent != debug {
+			t.Fatalf("wrong requests logging in debug mode %t", debug)
+		}
+	}
+}
+
+func TestUnknownUpdateHandler(t *testing.T) {
+
+	var (
+		unknown []int
+		inits   int
+	)
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			inits++
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		UnknownUpdateHandler: func(t *Telegram, update Update) {
+			unknown = append(unknown, update.UpdateID)
+		},
+	})
+
+	poll := func(updateID int) Update {
+		return Update{
+			UpdateID: updateID,
+			Poll:     &tgbotapi.Poll{ID: "poll", Question: "?"},
+		}
+	}
+
+	if err := bot.UpdateAbsorb(poll(1)); err != nil {
+		t.Fatalf("absorb error: %v", err)
+	}
+	if err := bot.ProcessUpdate(poll(2)); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	// Handler is not called for known updates
+	if err := bot.ProcessUpdate(testMessage(3, 1, "hello")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if fmt.Sprint(unknown) != "[1 2]" || inits != 1 {
+		t.Fatalf("wrong unknown updates: %v (inits %d)", unknown, inits)
+	}
+
+	// Unknown updates are not queued
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 0 || qs.Updates != 0 {
+		t.Fatalf("queue must be empty: %+v", qs)
+	}
+}
@@ -0,0 +1,53 @@
+package tg
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Templates contains a set of message templates.
+// Templates may contain named placeholders in `{name}` format
+// that are replaced with values from message variables
+type Templates struct {
+
+	// DefaultLang defines a language used if template
+	// is not found for requested one
+	DefaultLang string
+
+	// Texts contains templates texts. First map key it's a
+	// language code, second one it's a template name
+	Texts map[string]map[string]string
+}
+
+// Render renders specified template for `lang` language with variables `vars`
+func (tpl *Templates) Render(name, lang string, vars map[string]string) (string, error) {
+
+	text, b := tpl.Texts[lang][name]
+	if b == false {
+		text, b = tpl.Texts[tpl.DefaultLang][name]
+		if b == false {
+			return "", fmt.Errorf("%w: `%s`", ErrTemplateNotFound, name)
+		}
+	}
+
+	if len(vars) == 0 {
+		return text, nil
+	}
+
+	var r []string
+	for k, v := range vars {
+		r = append(r, "{"+k+"}", v)
+	}
+
+	return strings.NewReplacer(r...).Replace(text), nil
+}
+
+// templateRender renders specified template with templates set from bot settings
+func (t *Telegram) templateRender(name, lang string, vars map[string]string) (string, error) {
+
+	if t.templates == nil {
+		return "", fmt.Errorf("%w: `%s`", ErrTemplateNotFound, name)
+	}
+
+	return t.templates.Render(name, lang, vars)
+}
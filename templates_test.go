@@ -0,0 +1,154 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// testTemplates is a templates set used in tests
+var testTemplates = &Templates{
+	DefaultLang: "en",
+	Texts: map[string]map[string]string{
+		"en": {
+			"hello": "Hello, {name}! You have {count} messages",
+			"bye":   "Bye",
+		},
+		"ru": {
+			"hello": "Привет, {name}! Сообщений: {count}",
+		},
+	},
+}
+
+func TestTemplatesRender(t *testing.T) {
+
+	vars := map[string]string{
+		"name":  "John",
+		"count": "3",
+	}
+
+	for _, c := range []struct {
+		name     string
+		lang     string
+		expected string
+	}{
+		{"hello", "en", "Hello, John! You have 3 messages"},
+		{"hello", "ru", "Привет, John! Сообщений: 3"},
+		{"hello", "de", "Hello, John! You have 3 messages"},
+		{"bye", "ru", "Bye"},
+	} {
+		text, err := testTemplates.Render(c.name, c.lang, vars)
+		if err != nil {
+			t.Fatalf("render error: %v", err)
+		}
+		if text != c.expected {
+			t.Fatalf("wrong rendered template `%s` (%s): %s", c.name, c.lang, text)
+		}
+	}
+
+	if _, err := testTemplates.Render("unknown", "en", nil); errors.Is(err, ErrTemplateNotFound) == false {
+		t.Fatalf("expected error %v, got %v", ErrTemplateNotFound, err)
+	}
+}
+
+func TestSendMessageTemplate(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{Templates: testTemplates}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("greet")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("greet"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Template: "hello",
+						Vars: map[string]string{
+							"name":  "John",
+							"count": "1",
+						},
+						NextState: SessStateBreak(),
+					}, nil
+				},
+			},
+		},
+	})
+
+	// State handler message is rendered from template
+	testProcess(t, bot, testMessage(1, 1, "hi"))
+
+	if _, err := bot.SendMessage(1, 0, SendMessageData{
+		Template: "hello",
+		Lang:     "ru",
+		Vars: map[string]string{
+			"name":  "John",
+			"count": "2",
+		},
+	}); err != nil {
+		t.Fatalf("send message error: %v", err)
+	}
+
+	var texts []string
+	for _, r := range testSent(bot, "sendMessage") {
+		texts = append(texts, r.Params["text"])
+	}
+	if fmt.Sprint(texts) != "[Hello, John! You have 1 messages Привет, John! Сообщений: 2]" {
+		t.Fatalf("wrong sent messages: %v", texts)
+	}
+}
+
+func TestStateTemplateLanguage(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{Templates: testTemplates}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("greet")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("greet"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Template: "hello",
+						Vars: map[string]string{
+							"name":  s.UserFirstNameGet(),
+							"count": "1",
+						},
+						NextState: SessStateBreak(),
+					}, nil
+				},
+			},
+		},
+	})
+
+	// Template is rendered in session user language
+	for i, lang := range []string{"ru", "de"} {
+
+		u := testMessage(i+1, int64(i+1), "hi")
+		u.Message.From.FirstName = "John"
+		u.Message.From.LanguageCode = lang
+
+		testProcess(t, bot, u)
+	}
+
+	var texts []string
+	for _, r := range testSent(bot, "sendMessage") {
+		texts = append(texts, r.Params["text"])
+	}
+	if fmt.Sprint(texts) != "[Привет, John! Сообщений: 1 Hello, John! You have 1 messages]" {
+		t.Fatalf("wrong sent messages: %v", texts)
+	}
+}
+
+func TestSendMessageTemplateNotFound(t *testing.T) {
+
+	for _, tpl := range []*Templates{testTemplates, nil} {
+
+		bot := testBotInit(t, nil, Settings{Templates: tpl}, Description{})
+
+		if _, err := bot.SendMessage(1, 0, SendMessageData{Template: "unknown"}); errors.Is(err, ErrTemplateNotFound) == false {
+			t.Fatalf("expected error %v, got %v", ErrTemplateNotFound, err)
+		}
+
+		if r := testSent(bot, "sendMessage"); len(r) != 0 {
+			t.Fatalf("message must not be sent: %+v", r)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package tg
+
+import (
+	"testing"
+)
+
+func TestButtonToastSpecialStates(t *testing.T) {
+
+	for _, c := range []struct {
+		state   SessionState
+		toast   string
+		destroy bool
+	}{
+		{SessStateDestroy(), "Cancelled", true},
+		{SessStateBreak(), "Done", false},
+	} {
+
+		var inits, messages int
+
+		bot := testBotInit(t, nil, Settings{}, Description{
+			InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+				inits++
+				return InitHandlerRes{NextState: SessStateBreak()}, nil
+			},
+			States: map[SessionState]State{
+				SessState("menu"): {
+					MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+						messages++
+						return MessageHandlerRes{NextState: SessStateBreak()}, nil
+					},
+				},
+			},
+		})
+
+		if err := bot.SessionStart(1, 1, SessState("menu")); err != nil {
+			t.Fatalf("session start error: %v", err)
+		}
+
+		if _, err := bot.SendMessage(1, 0, SendMessageData{
+			Message: "Menu",
+			Buttons: [][]Button{
+				{
+					{
+						Text:       "Cancel",
+						Identifier: "cancel",
+						Toast:      c.toast,
+					},
+				},
+			},
+			ButtonState: c.state,
+		}); err != nil {
+			t.Fatalf("send message error: %v", err)
+		}
+
+		u := testCallback(t, 1, 1, 10, c.state, "cancel")
+
+		// Toast is not a part of callback data
+		if d := testButtonData(t, bot); d != u.CallbackQuery.Data {
+			t.Fatalf("wrong callback data: %s", d)
+		}
+
+		testProcess(t, bot, u)
+
+		a := testSent(bot, "answerCallbackQuery")
+		if len(a) != 1 || a[0].Params["text"] != c.toast {
+			t.Fatalf("wrong callback answer: %+v", a)
+		}
+
+		// Destroyed session is initiated again by the next message
+		testProcess(t, bot, testMessage(2, 1, "hello"))
+
+		if c.destroy == true && (inits != 1 || messages != 0) || c.destroy == false && (inits != 0 || messages != 1) {
+			t.Fatalf("wrong session after `%s` button: inits %d, messages %d", c.toast, inits, messages)
+		}
+	}
+}
+
+func TestButtonToastResolve(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{CallbackAnswerManual: true}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(1, 1, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	send := func(toast string) {
+		if _, err := bot.SendMessage(1, 0, SendMessageData{
+			Message:     "Menu",
+			Buttons:     [][]Button{{{Text: "Save", Identifier: "save", Toast: toast, Alert: true}}},
+			ButtonState: SessState("menu"),
+		}); err != nil {
+			t.Fatalf("send message error: %v", err)
+		}
+	}
+
+	press := func(updateID int, chatID int64) {
+		u := testCallback(t, updateID, 1, 10, SessState("menu"), "save")
+		u.CallbackQuery.Message.Chat.ID = chatID
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	// Toast is resolved for the chat buttons were sent into
+	send("Saved")
+	press(1, 1)
+	press(2, 2)
+
+	// Stale toast is not shown for button re-sent without toast
+	send("")
+	press(3, 1)
+
+	// Toasts of messages sent in inline mode are keyed by inline message
+	if err := bot.EditInlineMessage("inline", SendMessageData{
+		Message:     "Menu",
+		Buttons:     [][]Button{{{Text: "Save", Identifier: "save", Toast: "Saved inline"}}},
+		ButtonState: SessState("menu"),
+	}); err != nil {
+		t.Fatalf("edit inline message error: %v", err)
+	}
+
+	u := testCallback(t, 4, 1, 0, SessState("menu"), "save")
+	u.CallbackQuery.Message = nil
+	u.CallbackQuery.InlineMessageID = "inline"
+	if err := bot.ProcessUpdate(u); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	a := testSent(bot, "answerCallbackQuery")
+	if len(a) != 2 || a[0].Params["text"] != "Saved" || a[0].Params["show_alert"] != "true" || a[1].Params["text"] != "Saved inline" {
+		t.Fatalf("wrong callback answers: %+v", a)
+	}
+}
@@ -2,7 +2,13 @@ package tg
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -10,6 +16,9 @@ import (
 // Update is an update response, from Telegram GetUpdates.
 type Update tgbotapi.Update
 
+// CallbackQuery is an incoming callback query from a button
+type CallbackQuery = tgbotapi.CallbackQuery
+
 // UpdateType is a type of update chain
 type UpdateType int
 
@@ -19,11 +28,32 @@ type UpdateChain struct {
 	updates    []Update
 }
 
+// callbackDataMaxLen is a Telegram limit for callback data length in bytes
+const callbackDataMaxLen = 64
+
+// callbackDataVersion is a current version of callback data layout. Version of
+// the initial layout is zero and it's not written into callback data, so it
+// does not take bytes of Telegram limit. Bump it on incompatible layout changes
+// and add migration into `callbackData.migrate()`
+const callbackDataVersion = 0
+
+// errCallbackDataStale is returned if callback data can not be decoded
+// (e.g. button was created by previous bot version with other layout)
+var errCallbackDataStale = errors.New("stale callback data")
+
 type callbackData struct {
+	V int    `json:"v,omitempty"`
 	S string `json:"s"`
 	I string `json:"i"`
 }
 
+// callbackToast contains notification shown to user after button pressed.
+// Toasts are kept in Redis rather than in callback data
+type callbackToast struct {
+	T string `json:"t"`
+	A bool   `json:"a,omitempty"`
+}
+
 const (
 
 	// UpdateTypeNone - type `none` for update chain.
@@ -38,10 +68,37 @@ const (
 
 	// UpdateTypeCallback - type callback
 	UpdateTypeCallback
+
+	// UpdateTypePreCheckout - type pre-checkout query (payments)
+	UpdateTypePreCheckout
+
+	// UpdateTypeShipping - type shipping query (payments)
+	UpdateTypeShipping
+)
+
+// Chat types returned by `UpdateChain.ChatType()`
+const (
+	ChatTypePrivate    = "private"
+	ChatTypeGroup      = "group"
+	ChatTypeSupergroup = "supergroup"
+	ChatTypeChannel    = "channel"
 )
 
 func (u UpdateType) String() string {
-	return [...]string{"none", "unknown", "message", "callback"}[u]
+	return [...]string{"none", "unknown", "message", "callback", "pre_checkout", "shipping"}[u]
+}
+
+// NewUpdateChain creates update chain from specified updates. Chain type
+// is defined by the first update with known type and updates with other
+// types are skipped (the same way as for updates from queue).
+// E.g. useful to test handlers
+func NewUpdateChain(updates ...Update) UpdateChain {
+
+	var uc UpdateChain
+
+	uc.add(updates)
+
+	return uc
 }
 
 // Get gets all updates from chain
@@ -49,6 +106,77 @@ func (uc *UpdateChain) Get() []Update {
 	return uc.updates
 }
 
+// Len gets number of updates in chain
+func (uc *UpdateChain) Len() int {
+	return len(uc.updates)
+}
+
+// Each calls `f` for every update in chain in order of their receiving
+func (uc *UpdateChain) Each(f func(Update)) {
+	for _, u := range uc.updates {
+		f(u)
+	}
+}
+
+// MessageDate gets the time the first message in chain was sent at.
+// Returns zero time if chain has not message type
+func (uc *UpdateChain) MessageDate() time.Time {
+
+	if uc.updateType != UpdateTypeMessage {
+		return time.Time{}
+	}
+
+	for _, u := range uc.updates {
+		if u.Message != nil {
+			return u.Message.Time()
+		}
+	}
+
+	return time.Time{}
+}
+
+// IsStale checks whether the first message in chain was sent earlier
+// than `maxAge` ago (e.g. before the bot restart). Chains without message
+// type are never stale
+func (uc *UpdateChain) IsStale(maxAge time.Duration) bool {
+
+	d := uc.MessageDate()
+	if d.IsZero() == true {
+		return false
+	}
+
+	return time.Since(d) > maxAge
+}
+
+// MediaGroupID gets media group (album) ID of messages in chain.
+// Returns false if chain contains no album items
+func (uc *UpdateChain) MediaGroupID() (string, bool) {
+
+	if uc.updateType != UpdateTypeMessage {
+		return "", false
+	}
+
+	for _, u := range uc.updates {
+		if u.Message != nil && len(u.Message.MediaGroupID) > 0 {
+			return u.Message.MediaGroupID, true
+		}
+	}
+
+	return "", false
+}
+
+// LastMessageText gets text (or caption) of the last message in chain
+// which has it. Returns empty string if chain has not message type
+func (uc *UpdateChain) LastMessageText() string {
+
+	text := uc.MessageTextGet()
+	if len(text) == 0 {
+		return ""
+	}
+
+	return text[len(text)-1]
+}
+
 // MessageTextGet gets messages text or captions for every update from chain.
 // Chain must have message type
 func (uc *UpdateChain) MessageTextGet() []string {
@@ -86,7 +214,10 @@ func (uc *UpdateChain) MessagesIDsGet() []int {
 		}
 	case UpdateTypeCallback:
 		for _, u := range uc.updates {
-			ids = append(ids, u.CallbackQuery.Message.MessageID)
+			// Callbacks from inline messages have no message
+			if u.CallbackQuery.Message != nil {
+				ids = append(ids, u.CallbackQuery.Message.MessageID)
+			}
 		}
 	}
 
@@ -106,6 +237,11 @@ func (uc *UpdateChain) MessagesIDGet() int {
 	case UpdateTypeMessage:
 		return u.Message.MessageID
 	case UpdateTypeCallback:
+		// Callbacks from inline messages have no message,
+		// so new message will be sent instead of editing
+		if u.CallbackQuery.Message == nil {
+			return 0
+		}
 		return u.CallbackQuery.Message.MessageID
 	}
 
@@ -127,6 +263,22 @@ func (uc *UpdateChain) CallbackQueryIDGet() string {
 	return uc.updates[0].CallbackQuery.ID
 }
 
+// CallbackQuery gets full callback query (e.g. to get inline message ID
+// or chat instance) from first update element from chain.
+// Returns nil if chain has not callback type
+func (uc *UpdateChain) CallbackQuery() *CallbackQuery {
+
+	if uc.updateType != UpdateTypeCallback {
+		return nil
+	}
+
+	if len(uc.updates) == 0 {
+		return nil
+	}
+
+	return uc.updates[0].CallbackQuery
+}
+
 // FilesGet gets files from update chain.
 // At the time only Photo, Document and Voice types are supported
 func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
@@ -143,7 +295,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 			// Get last element in array (largest by size)
 			f, err := fileGet(t, elt[len(elt)-1].FileID, "")
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -151,7 +303,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 		if elt := u.Message.Voice; elt != nil {
 			f, err := fileGet(t, (*elt).FileID, "")
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -159,7 +311,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 		if elt := u.Message.Document; elt != nil {
 			f, err := fileGet(t, elt.FileID, elt.FileName)
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -167,7 +319,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 		if elt := u.Message.Video; elt != nil {
 			f, err := fileGet(t, elt.FileID, elt.FileName)
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -175,7 +327,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 		if elt := u.Message.Audio; elt != nil {
 			f, err := fileGet(t, elt.FileID, elt.FileName)
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -183,7 +335,7 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 		if elt := u.Message.Sticker; elt != nil {
 			f, err := fileGet(t, elt.FileID, elt.Emoji)
 			if err != nil {
-				return []File{}, nil
+				return []File{}, err
 			}
 			files = append(files, f)
 		}
@@ -192,6 +344,60 @@ func (uc *UpdateChain) FilesGet(t Telegram) ([]File, error) {
 	return files, nil
 }
 
+// BotMentioned checks the bot with specified user name (without leading
+// '@' character) is mentioned in any message text or caption from chain.
+// Chain must have message type
+func (uc *UpdateChain) BotMentioned(botUserName string) bool {
+
+	if uc.updateType != UpdateTypeMessage || len(botUserName) == 0 {
+		return false
+	}
+
+	for _, u := range uc.updates {
+
+		for _, e := range u.Message.Entities {
+			if e.IsMention() == true && strings.EqualFold(entityTextGet(u.Message.Text, e), "@"+botUserName) == true {
+				return true
+			}
+		}
+
+		for _, e := range u.Message.CaptionEntities {
+			if e.IsMention() == true && strings.EqualFold(entityTextGet(u.Message.Caption, e), "@"+botUserName) == true {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsForwarded checks whether the first message in update chain was forwarded
+func (uc *UpdateChain) IsForwarded() bool {
+
+	if uc.updateType != UpdateTypeMessage || len(uc.updates) == 0 {
+		return false
+	}
+
+	m := uc.updates[0].Message
+
+	return m.ForwardDate != 0 || m.ForwardFrom != nil || m.ForwardFromChat != nil || len(m.ForwardSenderName) > 0
+}
+
+// ViaBot gets user name of the bot the first message in update chain was sent via
+// (inline mode). Returns false if message was not sent via bot
+func (uc *UpdateChain) ViaBot() (string, bool) {
+
+	if uc.updateType != UpdateTypeMessage || len(uc.updates) == 0 {
+		return "", false
+	}
+
+	if uc.updates[0].Message.ViaBot == nil {
+		return "", false
+	}
+
+	return uc.updates[0].Message.ViaBot.UserName, true
+}
+
 // TypeGet gets chain type
 func (uc *UpdateChain) TypeGet() UpdateType {
 	return uc.updateType
@@ -233,12 +439,31 @@ func (uc *UpdateChain) callbackSessionStateGet() (SessionState, string, error) {
 	}
 
 	if err := json.Unmarshal([]byte(data), &d); err != nil {
-		return sessionBreak, "", err
+		return sessionBreak, "", errCallbackDataStale
+	}
+
+	if d.migrate() == false {
+		return sessionBreak, "", errCallbackDataStale
 	}
 
 	return SessionState{d.S}, d.I, nil
 }
 
+// migrate converts callback data created by previous versions into current
+// layout. Returns false if data can not be converted
+func (d *callbackData) migrate() bool {
+	switch d.V {
+	case callbackDataVersion:
+		return true
+	case 1:
+		// Data with version 1 written by previous bot
+		// versions has the same layout as the initial one
+		d.V = callbackDataVersion
+		return true
+	}
+	return false
+}
+
 // callbackDataGet gets callback data from first update element from chain.
 // Chain must have callback type
 func (uc *UpdateChain) callbackDataGet() string {
@@ -256,8 +481,9 @@ func (uc *UpdateChain) callbackDataGet() string {
 
 // commandCheck checks first update element in chain has command signs.
 // If so command and its args will be returned.
+// Commands addressed to other bots (i.e. `/cmd@OtherBot`) are ignored.
 // Chain must have message type
-func (uc *UpdateChain) commandCheck() (string, string) {
+func (uc *UpdateChain) commandCheck(botUserName string) (string, string) {
 
 	if uc.updateType != UpdateTypeMessage {
 		return "", ""
@@ -269,7 +495,42 @@ func (uc *UpdateChain) commandCheck() (string, string) {
 
 	update := uc.updates[0]
 
-	return update.Message.Command(), update.Message.CommandArguments()
+	cmd := update.Message.CommandWithAt()
+	if i := strings.Index(cmd, "@"); i >= 0 {
+		if len(botUserName) > 0 && strings.EqualFold(cmd[i+1:], botUserName) == false {
+			return "", ""
+		}
+		cmd = cmd[:i]
+	}
+
+	return cmd, update.Message.CommandArguments()
+}
+
+// ChatType gets type of chat the update chain came from, i.e. one of
+// ChatTypePrivate, ChatTypeGroup, ChatTypeSupergroup or ChatTypeChannel.
+// Returns empty string if chat is unknown (e.g. for inline messages callbacks)
+func (uc *UpdateChain) ChatType() string {
+
+	if len(uc.updates) == 0 {
+		return ""
+	}
+
+	switch uc.updateType {
+	case UpdateTypeMessage:
+		return uc.updates[0].Message.Chat.Type
+	case UpdateTypeCallback:
+		if uc.updates[0].CallbackQuery.Message == nil {
+			return ""
+		}
+		return uc.updates[0].CallbackQuery.Message.Chat.Type
+	}
+
+	return ""
+}
+
+// chatPrivate checks first update element in chain is from private chat
+func (uc *UpdateChain) chatPrivate() bool {
+	return uc.ChatType() == ChatTypePrivate
 }
 
 // updateTypeEltGet gets type for specified update element
@@ -283,6 +544,14 @@ func updateTypeEltGet(update Update) UpdateType {
 		return UpdateTypeCallback
 	}
 
+	if update.PreCheckoutQuery != nil {
+		return UpdateTypePreCheckout
+	}
+
+	if update.ShippingQuery != nil {
+		return UpdateTypeShipping
+	}
+
 	return UpdateTypeUnknown
 }
 
@@ -293,7 +562,17 @@ func updateIDsGet(update Update) (int64, int64) {
 	case UpdateTypeMessage:
 		return update.Message.Chat.ID, update.Message.From.ID
 	case UpdateTypeCallback:
+		// Callbacks from inline messages have no chat,
+		// use the private chat with user
+		if update.CallbackQuery.Message == nil {
+			return update.CallbackQuery.From.ID, update.CallbackQuery.From.ID
+		}
 		return update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.From.ID
+	case UpdateTypePreCheckout:
+		// Payment queries carry no chat, use the private chat with user
+		return update.PreCheckoutQuery.From.ID, update.PreCheckoutQuery.From.ID
+	case UpdateTypeShipping:
+		return update.ShippingQuery.From.ID, update.ShippingQuery.From.ID
 	}
 
 	return 0, 0
@@ -307,6 +586,10 @@ func updateUserNameGet(update Update) string {
 		return update.Message.From.UserName
 	case UpdateTypeCallback:
 		return update.CallbackQuery.From.UserName
+	case UpdateTypePreCheckout:
+		return update.PreCheckoutQuery.From.UserName
+	case UpdateTypeShipping:
+		return update.ShippingQuery.From.UserName
 	}
 
 	return ""
@@ -320,6 +603,10 @@ func updateFirstNameGet(update Update) string {
 		return update.Message.From.FirstName
 	case UpdateTypeCallback:
 		return update.CallbackQuery.From.FirstName
+	case UpdateTypePreCheckout:
+		return update.PreCheckoutQuery.From.FirstName
+	case UpdateTypeShipping:
+		return update.ShippingQuery.From.FirstName
 	}
 
 	return ""
@@ -333,6 +620,27 @@ func updateLastNameGet(update Update) string {
 		return update.Message.From.LastName
 	case UpdateTypeCallback:
 		return update.CallbackQuery.From.LastName
+	case UpdateTypePreCheckout:
+		return update.PreCheckoutQuery.From.LastName
+	case UpdateTypeShipping:
+		return update.ShippingQuery.From.LastName
+	}
+
+	return ""
+}
+
+// updateLanguageGet gets user language code from specified update element
+func updateLanguageGet(update Update) string {
+
+	switch updateTypeEltGet(update) {
+	case UpdateTypeMessage:
+		return update.Message.From.LanguageCode
+	case UpdateTypeCallback:
+		return update.CallbackQuery.From.LanguageCode
+	case UpdateTypePreCheckout:
+		return update.PreCheckoutQuery.From.LanguageCode
+	case UpdateTypeShipping:
+		return update.ShippingQuery.From.LanguageCode
 	}
 
 	return ""
@@ -341,6 +649,7 @@ func updateLastNameGet(update Update) string {
 func callbackDataGen(state SessionState, identifier string) (string, error) {
 
 	d := callbackData{
+		V: callbackDataVersion,
 		S: state.state,
 		I: identifier,
 	}
@@ -353,6 +662,80 @@ func callbackDataGen(state SessionState, identifier string) (string, error) {
 	return string(b), nil
 }
 
+// IdentifierPack packs specified structured value (e.g. `{"action":"del","id":42}`)
+// into button identifier. Note that Telegram limits callback data with 64 bytes
+// including a state name and identifier (quotes within identifier are escaped
+// and take extra bytes), so keep the value short. Exceeding the limit is
+// reported when message is sent
+func IdentifierPack(v interface{}) (string, error) {
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// IdentifierUnpack unpacks button identifier packed with `IdentifierPack` into `v`
+func IdentifierUnpack(identifier string, v interface{}) error {
+	if err := json.Unmarshal([]byte(identifier), v); err != nil {
+		return fmt.Errorf("%w: %v", ErrCallbackDataFormat, err)
+	}
+	return nil
+}
+
+// callbackAnswerOnly checks callback with specified data is from answer-only button
+func callbackAnswerOnly(data string) bool {
+
+	var d callbackData
+
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return false
+	}
+
+	return d.S == sessionAnswer.state
+}
+
+// callbackToastsKeyGet gets key of toasts for buttons of message callback
+// query is from (see `toastsKeyGet()`)
+func callbackToastsKeyGet(cq *tgbotapi.CallbackQuery) string {
+
+	if cq.Message != nil && cq.Message.Chat != nil {
+		return toastsKeyGet(cq.Message.Chat.ID, "")
+	}
+
+	if len(cq.InlineMessageID) > 0 {
+		return toastsKeyGet(0, cq.InlineMessageID)
+	}
+
+	return ""
+}
+
+// toastsKeyGet gets key of toasts for buttons of messages. Regular messages
+// are keyed by chat, messages sent in inline mode by inline message ID
+func toastsKeyGet(chatID int64, inlineMessageID string) string {
+
+	if len(inlineMessageID) > 0 {
+		return "inline:" + inlineMessageID
+	}
+
+	return strconv.FormatInt(chatID, 10)
+}
+
+// entityTextGet gets text of specified message entity.
+// Note that entities offsets are measured in UTF-16 code units
+func entityTextGet(text string, e tgbotapi.MessageEntity) string {
+
+	t := utf16.Encode([]rune(text))
+
+	if e.Offset < 0 || e.Length < 0 || e.Offset+e.Length > len(t) {
+		return ""
+	}
+
+	return string(utf16.Decode(t[e.Offset : e.Offset+e.Length]))
+}
+
 // fileGet gets file by specified file ID from Telegram
 // If `fileName` is empty base part of file path will be used.
 func fileGet(t Telegram, fileID, fileName string) (File, error) {
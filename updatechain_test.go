@@ -0,0 +1,531 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// testInlineCallback makes an update with press of button with `identifier`
+// for `state` on message sent via the bot in inline mode
+func testInlineCallback(t *testing.T, updateID int, userID int64, state SessionState, identifier string) Update {
+
+	t.Helper()
+
+	u := testCallback(t, updateID, userID, 0, state, identifier)
+	u.CallbackQuery.Message = nil
+	u.CallbackQuery.InlineMessageID = "inline"
+
+	return u
+}
+
+func TestUpdateIDsGetInlineCallback(t *testing.T) {
+
+	u := testInlineCallback(t, 1, 42, SessState("menu"), "x")
+
+	chatID, userID := updateIDsGet(u)
+	if chatID != 42 || userID != 42 {
+		t.Fatalf("wrong IDs for inline callback: chat %d, user %d", chatID, userID)
+	}
+
+	var uc UpdateChain
+	uc.add([]Update{u})
+
+	if id := uc.MessagesIDGet(); id != 0 {
+		t.Fatalf("wrong message ID for inline callback: %d", id)
+	}
+	if ids := uc.MessagesIDsGet(); len(ids) != 0 {
+		t.Fatalf("wrong message IDs for inline callback: %v", ids)
+	}
+	if ct := uc.ChatType(); ct != "" {
+		t.Fatalf("wrong chat type for inline callback: %s", ct)
+	}
+}
+
+func TestProcessUpdateInlineCallback(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					return CallbackHandlerRes{NextState: SessState("done")}, nil
+				},
+			},
+			SessState("done"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{
+						Message:      "done",
+						StickMessage: true,
+						NextState:    SessStateBreak(),
+					}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(42, 42, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	if err := bot.ProcessUpdate(testInlineCallback(t, 1, 42, SessState("menu"), "x")); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	// Message without chat can not be edited, new one must be sent
+	if r := testSent(bot, "editMessageText"); len(r) != 0 {
+		t.Fatalf("unexpected edits: %v", r)
+	}
+
+	r := testSent(bot, "sendMessage")
+	if len(r) != 1 {
+		t.Fatalf("expected one sent message, got %d", len(r))
+	}
+	if r[0].Params["chat_id"] != "42" || r[0].Params["text"] != "done" {
+		t.Fatalf("wrong sent message: %v", r[0].Params)
+	}
+}
+
+func TestEditInlineMessage(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	err := bot.EditInlineMessage("inline", SendMessageData{
+		Message:   "text",
+		ParseMode: ParseModeHTML,
+		Buttons: [][]Button{
+			{
+				{Text: "Open", Identifier: "https://example.com", Mode: ButtonModeURL},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("edit inline message error: %v", err)
+	}
+
+	r := testSent(bot, "editMessageText")
+	if len(r) != 1 {
+		t.Fatalf("expected one edit, got %d", len(r))
+	}
+
+	p := r[0].Params
+	if p["inline_message_id"] != "inline" || p["text"] != "text" || p["parse_mode"] != "HTML" {
+		t.Fatalf("wrong edit request: %v", p)
+	}
+	if _, b := p["chat_id"]; b == true {
+		t.Fatalf("inline edit must not contain chat ID: %v", p)
+	}
+	if _, b := p["message_id"]; b == true {
+		t.Fatalf("inline edit must not contain message ID: %v", p)
+	}
+	if len(p["reply_markup"]) == 0 {
+		t.Fatalf("inline edit must contain buttons: %v", p)
+	}
+}
+
+func TestIdentifierPack(t *testing.T) {
+
+	type action struct {
+		Action string `json:"action"`
+		ID     int    `json:"id"`
+	}
+
+	identifier, err := IdentifierPack(action{Action: "del", ID: 42})
+	if err != nil {
+		t.Fatalf("identifier pack error: %v", err)
+	}
+
+	// Packed identifier fits callback data wrapped with state
+	if _, err := keyboardPrepare([][]Button{{{Text: "Delete", Identifier: identifier}}}, SessState("list")); err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	var got action
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		States: map[SessionState]State{
+			SessState("list"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					if err := IdentifierUnpack(identifier, &got); err != nil {
+						return CallbackHandlerRes{}, err
+					}
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.ProcessUpdate(testCallback(t, 1, 1, 1, SessState("list"), identifier)); err != nil {
+		t.Fatalf("process update error: %v", err)
+	}
+
+	if got.Action != "del" || got.ID != 42 {
+		t.Fatalf("wrong unpacked identifier: %+v", got)
+	}
+
+	if err := IdentifierUnpack("del:42", &got); errors.Is(err, ErrCallbackDataFormat) == false {
+		t.Fatalf("wrong identifier must be reported, got: %v", err)
+	}
+}
+
+func TestIdentifierPackTooLong(t *testing.T) {
+
+	identifier, err := IdentifierPack(map[string]string{"action": "delete", "comment": "too long identifier"})
+	if err != nil {
+		t.Fatalf("identifier pack error: %v", err)
+	}
+
+	_, err = keyboardPrepare([][]Button{{{Text: "Delete", Identifier: identifier}}}, SessState("list"))
+	if errors.Is(err, ErrCallbackDataTooLong) == false {
+		t.Fatalf("too long identifier must be reported, got: %v", err)
+	}
+}
+
+func TestChatType(t *testing.T) {
+
+	for _, ct := range []string{ChatTypePrivate, ChatTypeGroup, ChatTypeSupergroup, ChatTypeChannel} {
+
+		u := testGroupMessage(1, -100, 42, "hi")
+		u.Message.Chat.Type = ct
+
+		uc := NewUpdateChain(u)
+		if r := uc.ChatType(); r != ct {
+			t.Fatalf("wrong chat type for message: expected %s, got %s", ct, r)
+		}
+
+		c := testCallback(t, 2, 42, 1, SessState("menu"), "x")
+		c.CallbackQuery.Message.Chat.Type = ct
+
+		uc = NewUpdateChain(c)
+		if r := uc.ChatType(); r != ct {
+			t.Fatalf("wrong chat type for callback: expected %s, got %s", ct, r)
+		}
+	}
+
+	var uc UpdateChain
+	if r := uc.ChatType(); r != "" {
+		t.Fatalf("wrong chat type for empty chain: %s", r)
+	}
+}
+
+func TestForwardedViaBot(t *testing.T) {
+
+	plain := testMessage(1, 42, "hi")
+
+	forwarded := testMessage(2, 42, "hi")
+	forwarded.Message.ForwardFrom = &tgbotapi.User{ID: 7}
+	forwarded.Message.ForwardDate = 1700000000
+
+	hidden := testMessage(3, 42, "hi")
+	hidden.Message.ForwardSenderName = "Hidden User"
+	hidden.Message.ForwardDate = 1700000000
+
+	via := testMessage(4, 42, "hi")
+	via.Message.ViaBot = &tgbotapi.User{ID: 8, IsBot: true, UserName: "gif"}
+
+	for _, c := range []struct {
+		name      string
+		u         Update
+		forwarded bool
+		viaBot    string
+	}{
+		{"plain", plain, false, ""},
+		{"forwarded", forwarded, true, ""},
+		{"hidden sender", hidden, true, ""},
+		{"via bot", via, false, "gif"},
+		{"callback", testCallback(t, 5, 42, 1, SessState("menu"), "x"), false, ""},
+	} {
+
+		uc := NewUpdateChain(c.u)
+
+		if r := uc.IsForwarded(); r != c.forwarded {
+			t.Fatalf("%s: expected forwarded %t, got %t", c.name, c.forwarded, r)
+		}
+
+		name, b := uc.ViaBot()
+		if name != c.viaBot || b != (len(c.viaBot) > 0) {
+			t.Fatalf("%s: expected via bot `%s`, got `%s` (%t)", c.name, c.viaBot, name, b)
+		}
+	}
+}
+
+func TestCallbackQuery(t *testing.T) {
+
+	u := testInlineCallback(t, 1, 42, SessState("menu"), "x")
+	u.CallbackQuery.ChatInstance = "instance"
+	u.CallbackQuery.GameShortName = "game"
+
+	uc := NewUpdateChain(u)
+
+	q := uc.CallbackQuery()
+	if q == nil {
+		t.Fatalf("callback query must be returned for callback chain")
+	}
+	if q != u.CallbackQuery || q.InlineMessageID != "inline" || q.ChatInstance != "instance" || q.GameShortName != "game" {
+		t.Fatalf("wrong callback query: %+v", q)
+	}
+
+	uc = NewUpdateChain(testMessage(2, 42, "hi"))
+	if q := uc.CallbackQuery(); q != nil {
+		t.Fatalf("callback query must be nil for message chain: %+v", q)
+	}
+}
+
+func TestCallbackDataVersion(t *testing.T) {
+
+	// Version of the current layout is not written
+	d, err := callbackDataGen(SessState("menu"), "x")
+	if err != nil {
+		t.Fatalf("callback data gen error: %v", err)
+	}
+	if d != `{"s":"user:menu","i":"x"}` {
+		t.Fatalf("wrong callback data: %s", d)
+	}
+
+	for _, c := range []struct {
+		data       string
+		state      SessionState
+		identifier string
+		err        error
+	}{
+		// Buttons created before data versioning
+		{`{"s":"user:menu","i":"x"}`, SessState("menu"), "x", nil},
+		{`{"v":1,"s":"user:menu","i":"x","t":"Done"}`, SessState("menu"), "x", nil},
+		{`{"v":2,"s":"user:menu","i":"x"}`, sessionBreak, "", errCallbackDataStale},
+		{`{"v":99,"s":"user:menu","i":"x"}`, sessionBreak, "", errCallbackDataStale},
+		{`menu:x`, sessionBreak, "", errCallbackDataStale},
+	} {
+
+		u := testCallback(t, 1, 42, 10, SessState("menu"), "")
+		u.CallbackQuery.Data = c.data
+
+		uc := NewUpdateChain(u)
+
+		s, i, err := uc.callbackSessionStateGet()
+		if err != c.err || s != c.state || i != c.identifier {
+			t.Fatalf("wrong callback data `%s` decoding: state %v, identifier `%s`, error %v", c.data, s, i, err)
+		}
+	}
+}
+
+func TestCallbackDataStale(t *testing.T) {
+
+	var defaults, callbacks int
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		DefaultHandler: func(t *Telegram, s *Session) (DefaultHandlerRes, error) {
+			defaults++
+			return DefaultHandlerRes{NextState: SessStateBreak()}, nil
+		},
+		States: map[SessionState]State{
+			SessState("menu"): {
+				CallbackHandler: func(t *Telegram, s *Session, identifier string) (CallbackHandlerRes, error) {
+					callbacks++
+					return CallbackHandlerRes{NextState: SessStateBreak()}, nil
+				},
+			},
+		},
+	})
+
+	if err := bot.SessionStateSet(42, 42, SessState("menu")); err != nil {
+		t.Fatalf("session state set error: %v", err)
+	}
+
+	for i, data := range []string{`{"s":"user:menu","i":"x"}`, `{"v":99,"s":"user:menu"}`} {
+
+		u := testCallback(t, i+1, 42, 10, SessState("menu"), "")
+		u.CallbackQuery.Data = data
+
+		if err := bot.ProcessUpdate(u); err != nil {
+			t.Fatalf("process update error: %v", err)
+		}
+	}
+
+	// Stale callback is routed to default handler
+	if callbacks != 1 || defaults != 1 {
+		t.Fatalf("wrong handlers calls: callback %d, default %d", callbacks, defaults)
+	}
+}
+
+func TestUpdateChainHelpers(t *testing.T) {
+
+	photo := testMessage(3, 42, "")
+	photo.Message.Caption = "photo caption"
+
+	empty := testMessage(4, 42, "")
+
+	uc := NewUpdateChain(testMessage(1, 42, "first"), testMessage(2, 42, "second"), photo, empty)
+
+	if uc.Len() != 4 {
+		t.Fatalf("wrong chain length: %d", uc.Len())
+	}
+
+	// Messages without text are skipped
+	if r := uc.LastMessageText(); r != "photo caption" {
+		t.Fatalf("wrong last message text: `%s`", r)
+	}
+
+	var ids []int
+	uc.Each(func(u Update) {
+		ids = append(ids, u.UpdateID)
+	})
+	if fmt.Sprint(ids) != "[1 2 3 4]" {
+		t.Fatalf("wrong updates iteration order: %v", ids)
+	}
+
+	var e UpdateChain
+	if e.Len() != 0 || e.LastMessageText() != "" {
+		t.Fatalf("wrong helpers result for empty chain")
+	}
+	e.Each(func(u Update) {
+		t.Fatalf("no updates must be iterated for empty chain")
+	})
+}
+
+// testAlbumPhoto makes an update with photo which is an item of album `group`
+func testAlbumPhoto(updateID int, userID int64, group, fileID string) Update {
+
+	u := testMessage(updateID, userID, "")
+	u.Message.MediaGroupID = group
+	u.Message.Photo = []tgbotapi.PhotoSize{
+		{FileID: fileID + "_small", Width: 90, Height: 90},
+		{FileID: fileID, Width: 800, Height: 800},
+	}
+
+	return u
+}
+
+func TestMediaGroupFiles(t *testing.T) {
+
+	var (
+		files []string
+		group string
+	)
+
+	bot := testBotInitHTTP(t, Settings{MediaGroupWait: 50 * time.Millisecond}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+
+			group, _ = s.UpdateChain().MediaGroupID()
+
+			fs, err := s.UpdateChain().FilesGet(*t)
+			if err != nil {
+				return InitHandlerRes{}, err
+			}
+			for _, f := range fs {
+				files = append(files, f.FileIDGet()+":"+f.FileName)
+			}
+
+			return InitHandlerRes{NextState: SessStateBreak()}, nil
+		},
+	}, func(method string, req *http.Request) (*http.Response, error) {
+
+		if method != "getFile" {
+			return nil, nil
+		}
+
+		if err := req.ParseForm(); err != nil {
+			return nil, err
+		}
+		id := req.PostForm.Get("file_id")
+
+		return testResponse(req, http.StatusOK, fmt.Sprintf(`{"ok":true,"result":{"file_id":%q,"file_path":"photos/%s.jpg"}}`, id, id)), nil
+	})
+
+	for i, id := range []string{"p1", "p2", "p3"} {
+		if err := bot.UpdateAbsorb(testAlbumPhoto(i+1, 42, "album", id)); err != nil {
+			t.Fatalf("absorb error: %v", err)
+		}
+	}
+
+	// Album items are waited for
+	if err := bot.Processing(); err != nil {
+		t.Fatalf("processing error: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("album must not be processed until media group wait elapsed")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := bot.Processing(); err != nil {
+		t.Fatalf("processing error: %v", err)
+	}
+
+	if group != "album" {
+		t.Fatalf("wrong media group ID: `%s`", group)
+	}
+	if fmt.Sprint(files) != "[p1:p1.jpg p2:p2.jpg p3:p3.jpg]" {
+		t.Fatalf("wrong album files: %v", files)
+	}
+}
+
+func TestNewUpdateChain(t *testing.T) {
+
+	pc := Update{
+		UpdateID:         9,
+		PreCheckoutQuery: &tgbotapi.PreCheckoutQuery{ID: "pc", From: &tgbotapi.User{ID: 42}},
+	}
+
+	for _, c := range []struct {
+		name     string
+		updates  []Update
+		typ      UpdateType
+		expected int
+	}{
+		{"messages", []Update{testMessage(1, 42, "a"), testMessage(2, 42, "b")}, UpdateTypeMessage, 2},
+		{"callback", []Update{testCallback(t, 3, 42, 1, SessState("menu"), "x")}, UpdateTypeCallback, 1},
+		{"pre-checkout", []Update{pc}, UpdateTypePreCheckout, 1},
+
+		// Elements of other type than the first one are skipped
+		{"mixed", []Update{testMessage(4, 42, "a"), testCallback(t, 5, 42, 1, SessState("menu"), "x"), testMessage(6, 42, "b")}, UpdateTypeMessage, 2},
+
+		// Unknown updates are skipped
+		{"unknown", []Update{{UpdateID: 7}, testCallback(t, 8, 42, 1, SessState("menu"), "x")}, UpdateTypeCallback, 1},
+		{"empty", nil, UpdateTypeNone, 0},
+	} {
+
+		uc := NewUpdateChain(c.updates...)
+
+		if uc.TypeGet() != c.typ || uc.Len() != c.expected {
+			t.Fatalf("%s: wrong chain type %v or length %d", c.name, uc.TypeGet(), uc.Len())
+		}
+	}
+}
+
+func TestMessageDate(t *testing.T) {
+
+	now := time.Now()
+
+	fresh := testMessage(1, 42, "fresh")
+	fresh.Message.Date = int(now.Add(-10 * time.Second).Unix())
+
+	old := testMessage(2, 42, "old")
+	old.Message.Date = int(now.Add(-time.Hour).Unix())
+
+	for _, c := range []struct {
+		u     Update
+		stale bool
+	}{
+		{fresh, false},
+		{old, true},
+	} {
+
+		uc := NewUpdateChain(c.u)
+
+		if d := uc.MessageDate(); d.Unix() != int64(c.u.Message.Date) {
+			t.Fatalf("wrong message date: %v", d)
+		}
+		if s := uc.IsStale(time.Minute); s != c.stale {
+			t.Fatalf("message `%s`: expected stale %t, got %t", c.u.Message.Text, c.stale, s)
+		}
+	}
+
+	// Callbacks have no message date and are never stale
+	uc := NewUpdateChain(testCallback(t, 3, 42, 1, SessState("menu"), "x"))
+	if uc.MessageDate().IsZero() == false || uc.IsStale(time.Minute) == true {
+		t.Fatalf("callback must have no message date")
+	}
+}
@@ -0,0 +1,46 @@
+package tg
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestUploadSizeLimit checks file size is checked before upload
+func TestUploadSizeLimit(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{UploadSizeLimit: 10}, Description{})
+
+	dir := t.TempDir()
+
+	for name, size := range map[string]int{"small.bin": 10, "big.bin": 11} {
+		if err := os.WriteFile(dir+"/"+name, make([]byte, size), 0644); err != nil {
+			t.Fatalf("write file error: %v", err)
+		}
+	}
+
+	if _, err := bot.UploadFile(1, FileSend{FileType: FileTypeDocument, FilePath: dir + "/big.bin"}); errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+
+	if _, err := bot.UploadFileStream(1, FileSendStream{
+		FileType: FileTypeDocument,
+		FileName: "big.bin",
+		FileSize: 11,
+	}, strings.NewReader("data")); errors.Is(err, ErrFileTooLarge) == false {
+		t.Fatalf("expected error %v, got %v", ErrFileTooLarge, err)
+	}
+
+	// Too large files are not sent to Telegram
+	if r := testSent(bot, "sendDocument"); len(r) != 0 {
+		t.Fatalf("too large files must not be uploaded: %+v", r)
+	}
+
+	if _, err := bot.UploadFile(1, FileSend{FileType: FileTypeDocument, FilePath: dir + "/small.bin"}); err != nil {
+		t.Fatalf("upload error: %v", err)
+	}
+	if r := testSent(bot, "sendDocument"); len(r) != 1 {
+		t.Fatalf("expected one upload, got %d", len(r))
+	}
+}
@@ -0,0 +1,60 @@
+package tg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStateValidator(t *testing.T) {
+
+	var emails []string
+
+	bot := testBotInit(t, nil, Settings{}, Description{
+		InitHandler: func(t *Telegram, s *Session) (InitHandlerRes, error) {
+			return InitHandlerRes{NextState: SessState("email")}, nil
+		},
+		States: map[SessionState]State{
+			SessState("email"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{Message: "Enter email"}, nil
+				},
+				Validator: func(t *Telegram, s *Session) error {
+					if e := strings.Join(s.UpdateChain().MessageTextGet(), "\n"); strings.Contains(e, "@") == false {
+						return fmt.Errorf("Wrong email: <%s>", e)
+					}
+					return nil
+				},
+				MessageHandler: func(t *Telegram, s *Session) (MessageHandlerRes, error) {
+					emails = append(emails, s.UpdateChain().MessageTextGet()...)
+					return MessageHandlerRes{NextState: SessState("done")}, nil
+				},
+			},
+			SessState("done"): {
+				StateHandler: func(t *Telegram, s *Session) (StateHandlerRes, error) {
+					return StateHandlerRes{Message: "Thanks"}, nil
+				},
+			},
+		},
+	})
+
+	testProcess(t, bot,
+		testMessage(1, 1, "hi"),
+		testMessage(2, 1, "foo"),
+		testMessage(3, 1, "user@example.com"),
+	)
+
+	// Wrong input is not passed to message handler
+	if fmt.Sprint(emails) != "[user@example.com]" {
+		t.Fatalf("wrong handled emails: %v", emails)
+	}
+
+	// Validator error is sent to user and the state is re-prompted
+	var texts []string
+	for _, r := range testSent(bot, "sendMessage") {
+		texts = append(texts, r.Params["text"])
+	}
+	if strings.Join(texts, "|") != "Enter email|Wrong email: &lt;foo&gt;|Enter email|Thanks" {
+		t.Fatalf("wrong sent messages: %v", texts)
+	}
+}
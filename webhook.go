@@ -0,0 +1,82 @@
+package tg
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookShutdownTimeout is a time to wait active requests while webhook server shutdown
+const webhookShutdownTimeout = 10 * time.Second
+
+// WebhookHandler returns http.Handler to receive updates from Telegram
+// in webhook mode. Every received update is put into queue with `UpdateAbsorb`
+func (t *Telegram) WebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		u, err := t.bot.HandleUpdate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := t.UpdateAbsorb(Update(*u)); err != nil {
+			// Telegram will redeliver the update
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// ServeWebhook starts HTTP server (or HTTPS if webhook `KeyFile` is set)
+// on `addr`, registers webhook handler on the path from webhook URL (incl.
+// bot token) and serves until `ctx` is done. Webhook settings must be
+// specified at bot init, the webhook itself is set there too. Note that
+// received updates are put into queue, use `Processing()` to process them
+func (t *Telegram) ServeWebhook(ctx context.Context, addr string) error {
+
+	if t.webhook == nil {
+		return ErrWebhookNotSet
+	}
+
+	u, err := url.Parse(webhookURLGet(t.webhook))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(u.Path, t.WebhookHandler())
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: mux,
+	}
+
+	// Bind the address first to report listen errors before serving
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan error, 1)
+	go func() {
+		if len(t.webhook.KeyFile) > 0 {
+			ch <- srv.ServeTLS(l, t.webhook.CertFile, t.webhook.KeyFile)
+		} else {
+			ch <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		sctx, cf := context.WithTimeout(context.Background(), webhookShutdownTimeout)
+		defer cf()
+		return srv.Shutdown(sctx)
+	}
+}
@@ -0,0 +1,139 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWebhookUpdate is an update sent by Telegram in webhook mode
+const testWebhookUpdate = `{"update_id":1,"message":{"message_id":1,"from":{"id":1},"chat":{"id":1,"type":"private"},"date":0,"text":"hello"}}`
+
+func TestWebhookHandler(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{UpdateQueueWait: time.Minute}, Description{})
+
+	for _, c := range []struct {
+		body   string
+		status int
+	}{
+		{testWebhookUpdate, http.StatusOK},
+		{"{wrong", http.StatusBadRequest},
+	} {
+
+		w := httptest.NewRecorder()
+
+		bot.WebhookHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(c.body)))
+
+		if w.Code != c.status {
+			t.Fatalf("wrong response status for `%s`: expected %d, got %d", c.body, c.status, w.Code)
+		}
+	}
+
+	// Received update is put into queue
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Chats != 1 || qs.Updates != 1 {
+		t.Fatalf("wrong queue stats: %+v", qs)
+	}
+}
+
+func TestServeWebhook(t *testing.T) {
+
+	bot := testBotInit(t, nil, Settings{}, Description{})
+
+	if err := bot.ServeWebhook(context.Background(), "127.0.0.1:0"); errors.Is(err, ErrWebhookNotSet) == false {
+		t.Fatalf("expected error %v, got %v", ErrWebhookNotSet, err)
+	}
+
+	// Get free port to listen on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	addr := l.Addr().String()
+
+	bot = testBotInit(t, nil, Settings{
+		BotSettings: SettingsBot{
+			Webhook: &SettingsBotWebhook{
+				URL:      "https://example.com/hook",
+				BotToken: "secret",
+			},
+		},
+		UpdateQueueWait: time.Minute,
+	}, Description{})
+
+	// Listen error is returned right away
+	if err := bot.ServeWebhook(context.Background(), addr); err == nil {
+		t.Fatal("expected listen error for busy address")
+	}
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.ServeWebhook(ctx, addr)
+	}()
+
+	// Wait for server to start
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		resp, err = http.Post("http://"+addr+"/hook/secret", "application/json", strings.NewReader(testWebhookUpdate))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("webhook request error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("wrong webhook response status: %d", resp.StatusCode)
+	}
+
+	// Handler is registered on the token path only
+	resp, err = http.Post("http://"+addr+"/hook/other", "application/json", strings.NewReader(testWebhookUpdate))
+	if err != nil {
+		t.Fatalf("webhook request error: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("wrong response status for other path: %d", resp.StatusCode)
+	}
+
+	qs, err := bot.QueueStats()
+	if err != nil {
+		t.Fatalf("queue stats error: %v", err)
+	}
+	if qs.Updates != 1 {
+		t.Fatalf("wrong queue stats: %+v", qs)
+	}
+
+	// Webhook is set on init only
+	r := testSent(bot, "setWebhook")
+	if len(r) != 1 || r[0].Params["url"] != "https://example.com/hook/secret" {
+		t.Fatalf("wrong setWebhook requests: %+v", r)
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve webhook error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server must be stopped on context cancel")
+	}
+}
@@ -0,0 +1,280 @@
+package tg
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WidgetAction it's a type of action widget returns after callback processing
+type WidgetAction int
+
+const (
+
+	// WidgetActionNone - nothing to do (e.g. caption button pressed)
+	WidgetActionNone WidgetAction = iota
+
+	// WidgetActionUpdate - widget must be re-rendered with new value
+	WidgetActionUpdate
+
+	// WidgetActionDone - user completed the input
+	WidgetActionDone
+)
+
+func (w WidgetAction) String() string {
+	return [...]string{"none", "update", "done"}[w]
+}
+
+// CalendarRes contains result of calendar callback processing
+type CalendarRes struct {
+
+	// Action defines what host handler should do
+	Action WidgetAction
+
+	// Date contains a month to render calendar for (for `WidgetActionUpdate`)
+	// or selected date (for `WidgetActionDone`)
+	Date time.Time
+}
+
+// NumPadRes contains result of number pad callback processing
+type NumPadRes struct {
+
+	// Action defines what host handler should do
+	Action WidgetAction
+
+	// Value contains a current number pad value (for `WidgetActionUpdate`)
+	// or entered value (for `WidgetActionDone`)
+	Value string
+}
+
+// PageRes contains result of pagination callback processing
+type PageRes struct {
+
+	// Action defines what host handler should do
+	Action WidgetAction
+
+	// Page contains a page number to render (for `WidgetActionUpdate`)
+	Page int
+}
+
+const (
+	calendarPrefix = "cal:"
+	numPadPrefix   = "np:"
+	pagePrefix     = "pg:"
+
+	// numPadValueMaxLen is a max length of number pad value to fit Telegram callback data limit
+	numPadValueMaxLen = 16
+)
+
+// CalendarButtons creates inline keyboard with a calendar for the month of `month`.
+// Use it within the StateHandler and process the callbacks with `CalendarParse()`
+// within the CallbackHandler of the same state
+func CalendarButtons(month time.Time) [][]Button {
+
+	var (
+		buttons [][]Button
+		row     []Button
+	)
+
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	// Navigation row
+	buttons = append(buttons, []Button{
+		{Text: "«", Identifier: calendarPrefix + "m:" + first.AddDate(0, -1, 0).Format("2006-01")},
+		{Text: first.Format("January 2006"), Identifier: calendarPrefix + "n"},
+		{Text: "»", Identifier: calendarPrefix + "m:" + first.AddDate(0, 1, 0).Format("2006-01")},
+	})
+
+	// Week days row
+	for _, d := range []string{"Mo", "Tu", "We", "Th", "Fr", "Sa", "Su"} {
+		row = append(row, Button{Text: d, Identifier: calendarPrefix + "n"})
+	}
+	buttons = append(buttons, row)
+	row = nil
+
+	// Blank cells before the first day of month (week starts on Monday)
+	for i := 0; i < (int(first.Weekday())+6)%7; i++ {
+		row = append(row, Button{Text: " ", Identifier: calendarPrefix + "n"})
+	}
+
+	for d := first; d.Month() == first.Month(); d = d.AddDate(0, 0, 1) {
+		row = append(row, Button{Text: strconv.Itoa(d.Day()), Identifier: calendarPrefix + "d:" + d.Format("2006-01-02")})
+		if len(row) == 7 {
+			buttons = append(buttons, row)
+			row = nil
+		}
+	}
+
+	// Blank cells after the last day of month
+	if len(row) > 0 {
+		for len(row) < 7 {
+			row = append(row, Button{Text: " ", Identifier: calendarPrefix + "n"})
+		}
+		buttons = append(buttons, row)
+	}
+
+	return buttons
+}
+
+// CalendarParse processes identifier of button pressed in calendar.
+// Returns false if identifier does not belong to calendar
+func CalendarParse(identifier string) (CalendarRes, bool) {
+
+	if strings.HasPrefix(identifier, calendarPrefix) == false {
+		return CalendarRes{}, false
+	}
+
+	a := strings.SplitN(strings.TrimPrefix(identifier, calendarPrefix), ":", 2)
+	if len(a) != 2 {
+		return CalendarRes{Action: WidgetActionNone}, true
+	}
+
+	switch a[0] {
+	case "m":
+		m, err := time.Parse("2006-01", a[1])
+		if err != nil {
+			return CalendarRes{Action: WidgetActionNone}, true
+		}
+		return CalendarRes{Action: WidgetActionUpdate, Date: m}, true
+	case "d":
+		d, err := time.Parse("2006-01-02", a[1])
+		if err != nil {
+			return CalendarRes{Action: WidgetActionNone}, true
+		}
+		return CalendarRes{Action: WidgetActionDone, Date: d}, true
+	}
+
+	return CalendarRes{Action: WidgetActionNone}, true
+}
+
+// NumPadButtons creates inline keyboard with a number pad for current `value`.
+// Use it within the StateHandler and process the callbacks with `NumPadParse()`
+// within the CallbackHandler of the same state
+func NumPadButtons(value string) [][]Button {
+
+	var buttons [][]Button
+
+	digit := func(d string) Button {
+		v := value + d
+		if len(v) > numPadValueMaxLen {
+			v = value
+		}
+		return Button{Text: d, Identifier: numPadPrefix + "v:" + v}
+	}
+
+	for _, r := range [][]string{{"1", "2", "3"}, {"4", "5", "6"}, {"7", "8", "9"}} {
+		var row []Button
+		for _, d := range r {
+			row = append(row, digit(d))
+		}
+		buttons = append(buttons, row)
+	}
+
+	bs := value
+	if len(bs) > 0 {
+		bs = bs[:len(bs)-1]
+	}
+
+	buttons = append(buttons, []Button{
+		{Text: "⌫", Identifier: numPadPrefix + "v:" + bs},
+		digit("0"),
+		{Text: "OK", Identifier: numPadPrefix + "ok:" + value},
+	})
+
+	return buttons
+}
+
+// NumPadParse processes identifier of button pressed in number pad.
+// Returns false if identifier does not belong to number pad
+func NumPadParse(identifier string) (NumPadRes, bool) {
+
+	if strings.HasPrefix(identifier, numPadPrefix) == false {
+		return NumPadRes{}, false
+	}
+
+	a := strings.SplitN(strings.TrimPrefix(identifier, numPadPrefix), ":", 2)
+	if len(a) != 2 {
+		return NumPadRes{Action: WidgetActionNone}, true
+	}
+
+	switch a[0] {
+	case "v":
+		return NumPadRes{Action: WidgetActionUpdate, Value: a[1]}, true
+	case "ok":
+		return NumPadRes{Action: WidgetActionDone, Value: a[1]}, true
+	}
+
+	return NumPadRes{Action: WidgetActionNone}, true
+}
+
+// PageButtons creates inline keyboard with `items` (one per row) for the
+// zero-based `page` of `pageSize` items and navigation row. Items keep their
+// identifiers. Use it within the StateHandler and process the callbacks with
+// `PageParse()` within the CallbackHandler of the same state (identifiers
+// not belonging to pagination are items pressed)
+func PageButtons(items []Button, page, pageSize int) [][]Button {
+
+	var buttons [][]Button
+
+	if pageSize <= 0 || len(items) == 0 {
+		return buttons
+	}
+
+	pages := (len(items) + pageSize - 1) / pageSize
+
+	if page < 0 {
+		page = 0
+	}
+	if page >= pages {
+		page = pages - 1
+	}
+
+	e := (page + 1) * pageSize
+	if e > len(items) {
+		e = len(items)
+	}
+
+	for _, i := range items[page*pageSize : e] {
+		buttons = append(buttons, []Button{i})
+	}
+
+	// Navigation row is not needed for single page
+	if pages == 1 {
+		return buttons
+	}
+
+	var nav []Button
+
+	if page > 0 {
+		nav = append(nav, Button{Text: "«", Identifier: pagePrefix + "p:" + strconv.Itoa(page-1)})
+	}
+
+	nav = append(nav, Button{Text: strconv.Itoa(page+1) + "/" + strconv.Itoa(pages), Identifier: pagePrefix + "n"})
+
+	if page < pages-1 {
+		nav = append(nav, Button{Text: "»", Identifier: pagePrefix + "p:" + strconv.Itoa(page+1)})
+	}
+
+	return append(buttons, nav)
+}
+
+// PageParse processes identifier of button pressed in pagination navigation.
+// Returns false if identifier does not belong to pagination
+func PageParse(identifier string) (PageRes, bool) {
+
+	if strings.HasPrefix(identifier, pagePrefix) == false {
+		return PageRes{}, false
+	}
+
+	a := strings.SplitN(strings.TrimPrefix(identifier, pagePrefix), ":", 2)
+	if len(a) != 2 || a[0] != "p" {
+		return PageRes{Action: WidgetActionNone}, true
+	}
+
+	p, err := strconv.Atoi(a[1])
+	if err != nil || p < 0 {
+		return PageRes{Action: WidgetActionNone}, true
+	}
+
+	return PageRes{Action: WidgetActionUpdate, Page: p}, true
+}
@@ -0,0 +1,201 @@
+package tg
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPageNav gets texts of pagination navigation buttons
+// and target pages they lead to
+func testPageNav(t *testing.T, rows [][]Button) string {
+
+	t.Helper()
+
+	var nav []string
+
+	for _, b := range rows[len(rows)-1] {
+
+		r, ok := PageParse(b.Identifier)
+		if ok == false {
+			t.Fatalf("navigation button `%s` is not recognized: `%s`", b.Text, b.Identifier)
+		}
+
+		if r.Action == WidgetActionUpdate {
+			nav = append(nav, fmt.Sprintf("%s->%d", b.Text, r.Page))
+		} else {
+			nav = append(nav, b.Text)
+		}
+	}
+
+	return fmt.Sprint(nav)
+}
+
+func TestPageButtons(t *testing.T) {
+
+	var items []Button
+	for _, id := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		items = append(items, Button{Text: id, Identifier: id})
+	}
+
+	for _, c := range []struct {
+		page  int
+		items string
+		nav   string
+	}{
+		{0, "[[a] [b] [c]]", "[1/3 »->1]"},
+		{1, "[[d] [e] [f]]", "[«->0 2/3 »->2]"},
+		{2, "[[g]]", "[«->1 3/3]"},
+	} {
+
+		rows := PageButtons(items, c.page, 3)
+
+		if r := testKeyboardLayout(rows[:len(rows)-1]); r != c.items {
+			t.Fatalf("page %d: expected items %s, got %s", c.page, c.items, r)
+		}
+		if r := testPageNav(t, rows); r != c.nav {
+			t.Fatalf("page %d: expected navigation %s, got %s", c.page, c.nav, r)
+		}
+
+		// Buttons fit callback data limits
+		if _, err := keyboardPrepare(rows, SessState("list")); err != nil {
+			t.Fatalf("page %d: keyboard prepare error: %v", c.page, err)
+		}
+	}
+
+	// Single page has no navigation
+	if r := testKeyboardLayout(PageButtons(items[:2], 0, 3)); r != "[[a] [b]]" {
+		t.Fatalf("wrong single page layout: %s", r)
+	}
+
+	// Items do not belong to pagination
+	if _, ok := PageParse("a"); ok == true {
+		t.Fatalf("item identifier must not be recognized as pagination")
+	}
+}
+
+// testButtonTexts gets texts of keyboard buttons by rows
+func testButtonTexts(rows [][]Button) string {
+
+	var r []string
+
+	for _, row := range rows {
+		var texts []string
+		for _, b := range row {
+			texts = append(texts, b.Text)
+		}
+		r = append(r, strings.Join(texts, " "))
+	}
+
+	return strings.Join(r, "|")
+}
+
+// testButtonFind finds button with specified text
+func testButtonFind(t *testing.T, rows [][]Button, text string) Button {
+
+	t.Helper()
+
+	for _, row := range rows {
+		for _, b := range row {
+			if b.Text == text {
+				return b
+			}
+		}
+	}
+
+	t.Fatalf("button `%s` not found", text)
+
+	return Button{}
+}
+
+func TestCalendarButtons(t *testing.T) {
+
+	rows := CalendarButtons(time.Date(2024, time.February, 15, 10, 0, 0, 0, time.UTC))
+
+	// February 2024 starts on Thursday and has 29 days
+	expected := "« February 2024 »|Mo Tu We Th Fr Sa Su|" +
+		"      1 2 3 4|5 6 7 8 9 10 11|12 13 14 15 16 17 18|19 20 21 22 23 24 25|26 27 28 29      "
+	if r := testButtonTexts(rows); r != expected {
+		t.Fatalf("wrong calendar layout: %s", r)
+	}
+
+	// Buttons fit callback data limits
+	if _, err := keyboardPrepare(rows, SessState("date")); err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	for _, c := range []struct {
+		button string
+		action WidgetAction
+		date   string
+	}{
+		{"«", WidgetActionUpdate, "2024-01-01"},
+		{"»", WidgetActionUpdate, "2024-03-01"},
+		{"February 2024", WidgetActionNone, "0001-01-01"},
+		{"Mo", WidgetActionNone, "0001-01-01"},
+		{"29", WidgetActionDone, "2024-02-29"},
+	} {
+
+		r, ok := CalendarParse(testButtonFind(t, rows, c.button).Identifier)
+		if ok == false {
+			t.Fatalf("button `%s` must belong to calendar", c.button)
+		}
+		if r.Action != c.action || r.Date.Format("2006-01-02") != c.date {
+			t.Fatalf("button `%s`: wrong result: %v %s", c.button, r.Action, r.Date.Format("2006-01-02"))
+		}
+	}
+
+	// Navigation crosses the year
+	r, _ := CalendarParse(testButtonFind(t, CalendarButtons(time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC)), "»").Identifier)
+	if r.Date.Format("2006-01") != "2024-01" {
+		t.Fatalf("wrong next month: %s", r.Date.Format("2006-01"))
+	}
+
+	if _, ok := CalendarParse("a"); ok == true {
+		t.Fatal("other identifier must not be recognized as calendar")
+	}
+}
+
+func TestNumPadButtons(t *testing.T) {
+
+	rows := NumPadButtons("12")
+
+	if r := testButtonTexts(rows); r != "1 2 3|4 5 6|7 8 9|⌫ 0 OK" {
+		t.Fatalf("wrong number pad layout: %s", r)
+	}
+
+	// Buttons fit callback data limits
+	if _, err := keyboardPrepare(NumPadButtons(strings.Repeat("9", numPadValueMaxLen)), SessState("amount")); err != nil {
+		t.Fatalf("keyboard prepare error: %v", err)
+	}
+
+	for _, c := range []struct {
+		value  string
+		button string
+		action WidgetAction
+		result string
+	}{
+		{"12", "3", WidgetActionUpdate, "123"},
+		{"12", "0", WidgetActionUpdate, "120"},
+		{"12", "⌫", WidgetActionUpdate, "1"},
+		{"", "⌫", WidgetActionUpdate, ""},
+		{"12", "OK", WidgetActionDone, "12"},
+
+		// Value is not extended over the max length
+		{strings.Repeat("1", numPadValueMaxLen), "5", WidgetActionUpdate, strings.Repeat("1", numPadValueMaxLen)},
+	} {
+
+		r, ok := NumPadParse(testButtonFind(t, NumPadButtons(c.value), c.button).Identifier)
+		if ok == false {
+			t.Fatalf("button `%s` must belong to number pad", c.button)
+		}
+		if r.Action != c.action || r.Value != c.result {
+			t.Fatalf("`%s` + `%s`: wrong result: %v `%s`", c.value, c.button, r.Action, r.Value)
+		}
+	}
+
+	if _, ok := NumPadParse("a"); ok == true {
+		t.Fatal("other identifier must not be recognized as number pad")
+	}
+}